@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package backoff
+
+// backoff provides exponential backoff with jitter,
+// used when re-dialing streams or retrying connections to remote machines
+//
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const defaultFactor = 2
+
+type Backoff struct {
+	min    time.Duration
+	max    time.Duration
+	factor float64
+
+	attempt int
+
+	mu *sync.Mutex
+}
+
+func NewBackoff(
+	min time.Duration,
+	max time.Duration,
+) *Backoff {
+	return &Backoff{
+		min:    min,
+		max:    max,
+		factor: defaultFactor,
+
+		mu: &sync.Mutex{},
+	}
+}
+
+// returns the time to wait before the next attempt and advances the attempt.
+// the wait is picked at random from the upper half of the exponential step
+// so that machines which lost the server at the same time do not come back at the same time
+//
+func (b *Backoff) Duration() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := float64(b.min) * math.Pow(b.factor, float64(b.attempt))
+	if d > float64(b.max) || math.IsInf(d, 0) {
+		d = float64(b.max)
+	}
+	b.attempt++
+
+	half := d / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+func (b *Backoff) Attempt() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.attempt
+}
+
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attempt = 0
+}
@@ -5,9 +5,11 @@
 package grpc
 
 import (
+	"context"
 	"crypto/tls"
 
 	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/utils"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
@@ -24,3 +26,22 @@ func NewGrpcDialOption(dotlog *dotlog.DotLog, isdebug bool) grpc.DialOption {
 
 	return option
 }
+
+// sends the auth key with every request, the server registers the machine
+// with it instead of waiting for the login through the login url
+//
+func NewAuthKeyOption(authKey string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(authKeyCredentials(authKey))
+}
+
+type authKeyCredentials string
+
+func (a authKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{utils.AuthKey: string(a)}, nil
+}
+
+// the insecure connection of the debug mode sends it as well
+//
+func (a authKeyCredentials) RequireTransportSecurity() bool {
+	return false
+}
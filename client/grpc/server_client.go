@@ -6,6 +6,10 @@ package grpc
 
 import (
 	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/login_session"
 	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
@@ -22,10 +26,22 @@ type ServerClientImpl interface {
 
 	SyncRemoteMachinesConfig(mk string) (*machine.SyncMachinesResponse, error)
 
-	// ConnectToHangoutMachines(mk string, handler func(msg *machine.HangOutMachinesResponse) error) error
+	ConnectToHangoutMachines(mk string, connected func(), handler func(msg *machine.HangOutMachinesResponse) error) error
 	JoinHangoutMachines(mk string) (*machine.HangOutMachinesResponse, error)
 
 	ConnectStreamPeerLoginSession(mk string) (*login_session.PeerLoginSessionResponse, error)
+
+	SetAdvertise(a Advertise)
+	DNSRoutes() []string
+	PeerTags() []string
+}
+
+// what this machine offers to the others. it is sent with the requests about the machines,
+// and the server shares it with the remote peers in the allowed ips of this machine
+type Advertise struct {
+	ExitNode bool
+	// subnets of the local networks this machine forwards to, e.g. 192.168.1.0/24
+	Routes []string
 }
 
 type ServerClient struct {
@@ -33,7 +49,18 @@ type ServerClient struct {
 	loginSessionClient login_session.LoginSessionServiceClient
 	conn               *grpc.ClientConn
 	ctx                context.Context
-	dotlog             *dotlog.DotLog
+
+	advertise Advertise
+
+	// nameservers of the domains pushed by the server in the response headers,
+	// e.g. corp.example=10.0.0.53,10.0.0.54. the ones of the last response which had the header
+	dnsRoutes []string
+	// tags of the remote peers pushed by the server, e.g. <machine key>=db,prod
+	peerTags []string
+
+	mu *sync.Mutex
+
+	dotlog *dotlog.DotLog
 }
 
 func NewServerClient(
@@ -45,20 +72,75 @@ func NewServerClient(
 		loginSessionClient: login_session.NewLoginSessionServiceClient(conn),
 		conn:               conn,
 		ctx:                context.Background(),
-		dotlog:             dotlog,
+
+		mu: &sync.Mutex{},
+
+		dotlog: dotlog,
+	}
+}
+
+func (c *ServerClient) SetAdvertise(a Advertise) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.advertise = a
+}
+
+func (c *ServerClient) DNSRoutes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.dnsRoutes
+}
+
+func (c *ServerClient) PeerTags() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.peerTags
+}
+
+// keeps what the server pushes in the response header, see the header contract in utils/key.go
+//
+func (c *ServerClient) receiveHeader(header metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// only a response with the header replaces them
+	if v, ok := header[utils.DNSRoutes]; ok {
+		c.dnsRoutes = v
+	}
+	if v, ok := header[utils.PeerTags]; ok {
+		c.peerTags = v
 	}
 }
 
+// adds the advertisement of this machine to md, see the header contract in utils/key.go
+//
+func (c *ServerClient) withAdvertise(md metadata.MD) metadata.MD {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	md.Set(utils.AdvertiseExitNode, strconv.FormatBool(c.advertise.ExitNode))
+	if len(c.advertise.Routes) > 0 {
+		md.Set(utils.AdvertiseRoutes, strings.Join(c.advertise.Routes, ","))
+	}
+
+	return md
+}
+
 // TODO: (shinta) remove SIGNAL_HOST and SIGNAL_PORT from env,
 // use the SignalHost and SignalPort in response
 func (c *ServerClient) GetMachine(mk, wgPubKey string) (*machine.GetMachineResponse, error) {
-	md := metadata.New(map[string]string{utils.MachineKey: mk, utils.WgPubKey: wgPubKey})
+	md := c.withAdvertise(metadata.New(map[string]string{utils.MachineKey: mk, utils.WgPubKey: wgPubKey}))
 	ctx := metadata.NewOutgoingContext(c.ctx, md)
 
-	res, err := c.machineClient.GetMachine(ctx, &emptypb.Empty{})
+	var header metadata.MD
+	res, err := c.machineClient.GetMachine(ctx, &emptypb.Empty{}, grpc.Header(&header))
 	if err != nil {
 		return nil, err
 	}
+	c.receiveHeader(header)
 
 	return &machine.GetMachineResponse{
 		IsRegistered: res.IsRegistered,
@@ -109,54 +191,78 @@ func (c *ServerClient) ConnectStreamPeerLoginSession(mk string) (*login_session.
 }
 
 func (c *ServerClient) SyncRemoteMachinesConfig(mk string) (*machine.SyncMachinesResponse, error) {
-	md := metadata.New(map[string]string{utils.MachineKey: mk})
+	md := c.withAdvertise(metadata.New(map[string]string{utils.MachineKey: mk}))
 	newctx := metadata.NewOutgoingContext(c.ctx, md)
 
-	conf, err := c.machineClient.SyncRemoteMachinesConfig(newctx, &emptypb.Empty{})
+	var header metadata.MD
+	conf, err := c.machineClient.SyncRemoteMachinesConfig(newctx, &emptypb.Empty{}, grpc.Header(&header))
 	if err != nil {
 		return nil, err
 	}
+	c.receiveHeader(header)
 
 	return conf, nil
 }
 
-// func (c *ServerClient) ConnectToHangoutMachines(mk string, handler func(msg *machine.HangOutMachinesResponse) error) error {
-// 	md := metadata.New(map[string]string{utils.MachineKey: mk})
-// 	newctx := metadata.NewOutgoingContext(c.ctx, md)
-
-// 	stream, err := c.machineClient.ConnectToHangoutMachines(newctx, &emptypb.Empty{})
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	for {
-// 		hangout, err := stream.Recv()
-// 		if err == io.EOF {
-// 			c.dotlog.Logger.Errorf("hangout machines return to EOF, received by [%s]", mk)
-// 			return err
-// 		}
-
-// 		if err != nil {
-// 			c.dotlog.Logger.Errorf("disconnect hangout machines, received by [%s], %s", mk, err.Error())
-// 			return err
-// 		}
-
-// 		err = handler(hangout)
-// 		if err != nil {
-// 			c.dotlog.Logger.Errorf("error handle with hangout machines, received by [%s]", mk)
-// 			return err
-// 		}
-// 	}
-// }
+// ConnectToHangoutMachines opens a long-lived stream on which the server pushes
+// machines joining, leaving or changing. connected is called when the first message has arrived,
+// before it is handled, and it blocks until the stream is closed
+//
+func (c *ServerClient) ConnectToHangoutMachines(
+	mk string,
+	connected func(),
+	handler func(msg *machine.HangOutMachinesResponse) error,
+) error {
+	md := c.withAdvertise(metadata.New(map[string]string{utils.MachineKey: mk}))
+	newctx := metadata.NewOutgoingContext(c.ctx, md)
+
+	stream, err := c.machineClient.ConnectToHangoutMachines(newctx, &emptypb.Empty{}, grpc.WaitForReady(true))
+	if err != nil {
+		return err
+	}
+
+	received := false
+	for {
+		hangout, err := stream.Recv()
+		if err == io.EOF {
+			c.dotlog.Logger.Errorf("hangout machines return to EOF, received by [%s]", mk)
+			return err
+		}
+
+		if err != nil {
+			c.dotlog.Logger.Errorf("disconnect hangout machines, received by [%s], %s", mk, err.Error())
+			return err
+		}
+
+		// the stream is established only once the first message has arrived,
+		// WaitForReady returns as soon as the transport is up
+		if !received {
+			received = true
+			header, err := stream.Header()
+			if err == nil {
+				c.receiveHeader(header)
+			}
+			connected()
+		}
+
+		err = handler(hangout)
+		if err != nil {
+			c.dotlog.Logger.Errorf("error handle with hangout machines, received by [%s]", mk)
+			return err
+		}
+	}
+}
 
 func (c *ServerClient) JoinHangoutMachines(mk string) (*machine.HangOutMachinesResponse, error) {
-	md := metadata.New(map[string]string{utils.MachineKey: mk})
+	md := c.withAdvertise(metadata.New(map[string]string{utils.MachineKey: mk}))
 	newctx := metadata.NewOutgoingContext(c.ctx, md)
 
-	res, err := c.machineClient.JoinHangOutMachines(newctx, &emptypb.Empty{})
+	var header metadata.MD
+	res, err := c.machineClient.JoinHangOutMachines(newctx, &emptypb.Empty{}, grpc.Header(&header))
 	if err != nil {
 		return nil, err
 	}
+	c.receiveHeader(header)
 
 	return res, nil
 }
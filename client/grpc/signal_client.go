@@ -27,15 +27,15 @@ type SignalClientImpl interface {
 	Offer(dstmk, srcmk string, uFlag string, pwd string) error
 	Answer(dstmk, srcmk string, uFlag string, pwd string) error
 
-	StartConnect(mk string, handler func(msg *negotiation.NegotiationRequest) error) error
+	StartConnect(mk string, connected func(), handler func(msg *negotiation.NegotiationRequest) error) error
 
 	WaitStartConnect()
 	IsReady() bool
 	GetStunTurnConfig() (*rtc.GetStunTurnConfigResponse, error)
 
-	// Status
-	DisConnected() error
-	Connected() error
+	// Status of the signal stream,
+	// the connection to each remote machine is tracked by conn.PeerStatusStore
+	Reconnecting() error
 	GetConnStatus() string
 }
 
@@ -145,7 +145,14 @@ func (c *SignalClient) connectStream(ctx context.Context) (negotiation.Negotiati
 	return stream, nil
 }
 
-func (c *SignalClient) StartConnect(mk string, handler func(msg *negotiation.NegotiationRequest) error) error {
+// connected is called once the first message has arrived on the stream, as ConnectToHangoutMachines does,
+// and it blocks until the stream is closed
+//
+func (c *SignalClient) StartConnect(
+	mk string,
+	connected func(),
+	handler func(msg *negotiation.NegotiationRequest) error,
+) error {
 	md := metadata.New(map[string]string{utils.MachineKey: mk})
 	ctx := metadata.NewOutgoingContext(c.ctx, md)
 
@@ -154,6 +161,8 @@ func (c *SignalClient) StartConnect(mk string, handler func(msg *negotiation.Neg
 		return err
 	}
 
+	defer c.connState.DisConnected()
+
 	defer func() {
 		err := stream.CloseSend()
 		if err != nil {
@@ -162,6 +171,7 @@ func (c *SignalClient) StartConnect(mk string, handler func(msg *negotiation.Neg
 		}
 	}()
 
+	received := false
 	for {
 		msg, err := stream.Recv()
 		if err == io.EOF {
@@ -169,10 +179,17 @@ func (c *SignalClient) StartConnect(mk string, handler func(msg *negotiation.Neg
 			return err
 		}
 		if err != nil {
-			c.dotlog.Logger.Errorf("failed to get grpc client stream for machinek key: %s", msg.DstPeerMachineKey)
+			c.dotlog.Logger.Errorf("failed to get grpc client stream for machine key: %s, %s", mk, err.Error())
 			return err
 		}
 
+		// the stream is established only once the first message has arrived,
+		// WaitForReady returns as soon as the transport is up
+		if !received {
+			received = true
+			connected()
+		}
+
 		err = handler(msg)
 		if err != nil {
 			c.dotlog.Logger.Errorf("failed to handle grpc client stream stream in machine key: %s", msg.DstPeerMachineKey)
@@ -208,18 +225,12 @@ func (c *SignalClient) GetStunTurnConfig() (*rtc.GetStunTurnConfigResponse, erro
 	return conf, nil
 }
 
-func (c *SignalClient) DisConnected() error {
-	c.connState.DisConnected()
-	return nil
-}
-
-func (c *SignalClient) Connected() error {
-	c.connState.Connected()
+func (c *SignalClient) Reconnecting() error {
+	c.connState.Reconnecting()
 	return nil
 }
 
 func (c *SignalClient) GetConnStatus() string {
-	c.connState.Connected()
 	status := c.connState.GetConnStatus()
 	return status.String()
 }
@@ -6,20 +6,29 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	grpc_client "github.com/Notch-Technologies/dotshake/client/grpc"
+	"github.com/Notch-Technologies/dotshake/conf"
 	"github.com/Notch-Technologies/dotshake/daemon"
 	dd "github.com/Notch-Technologies/dotshake/daemon/dotshaker"
 	"github.com/Notch-Technologies/dotshake/dotengine"
 	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/iface/filter"
 	"github.com/Notch-Technologies/dotshake/paths"
 	"github.com/Notch-Technologies/dotshake/process"
+	"github.com/Notch-Technologies/dotshake/rcn/controlplane"
+	"github.com/Notch-Technologies/dotshake/rcn/dns"
+	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
 	"github.com/Notch-Technologies/dotshake/types/flagtype"
 	"github.com/peterbourgon/ff/v2/ffcli"
 )
@@ -33,6 +42,15 @@ var upArgs struct {
 	logFile    string
 	logLevel   string
 	debug      bool
+
+	exitNode          string
+	advertiseExitNode bool
+	advertiseRoutes   string
+	dnsRoutes         string
+	packetFilter      string
+
+	// to tell the flags given from the defaults
+	fs *flag.FlagSet
 }
 
 var upCmd = &ffcli.Command{
@@ -49,6 +67,12 @@ var upCmd = &ffcli.Command{
 		fs.StringVar(&upArgs.logFile, "logfile", paths.DefaultClientLogFile(), "set logfile path")
 		fs.StringVar(&upArgs.logLevel, "loglevel", dotlog.InfoLevelStr, "set log level")
 		fs.BoolVar(&upArgs.debug, "debug", false, "is debug")
+		fs.StringVar(&upArgs.exitNode, "exit-node", "", "overlay ip or machine key of the remote machine to route all traffic to, empty to stop using an exit node")
+		fs.BoolVar(&upArgs.advertiseExitNode, "advertise-exit-node", false, "forward the traffic of the remote machines to the internet")
+		fs.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "comma separated subnets of the local networks to expose to the remote machines, e.g. 192.168.1.0/24, empty to stop advertising")
+		fs.StringVar(&upArgs.dnsRoutes, "dns-routes", "", "semicolon separated nameservers of the domains to resolve through the tunnel, e.g. corp.example=10.0.0.53,10.0.0.54;lab.example=10.1.0.53, empty to clear")
+		fs.StringVar(&upArgs.packetFilter, "packet-filter", "", "json file of the rules of the new connections the remote machines may open to this machine, empty to accept all of them. the pings and the dns queries are always accepted")
+		upArgs.fs = fs
 		return fs
 	})(),
 	Exec: execUp,
@@ -81,6 +105,12 @@ func execUp(ctx context.Context, args []string) error {
 		dotlog.Logger.Warnf("You need to activate dotshaker. execute this command 'dotshaker up'")
 	}
 
+	err = updatePrefs(clientConf, dotlog)
+	if err != nil {
+		dotlog.Logger.Warnf("failed to update prefs. because %v", err)
+		return err
+	}
+
 	err = upEngine(ctx, serverClient, dotlog, clientConf.TunName, mPubKey, ip, cidr, clientConf.WgPrivateKey, clientConf.BlackList)
 	if err != nil {
 		dotlog.Logger.Warnf("failed to start engine. because %v", err)
@@ -109,6 +139,117 @@ func execUp(ctx context.Context, args []string) error {
 	return nil
 }
 
+// saves the prefs given by the flags to the client config,
+// and applies them to the daemon when it is running
+//
+func updatePrefs(clientConf *conf.ClientConf, dotlog *dotlog.DotLog) error {
+	changed := false
+	var perr error
+	upArgs.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "exit-node":
+			clientConf.ExitNode = upArgs.exitNode
+			changed = true
+		case "advertise-exit-node":
+			clientConf.AdvertiseExitNode = upArgs.advertiseExitNode
+			changed = true
+		case "advertise-routes":
+			routes, err := controlplane.ParseRoutes(strings.Split(upArgs.advertiseRoutes, ","))
+			if err != nil {
+				perr = err
+				return
+			}
+			clientConf.AdvertiseRoutes = routes
+			changed = true
+		case "dns-routes":
+			routes, err := dns.ParseRoutes(strings.Split(upArgs.dnsRoutes, ";"))
+			if err != nil {
+				perr = err
+				return
+			}
+			clientConf.DNSRoutes = routes
+			changed = true
+		case "packet-filter":
+			policy, err := readPacketFilter(upArgs.packetFilter)
+			if err != nil {
+				perr = err
+				return
+			}
+			clientConf.PacketFilter = policy
+			changed = true
+		}
+	})
+	if perr != nil {
+		return perr
+	}
+	if !changed {
+		return nil
+	}
+
+	err := clientConf.Save()
+	if err != nil {
+		return err
+	}
+
+	sock := rcnsock.NewRcnSock(dotlog, nil)
+	err = sock.DialPrefs(rcnsock.Prefs{
+		ExitNode:          clientConf.ExitNode,
+		AdvertiseExitNode: clientConf.AdvertiseExitNode,
+		AdvertiseRoutes:   clientConf.AdvertiseRoutes,
+		DNSRoutes:         clientConf.DNSRoutes,
+		PacketFilter:      clientConf.PacketFilter,
+	})
+	if err != nil {
+		// applied when dotshaker starts
+		dotlog.Logger.Warnf("saved the prefs, but failed to apply them to dotshaker, %s", err.Error())
+		return nil
+	}
+
+	if clientConf.ExitNode != "" {
+		fmt.Printf("routing all traffic to exit node %s\n", clientConf.ExitNode)
+	}
+	if clientConf.AdvertiseExitNode {
+		fmt.Printf("advertising this machine as an exit node\n")
+	}
+	if len(clientConf.AdvertiseRoutes) > 0 {
+		fmt.Printf("advertising routes %s\n", strings.Join(clientConf.AdvertiseRoutes, ", "))
+	}
+	for domain, nameservers := range clientConf.DNSRoutes {
+		fmt.Printf("resolving %s through %s\n", domain, strings.Join(nameservers, ", "))
+	}
+	if clientConf.PacketFilter != nil {
+		fmt.Printf("filtering the new connections from the remote machines with %d rules\n", len(clientConf.PacketFilter.Rules))
+	}
+
+	return nil
+}
+
+// reads the policy of the packet filter from the json file at path, nil when path is empty
+//
+func readPacketFilter(path string) (*filter.Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &filter.Policy{}
+	err = json.Unmarshal(b, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the packet filter %s, %w", path, err)
+	}
+
+	err = policy.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet filter %s, %w", path, err)
+	}
+
+	return policy, nil
+}
+
 func upEngine(
 	ctx context.Context,
 	serverClient grpc_client.ServerClientImpl,
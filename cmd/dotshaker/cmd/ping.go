@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/paths"
+	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
+	"github.com/peterbourgon/ff/v2/ffcli"
+)
+
+var pingArgs struct {
+	count    int
+	interval time.Duration
+
+	logFile  string
+	logLevel string
+	debug    bool
+}
+
+var pingCmd = &ffcli.Command{
+	Name:       "ping",
+	ShortUsage: "ping [flags] <overlay ip>",
+	ShortHelp:  "ping a remote machine through the overlay of the userspace networking mode",
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("ping", flag.ExitOnError)
+		fs.IntVar(&pingArgs.count, "c", 4, "number of echo requests to send")
+		fs.DurationVar(&pingArgs.interval, "i", time.Second, "interval between the echo requests")
+		fs.StringVar(&pingArgs.logFile, "logfile", paths.DefaultDotShakerLogFile(), "set logfile path")
+		fs.StringVar(&pingArgs.logLevel, "loglevel", dotlog.InfoLevelStr, "set log level")
+		fs.BoolVar(&pingArgs.debug, "debug", false, "is debug")
+		return fs
+	})(),
+	Exec: execPing,
+}
+
+func execPing(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: dotshaker ping [flags] <overlay ip>")
+	}
+	ip := args[0]
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid ip %s", ip)
+	}
+
+	err := dotlog.InitDotLog(pingArgs.logLevel, pingArgs.logFile, pingArgs.debug)
+	if err != nil {
+		log.Fatalf("failed to initialize logger: %v", err)
+	}
+	dotlog := dotlog.NewDotLog("ping")
+
+	sock := rcnsock.NewRcnSock(dotlog, nil)
+
+	var received int
+	for n := 0; n < pingArgs.count; n++ {
+		if n > 0 {
+			time.Sleep(pingArgs.interval)
+		}
+
+		rtt, err := sock.DialPing(ip)
+		if err != nil {
+			fmt.Printf("no reply from %s, %s\n", ip, err.Error())
+			continue
+		}
+		received++
+		fmt.Printf("pong from %s in %s\n", ip, rtt.Round(time.Microsecond).String())
+	}
+
+	if received == 0 {
+		return fmt.Errorf("no reply from %s", ip)
+	}
+	return nil
+}
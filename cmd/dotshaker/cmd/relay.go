@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/paths"
+	"github.com/Notch-Technologies/dotshake/rcn/relay"
+	"github.com/peterbourgon/ff/v2/ffcli"
+)
+
+var relayArgs struct {
+	listen   string
+	wsListen string
+	wsPath   string
+	certFile string
+	keyFile  string
+	token    string
+	insecure bool
+	logFile  string
+	logLevel string
+	debug    bool
+}
+
+var relayCmd = &ffcli.Command{
+	Name:       "relay",
+	ShortUsage: "relay [flags]",
+	ShortHelp:  "run a relay server for the machines which can not connect with ice",
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("relay", flag.ExitOnError)
+		fs.StringVar(&relayArgs.listen, "listen", ":3480", "tcp address to serve relay streams over tls")
+		fs.StringVar(&relayArgs.wsListen, "ws-listen", "", "tcp address to serve relay streams over websocket, disabled when empty")
+		fs.StringVar(&relayArgs.wsPath, "ws-path", "/relay", "http path of the websocket")
+		fs.StringVar(&relayArgs.certFile, "cert", "", "tls certificate file")
+		fs.StringVar(&relayArgs.keyFile, "key", "", "tls private key file")
+		fs.StringVar(&relayArgs.token, "token", "", "token the machines must present, set the same relay_token in their client config")
+		fs.BoolVar(&relayArgs.insecure, "insecure", false, "allow serving without -token, and without tls when -cert and -key are not set")
+		fs.StringVar(&relayArgs.logFile, "logfile", paths.DefaultDotShakerLogFile(), "set logfile path")
+		fs.StringVar(&relayArgs.logLevel, "loglevel", dotlog.InfoLevelStr, "set log level")
+		fs.BoolVar(&relayArgs.debug, "debug", false, "for debug")
+		return fs
+	})(),
+	Exec: execRelay,
+}
+
+func relayListen(addr string, dotlog *dotlog.DotLog) (net.Listener, error) {
+	if relayArgs.certFile == "" || relayArgs.keyFile == "" {
+		if !relayArgs.insecure {
+			return nil, errors.New("-cert and -key are required, set -insecure to serve without tls")
+		}
+		dotlog.Logger.Warnf("serving relay on %s without tls", addr)
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(relayArgs.certFile, relayArgs.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func execRelay(ctx context.Context, args []string) error {
+	err := dotlog.InitDotLog(relayArgs.logLevel, relayArgs.logFile, relayArgs.debug)
+	if err != nil {
+		log.Fatalf("failed to initialize logger. because %v", err)
+	}
+
+	dotlog := dotlog.NewDotLog("dotshaker relay")
+
+	if relayArgs.token == "" {
+		if !relayArgs.insecure {
+			return errors.New("-token is required, set -insecure to let any machine use this relay")
+		}
+		dotlog.Logger.Warnf("no token is set, any machine can use this relay")
+	}
+
+	s := relay.NewServer(relayArgs.token, dotlog)
+
+	errCh := make(chan error, 2)
+
+	ln, err := relayListen(relayArgs.listen, dotlog)
+	if err != nil {
+		return err
+	}
+	go func() {
+		errCh <- s.Serve(ln)
+	}()
+	dotlog.Logger.Infof("serving relay on %s", ln.Addr().String())
+
+	if relayArgs.wsListen != "" {
+		wln, err := relayListen(relayArgs.wsListen, dotlog)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		go func() {
+			errCh <- s.ServeWebSocket(wln, relayArgs.wsPath)
+		}()
+		dotlog.Logger.Infof("serving relay over websocket on %s%s", wln.Addr().String(), relayArgs.wsPath)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c,
+		os.Interrupt,
+		syscall.SIGTERM,
+		syscall.SIGINT,
+	)
+
+	select {
+	case <-c:
+	case <-ctx.Done():
+	case err = <-errCh:
+		dotlog.Logger.Errorf("relay server has stopped, %v", err)
+	}
+
+	s.Close()
+
+	return err
+}
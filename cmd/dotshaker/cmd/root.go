@@ -17,7 +17,6 @@ import (
 	grpc_client "github.com/Notch-Technologies/dotshake/client/grpc"
 	"github.com/Notch-Technologies/dotshake/conf"
 	"github.com/Notch-Technologies/dotshake/dotlog"
-	"github.com/Notch-Technologies/dotshake/paths"
 	"github.com/Notch-Technologies/dotshake/rcn/conn"
 	"github.com/Notch-Technologies/dotshake/store"
 	"github.com/peterbourgon/ff/v2/ffcli"
@@ -27,14 +26,15 @@ import (
 func initializeDotShakerConf(
 	clientCtx context.Context,
 	path string,
+	statePath string,
 	isDev bool,
 	serverHost string, serverPort uint,
 	signalHost string, signalPort uint,
 	dotlog *dotlog.DotLog,
-) (signalClient grpc_client.SignalClientImpl, serverClient grpc_client.ServerClientImpl, clientConf *conf.ClientConf, mPubKey string) {
+) (signalClient grpc_client.SignalClientImpl, serverClient grpc_client.ServerClientImpl, clientConf *conf.ClientConf, mPubKey, mPrivKey string) {
 	// configure file store
 	//
-	cfs, err := store.NewFileStore(paths.DefaultDotshakeClientStateFile(), dotlog)
+	cfs, err := store.NewFileStore(statePath, dotlog)
 	if err != nil {
 		dotlog.Logger.Warnf("failed to create clietnt state, because %v", err)
 	}
@@ -47,6 +47,7 @@ func initializeDotShakerConf(
 		dotlog.Logger.Warnf("failed to write client state private key, because %v", err)
 	}
 	mPubKey = cs.GetPublicKey()
+	mPrivKey = cs.GetPrivateKey()
 
 	// initialize client conf
 	//
@@ -75,7 +76,7 @@ func initializeDotShakerConf(
 		dotlog.Logger.Warnf("failed to initialize grpc server client, because %v", err)
 	}
 
-	return signalClient, serverClient, clientConf, mPubKey
+	return signalClient, serverClient, clientConf, mPubKey, mPrivKey
 }
 
 func setupGrpcServerClient(
@@ -144,6 +145,8 @@ Flags and options are subject to change.
 			upCmd,
 			downCmd,
 			statusCmd,
+			pingCmd,
+			relayCmd,
 			versionCmd,
 		},
 		FlagSet: fs,
@@ -6,12 +6,20 @@ package cmd
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Notch-Technologies/dotshake/daemon"
 	dd "github.com/Notch-Technologies/dotshake/daemon/dotshaker"
 	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/paths"
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
 	"github.com/peterbourgon/ff/v2/ffcli"
 )
 
@@ -24,8 +32,19 @@ var statusArgs struct {
 var statusCmd = &ffcli.Command{
 	Name:      "status",
 	ShortHelp: "status the daemon",
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("status", flag.ExitOnError)
+		fs.StringVar(&statusArgs.logFile, "logfile", paths.DefaultDotShakerLogFile(), "set logfile path")
+		fs.StringVar(&statusArgs.logLevel, "loglevel", dotlog.InfoLevelStr, "set log level")
+		fs.BoolVar(&statusArgs.debug, "debug", false, "is debug")
+		return fs
+	})(),
 	Subcommands: []*ffcli.Command{
 		statusDaemonCmd,
+		statusPeersCmd,
+		statusPathsCmd,
+		statusHistoryCmd,
+		statusTrafficCmd,
 	},
 }
 
@@ -47,3 +66,206 @@ func statusDaemon(ctx context.Context, args []string) error {
 	fmt.Println(status)
 	return nil
 }
+
+var statusPeersCmd = &ffcli.Command{
+	Name:      "peers",
+	ShortHelp: "status of the connection to each remote machine",
+	Exec:      statusPeers,
+}
+
+func statusPeers(ctx context.Context, args []string) error {
+	err := dotlog.InitDotLog(statusArgs.logLevel, statusArgs.logFile, statusArgs.debug)
+	if err != nil {
+		log.Fatalf("failed to initialize logger: %v", err)
+	}
+	dotlog := dotlog.NewDotLog("status")
+
+	sock := rcnsock.NewRcnSock(dotlog, nil)
+	peers, err := sock.DialPeerStatus()
+	if err != nil {
+		dotlog.Logger.Errorf("failed to dial rcn sock, is dotshaker running? %s", err.Error())
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MACHINE KEY\tSTATE\tICE\tPATH\tREMOTE\tRTT\tLOSS\tMTU\tRX\tTX\tHANDSHAKE\tRESTARTS\tDROPPED\tSINCE\tERROR")
+	for _, p := range peers {
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			p.RemoteMachineKey, p.State.String(), orDash(p.IceState), p.Path(), remoteAddr(p),
+			rtt(p.RTT), loss(p.Loss), pathMTU(p), bytesSize(p.RxBytes), bytesSize(p.TxBytes),
+			handshakeAge(p), p.Restarts, p.SignalsDropped, time.Since(p.UpdatedAt).Round(time.Second).String(), orDash(p.LastError),
+		)
+	}
+
+	return w.Flush()
+}
+
+var statusPathsCmd = &ffcli.Command{
+	Name:      "paths",
+	ShortHelp: "recent upgrades to and fallbacks from direct paths of each remote machine",
+	Exec:      statusPaths,
+}
+
+func statusPaths(ctx context.Context, args []string) error {
+	err := dotlog.InitDotLog(statusArgs.logLevel, statusArgs.logFile, statusArgs.debug)
+	if err != nil {
+		log.Fatalf("failed to initialize logger: %v", err)
+	}
+	dotlog := dotlog.NewDotLog("status")
+
+	sock := rcnsock.NewRcnSock(dotlog, nil)
+	peers, err := sock.DialPeerStatus()
+	if err != nil {
+		dotlog.Logger.Errorf("failed to dial rcn sock, is dotshaker running? %s", err.Error())
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MACHINE KEY\tAT\tFROM\tTO\tRTT\tREASON")
+	for _, p := range peers {
+		for _, c := range p.PathChanges {
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				p.RemoteMachineKey, c.At.Format(time.RFC3339), c.From, c.To, rtt(c.RTT), orDash(c.Reason),
+			)
+		}
+	}
+
+	return w.Flush()
+}
+
+var statusHistoryCmd = &ffcli.Command{
+	Name:       "history",
+	ShortUsage: "history [machine key]",
+	ShortHelp:  "samples of the path quality and the traffic of each remote machine",
+	Exec:       statusHistory,
+}
+
+func statusHistory(ctx context.Context, args []string) error {
+	err := dotlog.InitDotLog(statusArgs.logLevel, statusArgs.logFile, statusArgs.debug)
+	if err != nil {
+		log.Fatalf("failed to initialize logger: %v", err)
+	}
+	dotlog := dotlog.NewDotLog("status")
+
+	sock := rcnsock.NewRcnSock(dotlog, nil)
+	peers, err := sock.DialPeerStatus()
+	if err != nil {
+		dotlog.Logger.Errorf("failed to dial rcn sock, is dotshaker running? %s", err.Error())
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MACHINE KEY\tAT\tPATH\tRTT\tLOSS\tRX\tTX")
+	for _, p := range peers {
+		if len(args) > 0 && p.RemoteMachineKey != args[0] {
+			continue
+		}
+
+		for _, s := range p.History {
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				p.RemoteMachineKey, s.At.Format(time.RFC3339), s.Path,
+				rtt(s.RTT), loss(s.Loss), bytesSize(s.RxBytes), bytesSize(s.TxBytes),
+			)
+		}
+	}
+
+	return w.Flush()
+}
+
+var statusTrafficCmd = &ffcli.Command{
+	Name:       "traffic",
+	ShortUsage: "traffic [machine key]",
+	ShortHelp:  "traffic per minute of wireguard and the wire proxy of each remote machine",
+	Exec:       statusTraffic,
+}
+
+func statusTraffic(ctx context.Context, args []string) error {
+	err := dotlog.InitDotLog(statusArgs.logLevel, statusArgs.logFile, statusArgs.debug)
+	if err != nil {
+		log.Fatalf("failed to initialize logger: %v", err)
+	}
+	dotlog := dotlog.NewDotLog("status")
+
+	sock := rcnsock.NewRcnSock(dotlog, nil)
+	peers, err := sock.DialPeerStatus()
+	if err != nil {
+		dotlog.Logger.Errorf("failed to dial rcn sock, is dotshaker running? %s", err.Error())
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MACHINE KEY\tMINUTE\tWG RX\tWG TX\tPROXY RX\tPROXY TX\tRX PKTS\tTX PKTS\tRX ERRS\tTX ERRS")
+	for _, p := range peers {
+		if len(args) > 0 && p.RemoteMachineKey != args[0] {
+			continue
+		}
+
+		for _, s := range p.Traffic {
+			fmt.Fprintf(
+				w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\n",
+				p.RemoteMachineKey, s.At.Format("15:04"),
+				bytesSize(s.RxBytes), bytesSize(s.TxBytes),
+				bytesSize(int64(s.Proxy.RxBytes)), bytesSize(int64(s.Proxy.TxBytes)),
+				s.Proxy.RxPackets, s.Proxy.TxPackets, s.Proxy.RxErrors, s.Proxy.TxErrors,
+			)
+		}
+	}
+
+	return w.Flush()
+}
+
+func remoteAddr(p conn.PeerStatus) string {
+	if p.DirectPath != "" {
+		return p.DirectPath
+	}
+	return orDash(p.RemoteCandidateAddr)
+}
+
+func pathMTU(p conn.PeerStatus) string {
+	if p.PathMTU == 0 {
+		return "-"
+	}
+	return strconv.Itoa(p.PathMTU)
+}
+
+func rtt(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.Round(time.Microsecond).String()
+}
+
+func loss(l float64) string {
+	return fmt.Sprintf("%.0f%%", l*100)
+}
+
+func bytesSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func handshakeAge(p conn.PeerStatus) string {
+	if p.LastHandshake.IsZero() {
+		return "never"
+	}
+	return p.HandshakeAge().Round(time.Second).String() + " ago"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
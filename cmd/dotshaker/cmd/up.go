@@ -35,6 +35,11 @@ var upArgs struct {
 	logLevel   string
 	debug      bool
 	daemon     bool
+	statePath  string
+	tun        string
+
+	socks5Listen    string
+	httpProxyListen string
 }
 
 var upCmd = &ffcli.Command{
@@ -52,6 +57,10 @@ var upCmd = &ffcli.Command{
 		fs.StringVar(&upArgs.logLevel, "loglevel", dotlog.InfoLevelStr, "set log level")
 		fs.BoolVar(&upArgs.debug, "debug", false, "for debug")
 		fs.BoolVar(&upArgs.daemon, "daemon", true, "whether to install daemon")
+		fs.StringVar(&upArgs.statePath, "state", paths.DefaultDotshakeClientStateFile(), "client state file")
+		fs.StringVar(&upArgs.tun, "tun", "", `tun device name, "userspace-networking" to run without a tun device and privileges`)
+		fs.StringVar(&upArgs.socks5Listen, "socks5-server", "", "local address of the socks5 proxy into the overlay, e.g. localhost:1080")
+		fs.StringVar(&upArgs.httpProxyListen, "http-proxy-server", "", "local address of the http proxy into the overlay, e.g. localhost:8080")
 		return fs
 	})(),
 	Exec: execUp,
@@ -68,7 +77,7 @@ func execUp(ctx context.Context, args []string) error {
 	clientCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	signalClient, serverClient, clientConf, mPubKey := initializeDotShakerConf(clientCtx, upArgs.clientPath, upArgs.debug, upArgs.serverHost, uint(upArgs.serverPort), upArgs.signalHost, uint(upArgs.signalPort), dotlog)
+	signalClient, serverClient, clientConf, mPubKey, mPrivKey := initializeDotShakerConf(clientCtx, upArgs.clientPath, upArgs.statePath, upArgs.debug, upArgs.serverHost, uint(upArgs.serverPort), upArgs.signalHost, uint(upArgs.signalPort), dotlog)
 
 	// TODO: (shinta) remove login process,
 	// this is because you log in when you do dotshake up,
@@ -79,9 +88,20 @@ func execUp(ctx context.Context, args []string) error {
 		dotlog.Logger.Warnf("failed to login, %s", err.Error())
 	}
 
+	// override the client config for this run
+	if upArgs.tun != "" {
+		clientConf.TunName = upArgs.tun
+	}
+	if upArgs.socks5Listen != "" {
+		clientConf.Socks5Listen = upArgs.socks5Listen
+	}
+	if upArgs.httpProxyListen != "" {
+		clientConf.HTTPProxyListen = upArgs.httpProxyListen
+	}
+
 	ch := make(chan struct{})
 
-	r := rcn.NewRcn(signalClient, serverClient, clientConf, mPubKey, ch, dotlog)
+	r := rcn.NewRcn(signalClient, serverClient, clientConf, mPubKey, mPrivKey, ch, dotlog)
 
 	if upArgs.daemon {
 		d := daemon.NewDaemon(dd.BinPath, dd.ServiceName, dd.DaemonFilePath, dd.SystemConfig, dotlog)
@@ -14,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/iface/filter"
 	"github.com/Notch-Technologies/dotshake/tun"
 	"github.com/Notch-Technologies/dotshake/types/key"
 	"github.com/Notch-Technologies/dotshake/utils"
@@ -29,12 +30,69 @@ type ClientConf struct {
 	PreSharedKey string   `json:"preshared_key"`
 	BlackList    []string `json:"blacklist"`
 
+	// stun and turn servers used in addition to the ones from the signal server
+	IceServers []IceServer `json:"ice_servers,omitempty"`
+
+	// /64 used for the ipv6 overlay addresses, e.g. fd00:d07::/64.
+	// must be the same on every machine, no ipv6 overlay when empty
+	IPv6Prefix string `json:"ipv6_prefix,omitempty"`
+
+	// udp port shared by the ice agents of all remote peers, random when 0.
+	// dotshaker fails to listen it rather than using another one when it is in use
+	IcePort uint `json:"ice_port,omitempty"`
+
+	// relay server used when ice can not connect to a remote peer,
+	// e.g. tls://relay.example.com:3480 or wss://relay.example.com/relay. no relay when empty
+	RelayURL   string `json:"relay_url,omitempty"`
+	RelayToken string `json:"relay_token,omitempty"`
+
+	// local addresses of the socks5 and http proxies into the overlay,
+	// e.g. localhost:1080. no proxy when empty
+	Socks5Listen    string `json:"socks5_listen,omitempty"`
+	HTTPProxyListen string `json:"http_proxy_listen,omitempty"`
+
+	// overlay ip or machine key of the remote peer all the traffic is routed to,
+	// no exit node when empty
+	ExitNode string `json:"exit_node,omitempty"`
+	// forward the traffic of the remote peers to the internet
+	AdvertiseExitNode bool `json:"advertise_exit_node,omitempty"`
+	// subnets of the local networks to forward the traffic of the remote peers to,
+	// the remote peers route them to this machine
+	AdvertiseRoutes []string `json:"advertise_routes,omitempty"`
+
+	// the machines are named <hostname>.<dns_domain>, dotshake when empty
+	DNSDomain string `json:"dns_domain,omitempty"`
+	// leave the resolver of the host as it is, the dns server still names this machine to the others
+	DisableHostDNS bool `json:"disable_host_dns,omitempty"`
+	// nameservers of the domains resolved through the tunnel, e.g. {"corp.example": ["10.0.0.53"]}.
+	// they take precedence over the ones pushed by the server
+	DNSRoutes map[string][]string `json:"dns_routes,omitempty"`
+
+	// rules of the new connections the remote peers may open to this machine,
+	// e.g. {"rules": [{"src": ["tag:admin"], "proto": "tcp", "ports": ["22"]}]}. no filter when empty.
+	// the pings and the dns queries to this machine are accepted whatever the rules are
+	PacketFilter *filter.Policy `json:"packet_filter,omitempty"`
+	// tags of the remote peers by their machine keys or overlay ips, added to the ones from the server
+	PeerTags map[string][]string `json:"peer_tags,omitempty"`
+
+	// unix socket of the rcn, the one of the daemon when empty.
+	// set by the programs embedding dotshake, never written to the file
+	RcnSockAddr string `json:"-"`
+
 	path    string
 	isDebug bool
 
 	dotlog *dotlog.DotLog
 }
 
+// e.g. {"urls": ["turn:turn.example.com:443?transport=tcp", "turns:turn.example.com:5349"], "username": "u", "password": "p"}
+//
+type IceServer struct {
+	URLs     []string `json:"urls"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+}
+
 func NewClientConf(
 	path string,
 	serverHost string, serverPort uint,
@@ -79,7 +137,7 @@ func (c *ClientConf) writeClientConf(
 		panic(err)
 	}
 
-	if err = utils.AtomicWriteFile(c.path, b, 0755); err != nil {
+	if err = utils.AtomicWriteFile(c.path, b, 0600); err != nil {
 		panic(err)
 	}
 
@@ -132,6 +190,23 @@ func (c *ClientConf) CreateClientConf() *ClientConf {
 			signalhost = c.SignalHost
 		}
 
+		// kept as they are, only edited by hand
+		c.IceServers = core.IceServers
+		c.IPv6Prefix = core.IPv6Prefix
+		c.IcePort = core.IcePort
+		c.RelayURL = core.RelayURL
+		c.RelayToken = core.RelayToken
+		c.Socks5Listen = core.Socks5Listen
+		c.HTTPProxyListen = core.HTTPProxyListen
+		c.ExitNode = core.ExitNode
+		c.AdvertiseExitNode = core.AdvertiseExitNode
+		c.AdvertiseRoutes = core.AdvertiseRoutes
+		c.DNSDomain = core.DNSDomain
+		c.DisableHostDNS = core.DisableHostDNS
+		c.DNSRoutes = core.DNSRoutes
+		c.PacketFilter = core.PacketFilter
+		c.PeerTags = core.PeerTags
+
 		return c.writeClientConf(
 			core.WgPrivateKey,
 			core.TunName,
@@ -145,6 +220,17 @@ func (c *ClientConf) CreateClientConf() *ClientConf {
 	}
 }
 
+// writes the current config to the file, readable only by the owner since it holds the wireguard private key
+//
+func (c *ClientConf) Save() error {
+	b, err := json.MarshalIndent(*c, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return utils.AtomicWriteFile(c.path, b, 0600)
+}
+
 func (c *ClientConf) GetClientConf() (*ClientConf, error) {
 	var cc ClientConf
 	b, err := ioutil.ReadFile(c.path)
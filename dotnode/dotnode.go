@@ -0,0 +1,377 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dotnode
+
+// dotnode package joins the dotshake network from a go program.
+// the node runs on a netstack in the process of the program, no tun device,
+// no daemon and no privileges are needed. the program dials the remote machines
+// and listens for them through the node, nothing else on the machine is reachable
+//
+//	s := &dotnode.Server{Dir: "/var/lib/myapp/dotshake", AuthKey: os.Getenv("DOTSHAKE_AUTH_KEY")}
+//	defer s.Close()
+//
+//	ln, err := s.Listen("tcp", ":80")
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	grpc_client "github.com/Notch-Technologies/dotshake/client/grpc"
+	"github.com/Notch-Technologies/dotshake/conf"
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/iface"
+	"github.com/Notch-Technologies/dotshake/iface/netstack"
+	"github.com/Notch-Technologies/dotshake/rcn"
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+	"github.com/Notch-Technologies/dotshake/store"
+	"github.com/Notch-Technologies/dotshake/types/flagtype"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultServerHost = "https://ctl.dotshake.com"
+	defaultSignalHost = "https://signal.dotshake.com"
+
+	// connecting to the server and the signal server
+	dialTimeout = 10 * time.Second
+)
+
+var ErrClosed = errors.New("dotnode: server closed")
+
+// numbers the interfaces of the servers in this process
+var ifaceSeq uint32
+
+type Server struct {
+	// directory of the client config, the state and the log of the node,
+	// created when it does not exist. the node keeps its keys and its ip across restarts in it
+	Dir string
+
+	// registers the machine without logging in. when empty, the login url is logged
+	// and Up waits until someone has logged in through it
+	AuthKey string
+
+	// the dotshake servers when empty
+	ServerHost string
+	ServerPort uint
+	SignalHost string
+	SignalPort uint
+
+	// connects to the servers without tls, for the local servers
+	Debug bool
+
+	// debug, info, warning or error, info when empty
+	LogLevel string
+
+	rcn *rcn.Rcn
+	ns  *netstack.Device
+	ip  net.IP
+	ch  chan struct{}
+
+	// to the server and the signal server
+	conns []*grpc.ClientConn
+
+	closed bool
+	mu     sync.Mutex
+
+	dotlog *dotlog.DotLog
+}
+
+// joins the network, returns once the node can dial and listen.
+// the remote machines are connected in the background.
+// Dial, Listen and ListenPacket call it as well
+//
+func (s *Server) Up(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.ns != nil {
+		return nil
+	}
+
+	return s.start(ctx)
+}
+
+func (s *Server) start(ctx context.Context) error {
+	if s.Dir == "" {
+		return errors.New("dotnode: Dir is required")
+	}
+	err := os.MkdirAll(s.Dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	level := s.LogLevel
+	if level == "" {
+		level = dotlog.InfoLevelStr
+	}
+	err = dotlog.InitDotLog(level, filepath.Join(s.Dir, "dotshake.log"), s.Debug)
+	if err != nil {
+		return err
+	}
+	s.dotlog = dotlog.NewDotLog("dotnode")
+
+	cfs, err := store.NewFileStore(filepath.Join(s.Dir, "client.state"), s.dotlog)
+	if err != nil {
+		return err
+	}
+	cs := store.NewClientStore(cfs, s.dotlog)
+	err = cs.WritePrivateKey()
+	if err != nil {
+		return err
+	}
+	mk := cs.GetPublicKey()
+	mPrivKey := cs.GetPrivateKey()
+
+	clientConf, err := conf.NewClientConf(
+		filepath.Join(s.Dir, "client.json"),
+		orDefault(s.ServerHost, defaultServerHost), orDefaultPort(s.ServerPort, flagtype.DefaultServerPort),
+		orDefault(s.SignalHost, defaultSignalHost), orDefaultPort(s.SignalPort, flagtype.DefaultSignalingServerPort),
+		s.Debug,
+		s.dotlog,
+	)
+	if err != nil {
+		return err
+	}
+	clientConf = clientConf.CreateClientConf()
+
+	// for this run, the file keeps the tun of the daemon
+	clientConf.TunName = fmt.Sprintf("%s-%d", iface.UserspaceNetworking, atomic.AddUint32(&ifaceSeq, 1))
+	clientConf.RcnSockAddr = filepath.Join(s.Dir, "rcn.sock")
+
+	signalClient, serverClient, err := s.dial(ctx, clientConf)
+	if err != nil {
+		return err
+	}
+
+	ip, err := s.login(ctx, serverClient, clientConf, mk)
+	if err != nil {
+		s.closeConns()
+		return err
+	}
+
+	ch := make(chan struct{})
+	r := rcn.NewRcn(signalClient, serverClient, clientConf, mk, mPrivKey, ch, s.dotlog)
+
+	ns, err := r.StartNetstack()
+	if err != nil {
+		close(ch)
+		r.Close()
+		s.closeConns()
+		return err
+	}
+
+	s.rcn = r
+	s.ns = ns
+	s.ip = ip
+	s.ch = ch
+
+	s.dotlog.Logger.Infof("joined dotshake as %s", ip.String())
+
+	return nil
+}
+
+func (s *Server) dial(
+	ctx context.Context,
+	clientConf *conf.ClientConf,
+) (grpc_client.SignalClientImpl, grpc_client.ServerClientImpl, error) {
+	options := []grpc.DialOption{
+		grpc_client.NewGrpcDialOption(s.dotlog, s.Debug),
+		grpc.WithBlock(),
+	}
+	if s.AuthKey != "" {
+		options = append(options, grpc_client.NewAuthKeyOption(s.AuthKey))
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	sconn, err := grpc.DialContext(dialCtx, clientConf.GetServerHost(), options...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to %s, %w", clientConf.GetServerHost(), err)
+	}
+
+	gconn, err := grpc.DialContext(dialCtx, clientConf.GetSignalHost(), options...)
+	if err != nil {
+		sconn.Close()
+		return nil, nil, fmt.Errorf("failed to connect to %s, %w", clientConf.GetSignalHost(), err)
+	}
+
+	s.conns = []*grpc.ClientConn{sconn, gconn}
+
+	return grpc_client.NewSignalClient(gconn, conn.NewConnectedState(), s.dotlog),
+		grpc_client.NewServerClient(sconn, s.dotlog),
+		nil
+}
+
+// returns the ip of the machine, waits for the login when it is not registered yet
+//
+func (s *Server) login(
+	ctx context.Context,
+	serverClient grpc_client.ServerClientImpl,
+	clientConf *conf.ClientConf,
+	mk string,
+) (net.IP, error) {
+	wgPrivateKey, err := wgtypes.ParseKey(clientConf.WgPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := serverClient.GetMachine(mk, wgPrivateKey.PublicKey().String())
+	if err != nil {
+		return nil, err
+	}
+	ip := m.Ip
+
+	if !m.IsRegistered {
+		s.dotlog.Logger.Warnf("to join dotshake, log in via this link => %s", m.LoginUrl)
+
+		type result struct {
+			ip  string
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			msg, err := serverClient.ConnectStreamPeerLoginSession(mk)
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			done <- result{ip: msg.Ip}
+		}()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r := <-done:
+			if r.err != nil {
+				return nil, r.err
+			}
+			ip = r.ip
+		}
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ip %q of the machine", ip)
+	}
+	return addr, nil
+}
+
+func (s *Server) netstack(ctx context.Context) (*netstack.Device, error) {
+	err := s.Up(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	return s.ns, nil
+}
+
+// dials a remote machine by its ip, network is tcp, tcp4, tcp6, udp, udp4 or udp6
+//
+func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	ns, err := s.netstack(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Dial(ctx, network, address)
+}
+
+// listens on the ip of the node, address is :port or ip:port
+//
+func (s *Server) Listen(network, address string) (net.Listener, error) {
+	ns, err := s.netstack(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return ns.Listen(network, address)
+}
+
+func (s *Server) ListenPacket(network, address string) (net.PacketConn, error) {
+	ns, err := s.netstack(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return ns.ListenPacket(network, address)
+}
+
+// sends an icmp echo request to a remote machine, returns the round trip time
+//
+func (s *Server) Ping(ctx context.Context, ip net.IP) (time.Duration, error) {
+	ns, err := s.netstack(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return ns.Ping(ctx, ip)
+}
+
+// ip of the node in the network, nil before Up
+//
+func (s *Server) IP() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ip
+}
+
+// leaves the network, the conns and listeners of the node are closed with it
+//
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+
+	if s.rcn == nil {
+		return nil
+	}
+
+	close(s.ch)
+	s.rcn.Close()
+	s.closeConns()
+
+	return nil
+}
+
+func (s *Server) closeConns() {
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func orDefaultPort(p uint, def int) uint {
+	if p == 0 {
+		return uint(def)
+	}
+	return p
+}
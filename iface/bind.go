@@ -0,0 +1,274 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+// conn.Bind of the userspace device which hands the packets of proxied peers
+// to their ice, relay or direct conns without the loopback socket of the wire proxy.
+//
+// each proxied peer gets a virtual endpoint in virtualEndpointPrefix, which is
+// configured as its wireguard endpoint. packets sent to a virtual endpoint are
+// written to the conn of the peer, and packets delivered from the conn are received
+// from the virtual endpoint. the other endpoints go through the default bind
+//
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.zx2c4.com/go118/netip"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	// packets delivered from the conns waiting for wireguard to receive them
+	bindQueueSize = 1024
+	// larger than any wireguard message on the tunnel
+	bindPacketSize = 1500
+
+	virtualEndpointPort = 1
+)
+
+// never routed, the device only sees these addresses as endpoints
+var virtualEndpointPrefix = netip.MustParsePrefix("127.2.0.0/16")
+
+var errNoVirtualEndpoint = errors.New("no virtual endpoint is registered")
+
+type VirtualEndpoint struct {
+	addr netip.AddrPort
+
+	conn net.Conn
+	mu   *sync.RWMutex
+}
+
+func (e *VirtualEndpoint) ClearSrc()           {}
+func (e *VirtualEndpoint) SrcToString() string { return "" }
+func (e *VirtualEndpoint) DstToString() string { return e.addr.String() }
+func (e *VirtualEndpoint) DstToBytes() []byte  { b, _ := e.addr.MarshalBinary(); return b }
+func (e *VirtualEndpoint) DstIP() netip.Addr   { return e.addr.Addr() }
+func (e *VirtualEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+// address to configure as the endpoint of the wireguard peer
+//
+func (e *VirtualEndpoint) UDPAddr() *net.UDPAddr {
+	ip := e.addr.Addr().As4()
+	return &net.UDPAddr{IP: net.IP(ip[:]), Port: int(e.addr.Port())}
+}
+
+// sets the conn the packets to the peer are written to, nil drops them
+//
+func (e *VirtualEndpoint) SetConn(c net.Conn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.conn = c
+}
+
+func (e *VirtualEndpoint) getConn() net.Conn {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.conn
+}
+
+type bindPacket struct {
+	buf []byte
+	n   int
+	ep  *VirtualEndpoint
+}
+
+var bindPacketPool = sync.Pool{
+	New: func() interface{} {
+		return &bindPacket{buf: make([]byte, bindPacketSize)}
+	},
+}
+
+type ICEBind struct {
+	std conn.Bind
+
+	endpoints map[netip.AddrPort]*VirtualEndpoint
+	// index of the next virtual endpoint in virtualEndpointPrefix
+	next uint16
+
+	recvCh chan *bindPacket
+	// closed by Close, replaced by Open
+	closeCh chan struct{}
+
+	mu *sync.Mutex
+}
+
+func NewICEBind() *ICEBind {
+	closeCh := make(chan struct{})
+	close(closeCh)
+
+	return &ICEBind{
+		std: conn.NewDefaultBind(),
+
+		endpoints: make(map[netip.AddrPort]*VirtualEndpoint),
+
+		recvCh:  make(chan *bindPacket, bindQueueSize),
+		closeCh: closeCh,
+
+		mu: &sync.Mutex{},
+	}
+}
+
+func (b *ICEBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.std.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	closeCh := make(chan struct{})
+	b.closeCh = closeCh
+	b.mu.Unlock()
+
+	return append(fns, b.makeReceiveVirtual(closeCh)), actualPort, nil
+}
+
+func (b *ICEBind) makeReceiveVirtual(closeCh chan struct{}) conn.ReceiveFunc {
+	return func(buf []byte) (int, conn.Endpoint, error) {
+		select {
+		case <-closeCh:
+			return 0, nil, net.ErrClosed
+		case p := <-b.recvCh:
+			n := copy(buf, p.buf[:p.n])
+			ep := p.ep
+			bindPacketPool.Put(p)
+			return n, ep, nil
+		}
+	}
+}
+
+func (b *ICEBind) Close() error {
+	b.mu.Lock()
+	select {
+	case <-b.closeCh:
+	default:
+		close(b.closeCh)
+	}
+	b.mu.Unlock()
+
+	return b.std.Close()
+}
+
+func (b *ICEBind) SetMark(mark uint32) error {
+	return b.std.SetMark(mark)
+}
+
+func (b *ICEBind) Send(buf []byte, ep conn.Endpoint) error {
+	ve, ok := ep.(*VirtualEndpoint)
+	if !ok {
+		return b.std.Send(buf, ep)
+	}
+
+	c := ve.getConn()
+	if c == nil {
+		// wireguard retransmits once the peer has a conn again
+		return nil
+	}
+
+	_, err := c.Write(buf)
+	return err
+}
+
+func (b *ICEBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if !virtualEndpointPrefix.Contains(addr.Addr()) {
+		return b.std.ParseEndpoint(s)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ep, ok := b.endpoints[addr]
+	if !ok {
+		return nil, errNoVirtualEndpoint
+	}
+	return ep, nil
+}
+
+// allocates a virtual endpoint for a proxied peer
+//
+func (b *ICEBind) Register() *VirtualEndpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		b.next++
+		if b.next == 0 {
+			b.next = 1
+		}
+
+		base := virtualEndpointPrefix.Addr().As4()
+		addr := netip.AddrPortFrom(
+			netip.AddrFrom4([4]byte{base[0], base[1], byte(b.next >> 8), byte(b.next)}),
+			virtualEndpointPort,
+		)
+		if _, ok := b.endpoints[addr]; ok {
+			continue
+		}
+
+		ep := &VirtualEndpoint{
+			addr: addr,
+			mu:   &sync.RWMutex{},
+		}
+		b.endpoints[addr] = ep
+		return ep
+	}
+}
+
+func (b *ICEBind) Unregister(ep *VirtualEndpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ep.SetConn(nil)
+	if b.endpoints[ep.addr] == ep {
+		delete(b.endpoints, ep.addr)
+	}
+}
+
+// queues a packet from the conn of ep for wireguard,
+// returns false when it is dropped because the queue is full
+//
+func (b *ICEBind) Deliver(ep *VirtualEndpoint, pkt []byte) bool {
+	p := bindPacketPool.Get().(*bindPacket)
+	p.n = copy(p.buf, pkt)
+	p.ep = ep
+
+	select {
+	case b.recvCh <- p:
+		return true
+	default:
+		bindPacketPool.Put(p)
+		return false
+	}
+}
+
+var (
+	binds   = make(map[string]*ICEBind)
+	bindsMu = &sync.Mutex{}
+)
+
+func setBind(tun string, b *ICEBind) {
+	bindsMu.Lock()
+	defer bindsMu.Unlock()
+
+	binds[tun] = b
+}
+
+// returns the bind of the userspace device of the interface, nil for the kernel device
+//
+func (i *Iface) Bind() *ICEBind {
+	bindsMu.Lock()
+	defer bindsMu.Unlock()
+
+	return binds[i.Tun]
+}
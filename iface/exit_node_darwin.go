@@ -0,0 +1,24 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"errors"
+	"net"
+)
+
+var errExitNodeUnsupported = errors.New("exit node is not supported on darwin yet")
+
+func setExitRoutes(tunname string, bypass []net.IP, ipv6 bool) error {
+	return errExitNodeUnsupported
+}
+
+func setExitBypass(bypass []net.IP) error {
+	return errExitNodeUnsupported
+}
+
+func clearExitRoutes(tunname string) error {
+	return nil
+}
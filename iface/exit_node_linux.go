@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+// routing to an exit node on linux.
+//
+// the default routes of the tunnel are in their own table. the ip rules look up
+// the main table first for the packets marked with wireguard.FwMark, the wireguard and ice sockets,
+// and for the bypassed servers, then for everything but the default route,
+// so that the overlay and the local networks stay as they are, and the tunnel table last
+//
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/Notch-Technologies/dotshake/utils"
+	"github.com/Notch-Technologies/dotshake/wireguard"
+)
+
+const (
+	exitNodeTable = 5210
+
+	// priorities of the ip rules, in the order they are looked up
+	exitNodeMarkPriority     = 5210
+	exitNodeBypassPriority   = 5211
+	exitNodeSuppressPriority = 5212
+	exitNodeTablePriority    = 5213
+)
+
+func setExitRoutes(tunname string, bypass []net.IP, ipv6 bool) error {
+	// replaces the routes and the rules of the previous exit node
+	err := clearExitRoutes(tunname)
+	if err != nil {
+		return err
+	}
+
+	for _, args := range exitRoutesArgs(tunname, bypass, ipv6) {
+		err = ipCommand(args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the ip commands of the routes and the rules, in the order they are run.
+// without ipv6 the ipv6 default route of the table is unreachable, so that the ipv6 traffic
+// does not leave through the local network while everything else goes to the exit node
+//
+func exitRoutesArgs(tunname string, bypass []net.IP, ipv6 bool) [][]string {
+	table := strconv.Itoa(exitNodeTable)
+
+	args := [][]string{}
+	for _, f := range []string{"-4", "-6"} {
+		if f == "-6" && !ipv6 {
+			args = append(args, []string{f, "route", "replace", "unreachable", "default", "table", table})
+		} else {
+			args = append(args, []string{f, "route", "replace", "default", "dev", tunname, "table", table})
+		}
+
+		args = append(args, []string{f, "rule", "add", "fwmark", strconv.Itoa(wireguard.FwMark), "lookup", "main", "priority", strconv.Itoa(exitNodeMarkPriority)})
+	}
+
+	args = append(args, exitBypassArgs(bypass)...)
+
+	for _, f := range []string{"-4", "-6"} {
+		args = append(args,
+			[]string{f, "rule", "add", "lookup", "main", "suppress_prefixlength", "0", "priority", strconv.Itoa(exitNodeSuppressPriority)},
+			[]string{f, "rule", "add", "lookup", table, "priority", strconv.Itoa(exitNodeTablePriority)},
+		)
+	}
+
+	return args
+}
+
+func exitBypassArgs(bypass []net.IP) [][]string {
+	args := [][]string{}
+	for _, b := range bypass {
+		f, bits := "-4", "/32"
+		if b.To4() == nil {
+			f, bits = "-6", "/128"
+		}
+
+		args = append(args, []string{f, "rule", "add", "to", b.String() + bits, "lookup", "main", "priority", strconv.Itoa(exitNodeBypassPriority)})
+	}
+	return args
+}
+
+// replaces the rules of the bypassed servers only, the other routes and rules are kept
+//
+func setExitBypass(bypass []net.IP) error {
+	for _, f := range []string{"-4", "-6"} {
+		deleteRules(f, exitNodeBypassPriority)
+	}
+
+	for _, args := range exitBypassArgs(bypass) {
+		err := ipCommand(args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fails once no rule of the priority is left
+//
+func deleteRules(family string, priority int) {
+	for {
+		err := ipCommand(family, "rule", "del", "priority", strconv.Itoa(priority))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func clearExitRoutes(tunname string) error {
+	priorities := []int{exitNodeMarkPriority, exitNodeBypassPriority, exitNodeSuppressPriority, exitNodeTablePriority}
+
+	for _, f := range []string{"-4", "-6"} {
+		for _, p := range priorities {
+			deleteRules(f, p)
+		}
+
+		// fails when the table is empty or the interface is gone
+		_ = ipCommand(f, "route", "flush", "table", strconv.Itoa(exitNodeTable))
+	}
+
+	return nil
+}
+
+func ipCommand(args ...string) error {
+	ipCmd, err := exec.LookPath("ip")
+	if err != nil {
+		return err
+	}
+
+	_, err = utils.ExecCmd(ipCmd + " " + strings.Join(args, " "))
+	return err
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestExitRoutesArgs(t *testing.T) {
+	bypass := []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")}
+
+	tests := []struct {
+		name string
+		ipv6 bool
+		// ip commands which have to be run, the others are not checked
+		want []string
+	}{
+		{
+			"ipv4 only",
+			false,
+			[]string{
+				"-4 route replace default dev dotshake table 5210",
+				// the ipv6 traffic does not leave through the local network
+				"-6 route replace unreachable default table 5210",
+				"-6 rule add lookup 5210 priority 5213",
+				"-6 rule add lookup main suppress_prefixlength 0 priority 5212",
+				"-4 rule add to 203.0.113.1/32 lookup main priority 5211",
+				"-6 rule add to 2001:db8::1/128 lookup main priority 5211",
+			},
+		},
+		{
+			"ipv6",
+			true,
+			[]string{
+				"-4 route replace default dev dotshake table 5210",
+				"-6 route replace default dev dotshake table 5210",
+				"-6 rule add lookup 5210 priority 5213",
+				"-6 rule add to 2001:db8::1/128 lookup main priority 5211",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string]bool)
+			for _, args := range exitRoutesArgs("dotshake", bypass, tt.ipv6) {
+				got[strings.Join(args, " ")] = true
+			}
+
+			for _, w := range tt.want {
+				if !got[w] {
+					t.Fatalf("%q is not run, got %v", w, got)
+				}
+			}
+			if !tt.ipv6 && got["-6 route replace default dev dotshake table 5210"] {
+				t.Fatal("ipv6 default route goes to the tunnel without ipv6")
+			}
+		})
+	}
+}
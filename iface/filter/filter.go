@@ -0,0 +1,242 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package filter
+
+// the inline filter of the userspace and netstack devices. the packets wireguard writes
+// to the device come from the remote peers. a tcp packet opens a connection only with syn
+// and without ack, and an icmp packet only as an echo request, so the others are replies.
+// udp has no such flag, the flows this machine has sent to are tracked instead
+//
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const (
+	// how long an inbound udp packet is a reply to the flow this machine has sent to
+	udpFlowTimeout = 2 * time.Minute
+	maxUDPFlows    = 8192
+
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+)
+
+type Filter struct {
+	ruleset *Ruleset
+
+	// udp flows this machine has sent to, and until when they are open
+	flows map[flow]time.Time
+
+	mu *sync.RWMutex
+}
+
+// the remote end and the local port of a udp flow
+type flow struct {
+	remote     [16]byte
+	remotePort uint16
+	localPort  uint16
+}
+
+// accepts everything until a ruleset is set
+//
+func New() *Filter {
+	return &Filter{
+		flows: make(map[flow]time.Time),
+
+		mu: &sync.RWMutex{},
+	}
+}
+
+// nil accepts everything
+//
+func (f *Filter) SetRuleset(rs *Ruleset) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ruleset = rs
+}
+
+// the header fields the filter looks at
+type packet struct {
+	src, dst net.IP
+	proto    uint8
+	// the transport header, nil for the fragments after the first
+	transport []byte
+}
+
+func parse(b []byte) (packet, bool) {
+	if len(b) < 1 {
+		return packet{}, false
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return packet{}, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return packet{}, false
+		}
+
+		p := packet{src: net.IP(b[12:16]), dst: net.IP(b[16:20]), proto: b[9]}
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 {
+			p.transport = b[ihl:]
+		}
+		return p, true
+	case 6:
+		if len(b) < 40 {
+			return packet{}, false
+		}
+		return packet{src: net.IP(b[8:24]), dst: net.IP(b[24:40]), proto: b[6], transport: b[40:]}, true
+	}
+
+	return packet{}, false
+}
+
+func ports(transport []byte) (src, dst uint16, ok bool) {
+	if len(transport) < 4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(transport[0:2]), binary.BigEndian.Uint16(transport[2:4]), true
+}
+
+// whether the packet from a remote peer is accepted
+//
+func (f *Filter) Allow(b []byte) bool {
+	f.mu.RLock()
+	rs := f.ruleset
+	f.mu.RUnlock()
+
+	if rs == nil {
+		return true
+	}
+
+	p, ok := parse(b)
+	if !ok {
+		return false
+	}
+	// the first fragment has been filtered, the others are useless without it
+	if p.transport == nil {
+		return true
+	}
+
+	switch p.proto {
+	case protoTCP:
+		_, dport, ok := ports(p.transport)
+		if !ok || len(p.transport) < 14 {
+			return false
+		}
+		flags := p.transport[13]
+		if flags&tcpFlagSYN == 0 || flags&tcpFlagACK != 0 {
+			return true
+		}
+		return rs.alwaysAccepted(p.dst, p.proto, dport) || rs.Match(p.src, p.proto, dport)
+	case protoUDP:
+		sport, dport, ok := ports(p.transport)
+		if !ok {
+			return false
+		}
+		if f.isReply(p.src, sport, dport) {
+			return true
+		}
+		return rs.alwaysAccepted(p.dst, p.proto, dport) || rs.Match(p.src, p.proto, dport)
+	case protoICMP, protoICMPv6:
+		if len(p.transport) < 1 {
+			return false
+		}
+		t := p.transport[0]
+		if t != icmpEchoRequest && t != icmpv6EchoRequest {
+			return true
+		}
+		return rs.alwaysAccepted(p.dst, p.proto, 0) || rs.Match(p.src, p.proto, 0)
+	}
+
+	return rs.Match(p.src, p.proto, 0)
+}
+
+// records the udp flow of the packet to a remote peer
+//
+func (f *Filter) Track(b []byte) {
+	p, ok := parse(b)
+	if !ok || p.proto != protoUDP {
+		return
+	}
+	sport, dport, ok := ports(p.transport)
+	if !ok {
+		return
+	}
+
+	fl := flow{remotePort: dport, localPort: sport}
+	copy(fl.remote[:], p.dst.To16())
+
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.flows) >= maxUDPFlows {
+		for k, until := range f.flows {
+			if now.After(until) {
+				delete(f.flows, k)
+			}
+		}
+		// still full of open flows, the oldest replies may be dropped
+		if len(f.flows) >= maxUDPFlows {
+			f.flows = make(map[flow]time.Time)
+		}
+	}
+
+	f.flows[fl] = now.Add(udpFlowTimeout)
+}
+
+func (f *Filter) isReply(src net.IP, sport, dport uint16) bool {
+	fl := flow{remotePort: sport, localPort: dport}
+	copy(fl.remote[:], src.To16())
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	until, ok := f.flows[fl]
+	return ok && time.Now().Before(until)
+}
+
+// filters the packets wireguard writes to d
+//
+func (f *Filter) Wrap(d tun.Device) tun.Device {
+	return &device{Device: d, filter: f}
+}
+
+type device struct {
+	tun.Device
+	filter *Filter
+}
+
+// to the remote peers
+//
+func (d *device) Read(buf []byte, offset int) (int, error) {
+	n, err := d.Device.Read(buf, offset)
+	if err == nil && n > 0 {
+		d.filter.Track(buf[offset : offset+n])
+	}
+	return n, err
+}
+
+// from the remote peers, the dropped packets are not written
+//
+func (d *device) Write(buf []byte, offset int) (int, error) {
+	if !d.filter.Allow(buf[offset:]) {
+		return len(buf) - offset, nil
+	}
+	return d.Device.Write(buf, offset)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	selfIP  = net.ParseIP("100.64.0.1")
+	selfIP6 = net.ParseIP("fd00:d07::1")
+	peerIP  = net.ParseIP("100.64.0.2")
+	peerIP6 = net.ParseIP("fd00:d07::2")
+	otherIP = net.ParseIP("100.64.0.3")
+)
+
+// a packet from src to dst with the transport header, ipv4 or ipv6 by the addresses
+//
+func ipPacket(src, dst net.IP, proto uint8, transport []byte) []byte {
+	if src.To4() != nil {
+		b := make([]byte, 20)
+		b[0] = 0x45
+		b[9] = proto
+		copy(b[12:16], src.To4())
+		copy(b[16:20], dst.To4())
+		return append(b, transport...)
+	}
+
+	b := make([]byte, 40)
+	b[0] = 0x60
+	b[6] = proto
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(b, transport...)
+}
+
+func tcpPacket(src, dst net.IP, sport, dport uint16, flags byte) []byte {
+	t := make([]byte, 20)
+	binary.BigEndian.PutUint16(t[0:2], sport)
+	binary.BigEndian.PutUint16(t[2:4], dport)
+	t[13] = flags
+	return ipPacket(src, dst, protoTCP, t)
+}
+
+func udpPacket(src, dst net.IP, sport, dport uint16) []byte {
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint16(t[0:2], sport)
+	binary.BigEndian.PutUint16(t[2:4], dport)
+	return ipPacket(src, dst, protoUDP, t)
+}
+
+func icmpPacket(src, dst net.IP, typ byte) []byte {
+	if src.To4() != nil {
+		return ipPacket(src, dst, protoICMP, []byte{typ, 0, 0, 0, 0, 0, 0, 0})
+	}
+	return ipPacket(src, dst, protoICMPv6, []byte{typ, 0, 0, 0, 0, 0, 0, 0})
+}
+
+func compile(t *testing.T, p *Policy) *Ruleset {
+	t.Helper()
+
+	peers := []Peer{
+		{MachineKey: "peer", IPs: []net.IP{peerIP, peerIP6}, Tags: []string{"db"}},
+		{MachineKey: "other", IPs: []net.IP{otherIP}},
+	}
+	rs, err := Compile(p, []net.IP{selfIP, selfIP6}, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestFilterAllow(t *testing.T) {
+	ssh := &Policy{Rules: []Rule{{Src: []string{"tag:db"}, Proto: "tcp", Ports: []string{"22"}}}}
+	web := &Policy{Rules: []Rule{{Src: []string{"*"}, Ports: []string{"8000-8100"}}}}
+	icmp := &Policy{Rules: []Rule{{Src: []string{"100.64.0.2"}, Proto: "icmp"}}}
+
+	tests := []struct {
+		name   string
+		policy *Policy
+		packet []byte
+		allow  bool
+	}{
+		{"no policy", nil, tcpPacket(otherIP, selfIP, 40000, 22, tcpFlagSYN), true},
+		{"syn matched", ssh, tcpPacket(peerIP, selfIP, 40000, 22, tcpFlagSYN), true},
+		{"syn matched over ipv6", ssh, tcpPacket(peerIP6, selfIP6, 40000, 22, tcpFlagSYN), true},
+		{"syn from another peer", ssh, tcpPacket(otherIP, selfIP, 40000, 22, tcpFlagSYN), false},
+		{"syn to another port", ssh, tcpPacket(peerIP, selfIP, 40000, 80, tcpFlagSYN), false},
+		{"syn of udp rule", &Policy{Rules: []Rule{{Src: []string{"*"}, Proto: "udp"}}}, tcpPacket(peerIP, selfIP, 40000, 22, tcpFlagSYN), false},
+		{"reply of tcp", ssh, tcpPacket(otherIP, selfIP, 80, 40000, tcpFlagSYN|tcpFlagACK), true},
+		{"established tcp", ssh, tcpPacket(otherIP, selfIP, 80, 40000, tcpFlagACK), true},
+		{"port range", web, udpPacket(otherIP, selfIP, 40000, 8080), true},
+		{"out of port range", web, udpPacket(otherIP, selfIP, 40000, 8101), false},
+		{"echo request matched", icmp, icmpPacket(peerIP, selfIP, icmpEchoRequest), true},
+		{"empty policy", &Policy{}, tcpPacket(peerIP, selfIP, 40000, 22, tcpFlagSYN), false},
+		{"echo reply", &Policy{}, icmpPacket(peerIP, selfIP, 0), true},
+		{"fragmentation needed", &Policy{}, icmpPacket(peerIP, selfIP, 3), true},
+		{"invalid packet", &Policy{}, []byte{0x45, 0}, false},
+
+		// always accepted whatever the rules are
+		{"echo request", &Policy{}, icmpPacket(otherIP, selfIP, icmpEchoRequest), true},
+		{"echo request over ipv6", &Policy{}, icmpPacket(peerIP6, selfIP6, icmpv6EchoRequest), true},
+		{"dns over udp", ssh, udpPacket(otherIP, selfIP, 40000, dnsPort), true},
+		{"dns over tcp", ssh, tcpPacket(otherIP, selfIP, 40000, dnsPort, tcpFlagSYN), true},
+		{"dns over ipv6", ssh, udpPacket(peerIP6, selfIP6, 40000, dnsPort), true},
+		{"dns to another address", ssh, udpPacket(otherIP, net.ParseIP("192.168.1.53"), 40000, dnsPort), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New()
+			f.SetRuleset(compile(t, tt.policy))
+
+			if got := f.Allow(tt.packet); got != tt.allow {
+				t.Fatalf("got %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
+
+// the udp packets from a remote peer are accepted only as the replies to the flows this machine has sent to
+//
+func TestFilterTrack(t *testing.T) {
+	f := New()
+	f.SetRuleset(compile(t, &Policy{}))
+
+	reply := udpPacket(peerIP, selfIP, 5000, 40000)
+	if f.Allow(reply) {
+		t.Fatal("accepted before this machine has sent to the flow")
+	}
+
+	f.Track(udpPacket(selfIP, peerIP, 40000, 5000))
+
+	tests := []struct {
+		name   string
+		packet []byte
+		allow  bool
+	}{
+		{"reply", reply, true},
+		{"from another port", udpPacket(peerIP, selfIP, 5001, 40000), false},
+		{"to another port", udpPacket(peerIP, selfIP, 5000, 40001), false},
+		{"from another peer", udpPacket(otherIP, selfIP, 5000, 40000), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := f.Allow(tt.packet); got != tt.allow {
+				t.Fatalf("got %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the nftables script replacing table with the ruleset for the input from tunname,
+// in one transaction. conntrack accepts the replies
+//
+func NftScript(table, tunname string, rs *Ruleset) string {
+	b := &strings.Builder{}
+
+	// creates the table when it does not exist, so that it can be deleted
+	fmt.Fprintf(b, "table inet %s\n", table)
+	fmt.Fprintf(b, "delete table inet %s\n", table)
+	fmt.Fprintf(b, "table inet %s {\n", table)
+	fmt.Fprintf(b, "\tchain input {\n")
+	fmt.Fprintf(b, "\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(b, "\t\tiifname != %q accept\n", tunname)
+	fmt.Fprintf(b, "\t\tct state established,related accept\n")
+
+	// always accepted, see the package comment
+	fmt.Fprintf(b, "\t\ticmp type echo-request accept\n")
+	fmt.Fprintf(b, "\t\ticmpv6 type echo-request accept\n")
+	for _, ip := range rs.self {
+		if ip4 := ip.To4(); ip4 != nil {
+			fmt.Fprintf(b, "\t\tip daddr %s meta l4proto { tcp, udp } th dport %d accept\n", ip4.String(), dnsPort)
+		} else {
+			fmt.Fprintf(b, "\t\tip6 daddr %s meta l4proto { tcp, udp } th dport %d accept\n", ip.String(), dnsPort)
+		}
+	}
+
+	for _, r := range rs.rules {
+		for _, line := range r.nftRules() {
+			fmt.Fprintf(b, "\t\t%s accept\n", line)
+		}
+	}
+
+	fmt.Fprintf(b, "\t\tdrop\n")
+	fmt.Fprintf(b, "\t}\n")
+	fmt.Fprintf(b, "}\n")
+
+	return b.String()
+}
+
+// the matches of the rule, one per ip family
+//
+func (r *rule) nftRules() []string {
+	var v4, v6 []string
+	for _, n := range r.srcs {
+		if n.IP.To4() != nil {
+			v4 = append(v4, n.String())
+		} else {
+			v6 = append(v6, n.String())
+		}
+	}
+
+	ports := []string{}
+	for _, pr := range r.ports {
+		if pr.first == pr.last {
+			ports = append(ports, fmt.Sprint(pr.first))
+		} else {
+			ports = append(ports, fmt.Sprintf("%d-%d", pr.first, pr.last))
+		}
+	}
+
+	families := []struct {
+		nfproto string
+		saddr   string
+		srcs    []string
+		icmp    string
+	}{
+		{"ipv4", "ip saddr", v4, "icmp"},
+		{"ipv6", "ip6 saddr", v6, "ipv6-icmp"},
+	}
+
+	lines := []string{}
+	for _, f := range families {
+		var match []string
+		switch {
+		case r.anySrc:
+			match = append(match, "meta nfproto "+f.nfproto)
+		case len(f.srcs) > 0:
+			match = append(match, fmt.Sprintf("%s { %s }", f.saddr, strings.Join(f.srcs, ", ")))
+		default:
+			// a tag or a machine key without any peer
+			continue
+		}
+
+		switch {
+		case r.proto == protoICMP:
+			match = append(match, "meta l4proto "+f.icmp)
+		case r.proto == protoTCP && len(ports) > 0:
+			match = append(match, fmt.Sprintf("tcp dport { %s }", strings.Join(ports, ", ")))
+		case r.proto == protoUDP && len(ports) > 0:
+			match = append(match, fmt.Sprintf("udp dport { %s }", strings.Join(ports, ", ")))
+		case r.proto == protoTCP:
+			match = append(match, "meta l4proto tcp")
+		case r.proto == protoUDP:
+			match = append(match, "meta l4proto udp")
+		case len(ports) > 0:
+			match = append(match, fmt.Sprintf("meta l4proto { tcp, udp } th dport { %s }", strings.Join(ports, ", ")))
+		}
+
+		lines = append(lines, strings.Join(match, " "))
+	}
+
+	return lines
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNftScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		rules  []string
+	}{
+		{"empty policy", &Policy{}, nil},
+		{
+			"any src",
+			&Policy{Rules: []Rule{{Src: []string{"*"}, Proto: "tcp", Ports: []string{"22", "8000-8100"}}}},
+			[]string{
+				"meta nfproto ipv4 tcp dport { 22, 8000-8100 } accept",
+				"meta nfproto ipv6 tcp dport { 22, 8000-8100 } accept",
+			},
+		},
+		{
+			"tag",
+			&Policy{Rules: []Rule{{Src: []string{"tag:db"}, Proto: "udp"}}},
+			[]string{
+				"ip saddr { 100.64.0.2/32 } meta l4proto udp accept",
+				"ip6 saddr { fd00:d07::2/128 } meta l4proto udp accept",
+			},
+		},
+		{
+			"ipv4 only",
+			&Policy{Rules: []Rule{{Src: []string{"100.64.0.3", "10.0.0.0/8"}, Proto: "icmp"}}},
+			[]string{"ip saddr { 100.64.0.3/32, 10.0.0.0/8 } meta l4proto icmp accept"},
+		},
+		{
+			"ports of any proto",
+			&Policy{Rules: []Rule{{Src: []string{"other"}, Ports: []string{"53"}}}},
+			[]string{"ip saddr { 100.64.0.3/32 } meta l4proto { tcp, udp } th dport { 53 } accept"},
+		},
+		{
+			"machine key of no peer",
+			&Policy{Rules: []Rule{{Src: []string{"unknown"}}}},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := NftScript("dotshake_ds0", "ds0", compile(t, tt.policy))
+
+			want := []string{
+				"table inet dotshake_ds0",
+				"delete table inet dotshake_ds0",
+				"table inet dotshake_ds0 {",
+				"chain input {",
+				"type filter hook input priority 0; policy accept;",
+				`iifname != "ds0" accept`,
+				"ct state established,related accept",
+				// always accepted
+				"icmp type echo-request accept",
+				"icmpv6 type echo-request accept",
+				"ip daddr 100.64.0.1 meta l4proto { tcp, udp } th dport 53 accept",
+				"ip6 daddr fd00:d07::1 meta l4proto { tcp, udp } th dport 53 accept",
+			}
+			want = append(want, tt.rules...)
+			want = append(want, "drop", "}", "}")
+
+			got := strings.Split(strings.TrimSpace(script), "\n")
+			for i := range got {
+				got[i] = strings.TrimSpace(got[i])
+			}
+
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
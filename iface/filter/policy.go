@@ -0,0 +1,317 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package filter
+
+// filter package is the packet filter of the traffic from the remote peers to this machine.
+// once a policy is set, a new connection from a remote peer is accepted only when
+// one of the rules matches it, the replies to the connections of this machine are always accepted.
+// the policy is compiled against the remote peers into a ruleset, which is enforced
+// inline on the userspace and netstack devices, and with nftables on the kernel device.
+//
+// whatever the rules are, the echo requests and the dns queries to the overlay addresses
+// of this machine are accepted as well. the remote peers ask the dns server of this machine
+// for its name, and ping it through the overlay. the pings and the path mtu probes between
+// the wire proxies go outside of the tunnel, so the filter never sees them
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	// of the dns server on the overlay addresses
+	dnsPort = 53
+
+	anySrc    = "*"
+	tagPrefix = "tag:"
+)
+
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// accepts the new connections from Src to Ports over Proto
+type Rule struct {
+	// remote peers, "*", "tag:<tag>", a machine key, an overlay ip or a cidr
+	Src []string `json:"src"`
+	// tcp, udp or icmp, all of them when empty
+	Proto string `json:"proto,omitempty"`
+	// destination ports, e.g. 22 or 8000-8100, all of them when empty
+	Ports []string `json:"ports,omitempty"`
+}
+
+// a remote peer the sources of the rules are resolved to
+type Peer struct {
+	MachineKey string
+	IPs        []net.IP
+	Tags       []string
+}
+
+// parses the tags of the remote peers in the form of peer=tag,tag, e.g. <machine key>=db,prod,
+// where peer is a machine key or an overlay ip. returns the valid ones with the error of the first invalid one
+//
+func ParseTags(values []string) (map[string][]string, error) {
+	tags := make(map[string][]string)
+
+	var firstErr error
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		peer, t, ok := strings.Cut(v, "=")
+		peer = strings.TrimSpace(peer)
+		if !ok || peer == "" {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invalid peer tags %s, peer=tag is expected", v)
+			}
+			continue
+		}
+
+		for _, tag := range strings.Split(t, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), tagPrefix)
+			if tag != "" {
+				tags[peer] = append(tags[peer], tag)
+			}
+		}
+	}
+
+	return tags, firstErr
+}
+
+func (p *Policy) Validate() error {
+	_, err := Compile(p, nil, nil)
+	return err
+}
+
+// the rules with their sources resolved to the addresses of the remote peers,
+// nil accepts everything
+type Ruleset struct {
+	rules []rule
+	// the overlay addresses of this machine, the dns queries to them are always accepted
+	self []net.IP
+}
+
+type rule struct {
+	anySrc bool
+	srcs   []*net.IPNet
+	// one of protoICMP, protoTCP and protoUDP, 0 for all of them
+	proto uint8
+	ports []portRange
+}
+
+type portRange struct {
+	first, last uint16
+}
+
+// self is the overlay addresses of this machine. returns nil when p is nil,
+// an empty policy accepts only what is always accepted
+//
+func Compile(p *Policy, self []net.IP, peers []Peer) (*Ruleset, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	rs := &Ruleset{self: self}
+	for n, r := range p.Rules {
+		compiled, err := compileRule(r, peers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d, %w", n+1, err)
+		}
+		rs.rules = append(rs.rules, compiled)
+	}
+
+	return rs, nil
+}
+
+func compileRule(r Rule, peers []Peer) (rule, error) {
+	c := rule{}
+
+	if len(r.Src) == 0 {
+		return c, errors.New("no src")
+	}
+
+	for _, s := range r.Src {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == anySrc:
+			c.anySrc = true
+		case strings.HasPrefix(s, tagPrefix):
+			tag := strings.TrimPrefix(s, tagPrefix)
+			if tag == "" {
+				return c, errors.New("empty tag")
+			}
+			for _, p := range peers {
+				if hasTag(p, tag) {
+					c.srcs = append(c.srcs, hostNets(p.IPs)...)
+				}
+			}
+		case strings.Contains(s, "/"):
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return c, err
+			}
+			c.srcs = append(c.srcs, ipNet)
+		case net.ParseIP(s) != nil:
+			c.srcs = append(c.srcs, hostNets([]net.IP{net.ParseIP(s)})...)
+		case s != "":
+			// a machine key, which matches nothing until the peer joins
+			for _, p := range peers {
+				if p.MachineKey == s {
+					c.srcs = append(c.srcs, hostNets(p.IPs)...)
+				}
+			}
+		default:
+			return c, errors.New("empty src")
+		}
+	}
+
+	switch strings.ToLower(r.Proto) {
+	case "":
+	case "tcp":
+		c.proto = protoTCP
+	case "udp":
+		c.proto = protoUDP
+	case "icmp":
+		c.proto = protoICMP
+	default:
+		return c, fmt.Errorf("unknown proto %s, tcp, udp or icmp is expected", r.Proto)
+	}
+
+	for _, p := range r.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return c, err
+		}
+		c.ports = append(c.ports, pr)
+	}
+	if len(c.ports) > 0 && c.proto == protoICMP {
+		return c, errors.New("icmp has no ports")
+	}
+
+	return c, nil
+}
+
+func hasTag(p Peer, tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func hostNets(ips []net.IP) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+		} else {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return nets
+}
+
+func parsePortRange(s string) (portRange, error) {
+	first, last, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		last = first
+	}
+
+	f, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %s", s)
+	}
+	l, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || l < f {
+		return portRange{}, fmt.Errorf("invalid port %s", s)
+	}
+
+	return portRange{first: uint16(f), last: uint16(l)}, nil
+}
+
+// whether a rule accepts a new connection from src to port over proto.
+// icmpv6 is matched by the icmp rules, and the rules with ports match only tcp and udp
+//
+func (rs *Ruleset) Match(src net.IP, proto uint8, port uint16) bool {
+	if rs == nil {
+		return true
+	}
+
+	if proto == protoICMPv6 {
+		proto = protoICMP
+	}
+
+	for _, r := range rs.rules {
+		if r.proto != 0 && r.proto != proto {
+			continue
+		}
+		if !r.matchSrc(src) {
+			continue
+		}
+		if len(r.ports) == 0 {
+			return true
+		}
+		if proto != protoTCP && proto != protoUDP {
+			continue
+		}
+		for _, pr := range r.ports {
+			if port >= pr.first && port <= pr.last {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// whether the new connection to dst and port over proto is accepted whatever the rules are,
+// see the package comment
+//
+func (rs *Ruleset) alwaysAccepted(dst net.IP, proto uint8, port uint16) bool {
+	if rs == nil {
+		return true
+	}
+
+	switch proto {
+	case protoICMP, protoICMPv6:
+		// only the echo requests are new connections
+		return true
+	case protoTCP, protoUDP:
+		if port != dnsPort {
+			return false
+		}
+		for _, ip := range rs.self {
+			if ip.Equal(dst) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *rule) matchSrc(src net.IP) bool {
+	if r.anySrc {
+		return true
+	}
+	for _, n := range r.srcs {
+		if n.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import "errors"
+
+var errForwardingUnsupported = errors.New("forwarding the traffic of the remote peers is not supported on darwin yet")
+
+func enableExitNode(tunname, overlayCIDR, ipv6Prefix string) error {
+	return errForwardingUnsupported
+}
+
+func disableExitNode(tunname string) error {
+	return nil
+}
+
+func enableSubnetRouter(tunname, overlayCIDR, ipv6Prefix string, routes []string) error {
+	return errForwardingUnsupported
+}
+
+func disableSubnetRouter(tunname string) error {
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+// forwarding of the traffic of the remote peers to the other interfaces on linux,
+// as an exit node to the internet or as a subnet router to the advertised routes.
+// the traffic is masqueraded with the addresses of this machine,
+// so that the other networks need no routes back to the overlay.
+// both of them enable the forwarding sysctls, which are restored once neither uses them
+//
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	ipv4Forwarding = "/proc/sys/net/ipv4/ip_forward"
+	ipv6Forwarding = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+// iptables rules and sysctls acquired by a forwarding
+type forwarding struct {
+	rules   [][]string
+	sysctls map[string]struct{}
+}
+
+var (
+	// by tun and what is forwarded
+	forwardings   = make(map[string]*forwarding)
+	forwardingsMu = &sync.Mutex{}
+)
+
+// a forwarding sysctl shared by the exit node and the subnet router
+type sharedSysctl struct {
+	users int
+	// value before the first user enabled it
+	old string
+}
+
+var (
+	// by path
+	sharedSysctls   = make(map[string]*sharedSysctl)
+	sharedSysctlsMu = &sync.Mutex{}
+)
+
+// enables the sysctl for one more user
+//
+func acquireSysctl(sysctl string) error {
+	sharedSysctlsMu.Lock()
+	defer sharedSysctlsMu.Unlock()
+
+	if s, ok := sharedSysctls[sysctl]; ok {
+		s.users++
+		return nil
+	}
+
+	b, err := os.ReadFile(sysctl)
+	if err != nil {
+		return err
+	}
+	old := strings.TrimSpace(string(b))
+
+	if old != "1" {
+		err = os.WriteFile(sysctl, []byte("1"), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to enable forwarding, %w", err)
+		}
+	}
+
+	sharedSysctls[sysctl] = &sharedSysctl{users: 1, old: old}
+
+	return nil
+}
+
+// restores the sysctl when the last user releases it
+//
+func releaseSysctl(sysctl string) error {
+	sharedSysctlsMu.Lock()
+	defer sharedSysctlsMu.Unlock()
+
+	s, ok := sharedSysctls[sysctl]
+	if !ok {
+		return nil
+	}
+
+	s.users--
+	if s.users > 0 {
+		return nil
+	}
+	delete(sharedSysctls, sysctl)
+
+	if s.old == "1" {
+		return nil
+	}
+	return os.WriteFile(sysctl, []byte(s.old), 0644)
+}
+
+func enableExitNode(tunname, overlayCIDR, ipv6Prefix string) error {
+	forwardingsMu.Lock()
+	defer forwardingsMu.Unlock()
+
+	key := tunname + "/exit-node"
+	if _, ok := forwardings[key]; ok {
+		return nil
+	}
+
+	fwd := &forwarding{sysctls: make(map[string]struct{})}
+
+	err := fwd.enable("iptables", ipv4Forwarding, tunname, overlayCIDR, "")
+	if err == nil && ipv6Prefix != "" {
+		err = fwd.enable("ip6tables", ipv6Forwarding, tunname, ipv6Prefix, "")
+	}
+	if err != nil {
+		fwd.disable()
+		return err
+	}
+
+	forwardings[key] = fwd
+
+	return nil
+}
+
+func disableExitNode(tunname string) error {
+	return disableForwarding(tunname + "/exit-node")
+}
+
+// replaces the routes forwarded before
+//
+func enableSubnetRouter(tunname, overlayCIDR, ipv6Prefix string, routes []string) error {
+	err := disableSubnetRouter(tunname)
+	if err != nil {
+		return err
+	}
+
+	forwardingsMu.Lock()
+	defer forwardingsMu.Unlock()
+
+	fwd := &forwarding{sysctls: make(map[string]struct{})}
+
+	for _, r := range routes {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			fwd.disable()
+			return err
+		}
+
+		if ipNet.IP.To4() != nil {
+			err = fwd.enable("iptables", ipv4Forwarding, tunname, overlayCIDR, ipNet.String())
+		} else if ipv6Prefix != "" {
+			err = fwd.enable("ip6tables", ipv6Forwarding, tunname, ipv6Prefix, ipNet.String())
+		} else {
+			err = fmt.Errorf("%s needs the ipv6 overlay, ipv6_prefix is not configured", r)
+		}
+		if err != nil {
+			fwd.disable()
+			return err
+		}
+	}
+
+	forwardings[tunname+"/subnet-router"] = fwd
+
+	return nil
+}
+
+func disableSubnetRouter(tunname string) error {
+	return disableForwarding(tunname + "/subnet-router")
+}
+
+// forwards the traffic from source on the tun to dst, or to the other interfaces when dst is empty
+//
+func (f *forwarding) enable(iptables, sysctl, tunname, source, dst string) error {
+	if _, ok := f.sysctls[sysctl]; !ok {
+		err := acquireSysctl(sysctl)
+		if err != nil {
+			return err
+		}
+		f.sysctls[sysctl] = struct{}{}
+	}
+
+	var rules [][]string
+	if dst == "" {
+		rules = [][]string{
+			{iptables, "-t", "nat", "-A", "POSTROUTING", "-s", source, "!", "-o", tunname, "-j", "MASQUERADE"},
+			{iptables, "-A", "FORWARD", "-i", tunname, "-j", "ACCEPT"},
+			{iptables, "-A", "FORWARD", "-o", tunname, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		}
+	} else {
+		rules = [][]string{
+			{iptables, "-t", "nat", "-A", "POSTROUTING", "-s", source, "-d", dst, "!", "-o", tunname, "-j", "MASQUERADE"},
+			{iptables, "-A", "FORWARD", "-i", tunname, "-d", dst, "-j", "ACCEPT"},
+			{iptables, "-A", "FORWARD", "-o", tunname, "-s", dst, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		}
+	}
+
+	for _, r := range rules {
+		out, err := exec.Command(r[0], r[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to %s, %s %w", strings.Join(r, " "), strings.TrimSpace(string(out)), err)
+		}
+		f.rules = append(f.rules, r)
+	}
+
+	return nil
+}
+
+// deletes the rules in the reverse order and releases the sysctls
+//
+func (f *forwarding) disable() error {
+	var firstErr error
+	for n := len(f.rules) - 1; n >= 0; n-- {
+		r := append([]string{}, f.rules[n]...)
+		for k, a := range r {
+			if a == "-A" {
+				r[k] = "-D"
+			}
+		}
+
+		err := exec.Command(r[0], r[1:]...).Run()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to %s, %w", strings.Join(r, " "), err)
+		}
+	}
+
+	for sysctl := range f.sysctls {
+		err := releaseSysctl(sysctl)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f.rules = nil
+	f.sysctls = make(map[string]struct{})
+
+	return firstErr
+}
+
+func disableForwarding(key string) error {
+	forwardingsMu.Lock()
+	fwd, ok := forwardings[key]
+	delete(forwardings, key)
+	forwardingsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return fwd.disable()
+}
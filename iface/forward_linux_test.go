@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the exit node and the subnet router share the sysctl, the last one to release it restores it
+//
+func TestSharedSysctl(t *testing.T) {
+	type step struct {
+		acquire bool
+		// value of the sysctl after the step
+		want string
+	}
+
+	tests := []struct {
+		name  string
+		old   string
+		steps []step
+	}{
+		{"one user", "0", []step{{true, "1"}, {false, "0"}}},
+		{
+			"released in the order acquired",
+			"0",
+			[]step{{true, "1"}, {true, "1"}, {false, "1"}, {false, "0"}},
+		},
+		{
+			"acquired again after the last release",
+			"0",
+			[]step{{true, "1"}, {false, "0"}, {true, "1"}, {false, "0"}},
+		},
+		{"already enabled", "1", []step{{true, "1"}, {true, "1"}, {false, "1"}, {false, "1"}}},
+		{"released more than acquired", "0", []step{{true, "1"}, {false, "0"}, {false, "0"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysctl := filepath.Join(t.TempDir(), "forwarding")
+			err := os.WriteFile(sysctl, []byte(tt.old+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for n, s := range tt.steps {
+				if s.acquire {
+					err = acquireSysctl(sysctl)
+				} else {
+					err = releaseSysctl(sysctl)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				b, err := os.ReadFile(sysctl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := strings.TrimSpace(string(b)); got != s.want {
+					t.Fatalf("step %d: got %q, want %q", n, got, s.want)
+				}
+			}
+
+			if _, ok := sharedSysctls[sysctl]; ok {
+				t.Fatal("still shared after the last release")
+			}
+		})
+	}
+}
+
+// a forwarding releases each sysctl it has acquired once, however many routes use it
+//
+func TestForwardingReleasesSysctlOnce(t *testing.T) {
+	sysctl := filepath.Join(t.TempDir(), "forwarding")
+	err := os.WriteFile(sysctl, []byte("0"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// held by the other forwarding
+	err = acquireSysctl(sysctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseSysctl(sysctl)
+
+	f := &forwarding{sysctls: map[string]struct{}{}}
+	err = acquireSysctl(sysctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.sysctls[sysctl] = struct{}{}
+
+	f.disable()
+	f.disable()
+
+	b, _ := os.ReadFile(sysctl)
+	if strings.TrimSpace(string(b)) != "1" {
+		t.Fatal("restored while the other forwarding still uses it")
+	}
+}
@@ -5,19 +5,32 @@
 package iface
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/Notch-Technologies/dotshake/dotlog"
 	"github.com/Notch-Technologies/dotshake/wireguard"
-	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// tun name of the userspace networking mode. wireguard runs on a netstack in this process,
+// nothing is configured on the host and no privileges are needed.
+// UserspaceNetworking-<suffix> names more of them in one process
+const UserspaceNetworking = "userspace-networking"
+
+func IsUserspaceNetworking(tunname string) bool {
+	return tunname == UserspaceNetworking || strings.HasPrefix(tunname, UserspaceNetworking+"-")
+}
+
+// the tun device could not be created, e.g. without NET_ADMIN or /dev/net/tun
+var errTunUnavailable = errors.New("tun device is unavailable")
+
 type Iface struct {
 	// your wireguard interface name
 	Tun string
@@ -27,6 +40,8 @@ type Iface struct {
 	IP string
 	// your cidr range
 	CIDR string
+	// your ipv6 overlay address with the prefix length, optional
+	IPv6 string
 
 	dotlog *dotlog.DotLog
 }
@@ -56,13 +71,13 @@ func (i *Iface) ConfigureToRemotePeer(
 		i.Tun, remotePeerPubKey, remoteip, endpoint.IP.String(), endpoint.Port,
 	)
 
-	_, ipNet, err := net.ParseCIDR(remoteip)
+	allowedIPs, err := parseAllowedIPs(remoteip)
 	if err != nil {
 		i.dotlog.Logger.Errorf("failed to parse cidr")
 		return err
 	}
 
-	i.dotlog.Logger.Debugf("allowed remote ip [%s]", ipNet.IP.String())
+	i.dotlog.Logger.Debugf("allowed remote ip [%s]", remoteip)
 
 	parsedRemotePeerPubKey, err := wgtypes.ParseKey(remotePeerPubKey)
 	if err != nil {
@@ -82,7 +97,7 @@ func (i *Iface) ConfigureToRemotePeer(
 	peer := wgtypes.PeerConfig{
 		PublicKey:                   parsedRemotePeerPubKey,
 		ReplaceAllowedIPs:           true,
-		AllowedIPs:                  []net.IPNet{*ipNet},
+		AllowedIPs:                  allowedIPs,
 		PersistentKeepaliveInterval: &keepAlive,
 		PresharedKey:                &parsedPreSharedkey,
 		Endpoint:                    endpoint,
@@ -102,6 +117,10 @@ func (i *Iface) ConfigureToRemotePeer(
 }
 
 func (i *Iface) configureDevice(config wgtypes.Config) error {
+	if dev := getNetstackDevice(i.Tun); dev != nil {
+		return dev.IpcSet(uapiConfig(config))
+	}
+
 	wg, err := wgctrl.New()
 	if err != nil {
 		i.dotlog.Logger.Errorf("failed to wgctl")
@@ -118,6 +137,62 @@ func (i *Iface) configureDevice(config wgtypes.Config) error {
 	return wg.ConfigureDevice(i.Tun, config)
 }
 
+// returns the peers currently configured on the wireguard device
+//
+func (i *Iface) GetRemotePeers() ([]wgtypes.Peer, error) {
+	if dev := getNetstackDevice(i.Tun); dev != nil {
+		s, err := dev.IpcGet()
+		if err != nil {
+			return nil, err
+		}
+		return parseUAPIPeers(s)
+	}
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		i.dotlog.Logger.Errorf("failed to wgctl")
+		return nil, err
+	}
+	defer wg.Close()
+
+	d, err := wg.Device(i.Tun)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Peers, nil
+}
+
+// replaces the allowed ips of a peer already on the device, keeping its endpoint and session.
+// nothing is done when the peer is not on the device yet
+//
+func (i *Iface) UpdatePeer(remotePeerPubKey, remoteip string) error {
+	i.dotlog.Logger.Debugf("updating allowed ips of [%s] on %s to [%s]", remotePeerPubKey, i.Tun, remoteip)
+
+	allowedIPs, err := parseAllowedIPs(remoteip)
+	if err != nil {
+		return err
+	}
+
+	parsedRemotePeerPubKey, err := wgtypes.ParseKey(remotePeerPubKey)
+	if err != nil {
+		return err
+	}
+
+	peer := wgtypes.PeerConfig{
+		PublicKey:         parsedRemotePeerPubKey,
+		UpdateOnly:        true,
+		ReplaceAllowedIPs: true,
+		AllowedIPs:        allowedIPs,
+	}
+
+	config := wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peer},
+	}
+
+	return i.configureDevice(config)
+}
+
 func (i *Iface) RemoveRemotePeer(iface string, remoteip, remotePeerPubKey string) error {
 	i.dotlog.Logger.Debugf("delete %s on %s", remotePeerPubKey, i.Tun)
 
@@ -141,14 +216,16 @@ func (i *Iface) RemoveRemotePeer(iface string, remoteip, remotePeerPubKey string
 func (i *Iface) CreateWithUserSpace(address string) error {
 	tunIface, err := tun.CreateTUN(i.Tun, wireguard.DefaultMTU)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w, %s", errTunUnavailable, err.Error())
 	}
 
-	tunDevice := device.NewDevice(tunIface, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, "wissy: "))
+	bind := NewICEBind()
+	tunDevice := device.NewDevice(withFilter(i.Tun, tunIface), bind, device.NewLogger(device.LogLevelSilent, "wissy: "))
 	err = tunDevice.Up()
 	if err != nil {
 		return err
 	}
+	setBind(i.Tun, bind)
 
 	uapi, err := getUAPI(i.Tun)
 	if err != nil {
@@ -171,5 +248,138 @@ func (i *Iface) CreateWithUserSpace(address string) error {
 		return err
 	}
 
+	if i.IPv6 != "" {
+		err = assignAddr6(i.Tun, i.IPv6)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+func CreateIface(
+	i *Iface,
+	dotlog *dotlog.DotLog,
+) error {
+	if IsUserspaceNetworking(i.Tun) {
+		return i.CreateWithNetstack()
+	}
+
+	return createIface(i, dotlog)
+}
+
+func RemoveIface(
+	tunname string,
+	dotlog *dotlog.DotLog,
+) error {
+	err := removeFilter(tunname)
+	if err != nil {
+		dotlog.Logger.Warnf("failed to remove the packet filter of %s, %s", tunname, err.Error())
+	}
+
+	if closeNetstack(tunname) {
+		return nil
+	}
+
+	return removeIface(tunname, dotlog)
+}
+
+// sets the mtu of the interface, of the stack for a netstack interface
+//
+func SetMTU(tunname string, mtu int) error {
+	if ns := getNetstack(tunname); ns != nil {
+		return ns.SetMTU(mtu)
+	}
+
+	return setMTU(tunname, mtu)
+}
+
+// routes all the traffic to the tunnel, except for the traffic to the bypassed ips
+// and from the wireguard and ice sockets. the exit node is the peer whose allowed ips
+// have the default routes. nothing to do for a netstack interface,
+// whose conns are dialed through the tunnel anyway
+//
+func SetExitRoutes(tunname string, bypass []net.IP, ipv6 bool) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return setExitRoutes(tunname, bypass, ipv6)
+}
+
+// replaces the servers which keep off the exit node set by SetExitRoutes
+//
+func SetExitBypass(tunname string, bypass []net.IP) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return setExitBypass(bypass)
+}
+
+func ClearExitRoutes(tunname string) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return clearExitRoutes(tunname)
+}
+
+// forwards and masquerades the traffic of the remote peers from overlayCIDR,
+// and from ipv6Prefix when it is not empty, to the internet
+//
+func EnableExitNode(tunname, overlayCIDR, ipv6Prefix string) error {
+	if getNetstack(tunname) != nil {
+		return errors.New("an exit node needs a tun device, not the userspace networking mode")
+	}
+
+	return enableExitNode(tunname, overlayCIDR, ipv6Prefix)
+}
+
+func DisableExitNode(tunname string) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return disableExitNode(tunname)
+}
+
+// forwards and masquerades the traffic of the remote peers from overlayCIDR,
+// and from ipv6Prefix when it is not empty, to the local networks of routes.
+// replaces the routes forwarded before
+//
+func EnableSubnetRouter(tunname, overlayCIDR, ipv6Prefix string, routes []string) error {
+	if getNetstack(tunname) != nil {
+		return errors.New("a subnet router needs a tun device, not the userspace networking mode")
+	}
+
+	return enableSubnetRouter(tunname, overlayCIDR, ipv6Prefix, routes)
+}
+
+func DisableSubnetRouter(tunname string) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return disableSubnetRouter(tunname)
+}
+
+// routes prefix, a subnet advertised by a remote peer, to the tunnel.
+// nothing to do for a netstack interface, which routes everything to the tunnel
+//
+func AddSubnetRoute(tunname, prefix string) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return addSubnetRoute(tunname, prefix)
+}
+
+func DelSubnetRoute(tunname, prefix string) error {
+	if getNetstack(tunname) != nil {
+		return nil
+	}
+
+	return delSubnetRoute(tunname, prefix)
+}
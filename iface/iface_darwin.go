@@ -5,27 +5,32 @@
 package iface
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/Notch-Technologies/dotshake/dotlog"
 	"github.com/Notch-Technologies/dotshake/utils"
 	"github.com/Notch-Technologies/dotshake/wireguard"
-	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-func CreateIface(
+func createIface(
 	i *Iface,
 	dotlog *dotlog.DotLog,
 ) error {
 	addr := i.IP + "/" + i.CIDR
 
 	err := i.createWithUserSpace(i.Tun, addr)
+	if errors.Is(err, errTunUnavailable) {
+		// the netstack runs only when it has been asked for with the tun name
+		return fmt.Errorf("%w, set the tun name to %s to run without it", err, UserspaceNetworking)
+	}
 	if err != nil {
 		dotlog.Logger.Warnf("failed to create user space, because %v", err)
 		return err
@@ -50,7 +55,7 @@ func CreateIface(
 	return i.configureDevice(config)
 }
 
-func RemoveIface(
+func removeIface(
 	tunname string,
 	dotlog *dotlog.DotLog,
 ) error {
@@ -71,14 +76,16 @@ func RemoveIface(
 func (i *Iface) createWithUserSpace(tunname, address string) error {
 	tunIface, err := tun.CreateTUN(tunname, wireguard.DefaultMTU)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w, %s", errTunUnavailable, err.Error())
 	}
 
-	tunDevice := device.NewDevice(tunIface, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, "dotshake: "))
+	bind := NewICEBind()
+	tunDevice := device.NewDevice(withFilter(tunname, tunIface), bind, device.NewLogger(device.LogLevelSilent, "dotshake: "))
 	err = tunDevice.Up()
 	if err != nil {
 		return err
 	}
+	setBind(tunname, bind)
 
 	uapi, err := getUAPI(tunname)
 	if err != nil {
@@ -101,6 +108,13 @@ func (i *Iface) createWithUserSpace(tunname, address string) error {
 		return err
 	}
 
+	if i.IPv6 != "" {
+		err = assignAddr6(tunname, i.IPv6)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -124,3 +138,33 @@ func assignAddr(tunname, address string) error {
 
 	return nil
 }
+
+func assignAddr6(tunname, address string) error {
+	ip, resolvedNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return err
+	}
+	ones, _ := resolvedNet.Mask.Size()
+
+	cmd := exec.Command("ifconfig", tunname, "inet6", ip.String(), "prefixlen", strconv.Itoa(ones), "alias")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("Command: %v failed with output %s and error: %v", cmd.String(), out, err)
+		return err
+	}
+
+	cmd = exec.Command("route", "add", "-inet6", "-net", resolvedNet.String(), "-interface", tunname)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		fmt.Printf("Command: %v failed with output %s and error: %v", cmd.String(), out, err)
+	}
+
+	return nil
+}
+
+func setMTU(tunname string, mtu int) error {
+	cmd := exec.Command("ifconfig", tunname, "mtu", strconv.Itoa(mtu))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set mtu of %s to %d, %s, %w", tunname, mtu, string(out), err)
+	}
+
+	return nil
+}
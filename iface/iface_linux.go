@@ -5,10 +5,12 @@
 package iface
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/Notch-Technologies/dotshake/distro"
@@ -27,24 +29,33 @@ func isWireGuardModule(
 	return err == nil
 }
 
-func CreateIface(
+func createIface(
 	i *Iface,
 	dotlog *dotlog.DotLog,
 ) error {
 	addr := i.IP + "/" + i.CIDR
 
-	if distro.Get() == distro.NixOS {
-		return createWithKernelSpace(i.Tun, i.WgPrivateKey, addr, dotlog)
-	}
+	if distro.Get() == distro.NixOS || isWireGuardModule(dotlog) {
+		err := createWithKernelSpace(i.Tun, i.WgPrivateKey, addr, dotlog)
+		if err != nil {
+			return err
+		}
 
-	if isWireGuardModule(dotlog) {
-		return createWithKernelSpace(i.Tun, i.WgPrivateKey, addr, dotlog)
+		if i.IPv6 != "" {
+			return assignAddr6(i.Tun, i.IPv6)
+		}
+		return nil
 	}
 
-	return createWithUserSpace(i, addr)
+	err := createWithUserSpace(i, addr)
+	if errors.Is(err, errTunUnavailable) {
+		// the netstack runs only when it has been asked for with the tun name
+		return fmt.Errorf("%w, set the tun name to %s to run without it", err, UserspaceNetworking)
+	}
+	return err
 }
 
-func RemoveIface(
+func removeIface(
 	tunname string,
 	dotlog *dotlog.DotLog,
 ) error {
@@ -97,7 +108,7 @@ func createWithKernelSpace(
 		return err
 	}
 
-	fMark := 0
+	fMark := wireguard.FwMark
 	port := wireguard.WgPort
 	wgConf := wgtypes.Config{
 		PrivateKey:   &key,
@@ -151,6 +162,20 @@ func assignAddr(tunname, address string) error {
 	return nil
 }
 
+func assignAddr6(tunname, address string) error {
+	ipCmd, err := exec.LookPath("ip")
+	if err != nil {
+		return err
+	}
+
+	_, err = utils.ExecCmd(ipCmd + " -6 address add dev " + tunname + " " + address)
+	if err != nil {
+		return fmt.Errorf("failed to add ipv6 address [%s] to %s, %w", address, tunname, err)
+	}
+
+	return nil
+}
+
 func createWithUserSpace(i *Iface, address string) error {
 	err := i.CreateWithUserSpace(address)
 	if err != nil {
@@ -162,7 +187,7 @@ func createWithUserSpace(i *Iface, address string) error {
 		return err
 	}
 
-	fwmark := 0
+	fwmark := wireguard.FwMark
 	port := wireguard.WgPort
 	config := wgtypes.Config{
 		PrivateKey:   &key,
@@ -173,3 +198,17 @@ func createWithUserSpace(i *Iface, address string) error {
 
 	return i.configureDevice(config)
 }
+
+func setMTU(tunname string, mtu int) error {
+	ipCmd, err := exec.LookPath("ip")
+	if err != nil {
+		return err
+	}
+
+	_, err = utils.ExecCmd(ipCmd + " link set dev " + tunname + " mtu " + strconv.Itoa(mtu))
+	if err != nil {
+		return fmt.Errorf("failed to set mtu of %s to %d, %w", tunname, mtu, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+// optional ipv6 overlay addresses.
+// the server only assigns ipv4 addresses, so the interface id of the ipv6 address
+// is derived from the wireguard public key. every machine configured with the same
+// prefix computes the same address for a peer without asking the server
+//
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net"
+	"strings"
+)
+
+const overlayIPv6PrefixLen = 64
+
+// returns the overlay address of the machine with wgPubKey in prefix, e.g. fd00:d07::/64
+//
+func OverlayIPv6(prefix, wgPubKey string) (net.IP, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	if bits != net.IPv6len*8 || ipNet.IP.To4() != nil {
+		return nil, errors.New("ipv6 overlay prefix must be an ipv6 network")
+	}
+	if ones != overlayIPv6PrefixLen {
+		return nil, errors.New("ipv6 overlay prefix must be a /64")
+	}
+
+	h := sha256.Sum256([]byte(wgPubKey))
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipNet.IP.To16())
+	copy(ip[overlayIPv6PrefixLen/8:], h[:net.IPv6len-overlayIPv6PrefixLen/8])
+
+	return ip, nil
+}
+
+// overlay address with the prefix length, to be assigned to the interface
+//
+func OverlayIPv6Addr(prefix, wgPubKey string) (string, error) {
+	ip, err := OverlayIPv6(prefix, wgPubKey)
+	if err != nil {
+		return "", err
+	}
+
+	ipNet := net.IPNet{IP: ip, Mask: net.CIDRMask(overlayIPv6PrefixLen, net.IPv6len*8)}
+	return ipNet.String(), nil
+}
+
+// overlay address of a remote peer, to be used as its allowed ip
+//
+func OverlayIPv6AllowedIP(prefix, wgPubKey string) (string, error) {
+	ip, err := OverlayIPv6(prefix, wgPubKey)
+	if err != nil {
+		return "", err
+	}
+
+	ipNet := net.IPNet{IP: ip, Mask: net.CIDRMask(net.IPv6len*8, net.IPv6len*8)}
+	return ipNet.String(), nil
+}
+
+// parses allowed ips joined with a comma, like 10.0.0.2/32,fd00:d07::1/128
+//
+func parseAllowedIPs(allowedIPs string) ([]net.IPNet, error) {
+	var ipNets []net.IPNet
+	for _, s := range strings.Split(allowedIPs, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, *ipNet)
+	}
+
+	if len(ipNets) == 0 {
+		return nil, errors.New("no allowed ips")
+	}
+
+	return ipNets, nil
+}
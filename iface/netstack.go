@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Notch-Technologies/dotshake/iface/netstack"
+	"github.com/Notch-Technologies/dotshake/wireguard"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type netstackIface struct {
+	ns  *netstack.Device
+	dev *device.Device
+}
+
+var (
+	netstacks   = make(map[string]*netstackIface)
+	netstacksMu = &sync.Mutex{}
+)
+
+// creates the userspace device on a netstack instead of a tun device,
+// nothing is configured on the host. the overlay is reached only through the netstack
+//
+func (i *Iface) CreateWithNetstack() error {
+	var addrs []net.IP
+	for _, a := range []string{i.IP, i.IPv6} {
+		if a == "" {
+			continue
+		}
+
+		ip := net.ParseIP(strings.Split(a, "/")[0])
+		if ip == nil {
+			return fmt.Errorf("invalid address %s", a)
+		}
+		addrs = append(addrs, ip)
+	}
+
+	ns, err := netstack.Create(i.Tun, addrs, wireguard.DefaultMTU)
+	if err != nil {
+		return err
+	}
+
+	bind := NewICEBind()
+	tunDevice := device.NewDevice(withFilter(i.Tun, ns), bind, device.NewLogger(device.LogLevelSilent, "dotshake: "))
+	err = tunDevice.Up()
+	if err != nil {
+		tunDevice.Close()
+		return err
+	}
+	setBind(i.Tun, bind)
+
+	netstacksMu.Lock()
+	netstacks[i.Tun] = &netstackIface{ns: ns, dev: tunDevice}
+	netstacksMu.Unlock()
+
+	// the device is configured in this process, the uapi socket is only for the wg command
+	uapi, err := getUAPI(i.Tun)
+	if err != nil {
+		i.dotlog.Logger.Warnf("no uapi socket for %s, %s", i.Tun, err.Error())
+	} else {
+		go func() {
+			for {
+				conn, err := uapi.Accept()
+				if err != nil {
+					// closed with the device
+					return
+				}
+				go tunDevice.IpcHandle(conn)
+			}
+		}()
+
+		go func() {
+			<-tunDevice.Wait()
+			uapi.Close()
+		}()
+	}
+
+	key, err := wgtypes.ParseKey(i.WgPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	// no fwmark, setting it needs CAP_NET_ADMIN
+	port := wireguard.WgPort
+	config := wgtypes.Config{
+		PrivateKey:   &key,
+		ReplacePeers: false,
+		ListenPort:   &port,
+	}
+
+	return i.configureDevice(config)
+}
+
+// returns the netstack of the interface, nil for the kernel and tun devices
+//
+func (i *Iface) Netstack() *netstack.Device {
+	return getNetstack(i.Tun)
+}
+
+func getNetstack(tun string) *netstack.Device {
+	netstacksMu.Lock()
+	defer netstacksMu.Unlock()
+
+	n, ok := netstacks[tun]
+	if !ok {
+		return nil
+	}
+	return n.ns
+}
+
+func getNetstackDevice(tun string) *device.Device {
+	netstacksMu.Lock()
+	defer netstacksMu.Unlock()
+
+	n, ok := netstacks[tun]
+	if !ok {
+		return nil
+	}
+	return n.dev
+}
+
+// closes the device of a netstack interface, returns false for the other interfaces
+//
+func closeNetstack(tun string) bool {
+	netstacksMu.Lock()
+	n, ok := netstacks[tun]
+	delete(netstacks, tun)
+	netstacksMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	// closes the netstack and the bind as well
+	n.dev.Close()
+
+	return true
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package netstack
+
+// connections from the remote peers to the overlay addresses of this machine.
+// they go to the listeners of this process first, the other tcp connections
+// are forwarded to the same port on localhost, so that the services of the machine
+// are reachable as they are through a tun device
+//
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// connections being established by the forwarder at once
+	maxInFlightForwards = 512
+	// tcp window of the forwarded connections, 0 is the default of the stack
+	forwardRcvWnd = 0
+
+	forwardDialTimeout = 5 * time.Second
+)
+
+// listens on the overlay addresses of this machine, address is :port or ip:port.
+// network is tcp, tcp4 or tcp6
+//
+func (d *Device) Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w %s", errUnsupportedNetwork, network)
+	}
+
+	addr, proto, err := listenAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := gonet.ListenTCP(d.stack, addr, proto)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// network is udp, udp4 or udp6
+//
+func (d *Device) ListenPacket(network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("%w %s", errUnsupportedNetwork, network)
+	}
+
+	addr, proto, err := listenAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := gonet.DialUDP(d.stack, &addr, nil, proto)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// forwards the tcp connections without a listener in this process
+// to the same port on localhost
+//
+func (d *Device) ForwardTCPToLocalhost() {
+	fwd := tcp.NewForwarder(d.stack, forwardRcvWnd, maxInFlightForwards, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		port := strconv.Itoa(int(id.LocalPort))
+
+		local, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", port), forwardDialTimeout)
+		if err != nil {
+			// refused like a closed port
+			r.Complete(true)
+			return
+		}
+
+		var wq waiter.Queue
+		ep, tcpErr := r.CreateEndpoint(&wq)
+		if tcpErr != nil {
+			r.Complete(true)
+			local.Close()
+			return
+		}
+		r.Complete(false)
+
+		go pipe(gonet.NewTCPConn(&wq, ep), local)
+	})
+
+	d.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
+}
+
+// copies between the two conns until both directions are done
+//
+func pipe(a, b net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,288 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package netstack
+
+// netstack package is an in-process tcp/ip stack used as the tun device of wireguard-go
+// where no tun device can be created, e.g. in containers without NET_ADMIN.
+// wireguard writes the decrypted ip packets of the remote peers to the stack
+// and reads the packets the stack sends, and the programs in this process
+// reach the overlay with Dial instead of the kernel
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	nicID = 1
+
+	// packets sent by the stack waiting for wireguard to read them
+	outboundQueueSize = 1024
+)
+
+var errUnsupportedNetwork = errors.New("unsupported network")
+
+type Device struct {
+	name string
+
+	ep    *channel.Endpoint
+	stack *stack.Stack
+
+	events chan tun.Event
+	// guards events against the sends after Close
+	eventsMu *sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// creates the stack with the overlay addresses of this machine,
+// every packet the stack sends goes to wireguard
+//
+func Create(name string, addrs []net.IP, mtu int) (*Device, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+		HandleLocal:        true,
+	})
+
+	sack := tcpip.TCPSACKEnabled(true)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return nil, fmt.Errorf("failed to enable tcp sack, %s", err)
+	}
+
+	ep := channel.New(outboundQueueSize, uint32(mtu), "")
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		return nil, fmt.Errorf("failed to create nic, %s", err)
+	}
+
+	var hasV4, hasV6 bool
+	for _, ip := range addrs {
+		addr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddrFromSlice(ip.To4()).WithPrefix(),
+		}
+		if ip.To4() == nil {
+			addr.Protocol = ipv6.ProtocolNumber
+			addr.AddressWithPrefix = tcpip.AddrFromSlice(ip.To16()).WithPrefix()
+			hasV6 = true
+		} else {
+			hasV4 = true
+		}
+
+		if err := s.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+			return nil, fmt.Errorf("failed to add %s, %s", ip.String(), err)
+		}
+	}
+
+	if hasV4 {
+		s.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID})
+	}
+	if hasV6 {
+		s.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: nicID})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &Device{
+		name: name,
+
+		ep:    ep,
+		stack: s,
+
+		events:   make(chan tun.Event, 1),
+		eventsMu: &sync.Mutex{},
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	d.events <- tun.EventUp
+
+	return d, nil
+}
+
+func (d *Device) File() *os.File { return nil }
+
+func (d *Device) Name() (string, error) { return d.name, nil }
+
+func (d *Device) Events() chan tun.Event { return d.events }
+
+func (d *Device) Flush() error { return nil }
+
+func (d *Device) MTU() (int, error) {
+	return int(d.ep.MTU()), nil
+}
+
+// sets the mtu of the stack, wireguard reads it on the next handshake
+//
+func (d *Device) SetMTU(mtu int) error {
+	d.ep.SetMTU(uint32(mtu))
+
+	d.eventsMu.Lock()
+	defer d.eventsMu.Unlock()
+
+	if d.ctx.Err() != nil {
+		return os.ErrClosed
+	}
+
+	select {
+	case d.events <- tun.EventMTUUpdate:
+	default:
+	}
+
+	return nil
+}
+
+// reads a packet sent by the stack for wireguard to encrypt
+//
+func (d *Device) Read(buf []byte, offset int) (int, error) {
+	pkt := d.ep.ReadContext(d.ctx)
+	if pkt == nil {
+		return 0, os.ErrClosed
+	}
+	defer pkt.DecRef()
+
+	view := pkt.ToView()
+	defer view.Release()
+
+	return view.Read(buf[offset:])
+}
+
+// hands a packet decrypted by wireguard to the stack
+//
+func (d *Device) Write(buf []byte, offset int) (int, error) {
+	packet := buf[offset:]
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	var proto tcpip.NetworkProtocolNumber
+	switch packet[0] >> 4 {
+	case 4:
+		proto = header.IPv4ProtocolNumber
+	case 6:
+		proto = header.IPv6ProtocolNumber
+	default:
+		// not an ip packet, wireguard drops it as well
+		return len(buf), nil
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
+	d.ep.InjectInbound(proto, pkt)
+	pkt.DecRef()
+
+	return len(buf), nil
+}
+
+func (d *Device) Close() error {
+	d.eventsMu.Lock()
+	defer d.eventsMu.Unlock()
+
+	if d.ctx.Err() != nil {
+		return nil
+	}
+	d.cancel()
+
+	d.stack.RemoveNIC(nicID)
+	d.stack.Close()
+	d.ep.Close()
+	close(d.events)
+
+	return nil
+}
+
+// connects to address, an ip and a port, through the overlay.
+// network is tcp, tcp4, tcp6, udp, udp4 or udp6
+//
+func (d *Device) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, proto, err := fullAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// not returned directly, a nil conn would be a non-nil net.Conn
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		c, err := gonet.DialContextTCP(ctx, d.stack, addr, proto)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case "udp", "udp4", "udp6":
+		c, err := gonet.DialUDP(d.stack, nil, &addr, proto)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("%w %s", errUnsupportedNetwork, network)
+	}
+}
+
+func fullAddr(address string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("%s is not an ip address", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("invalid port %s", port)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ip4), Port: uint16(p)}, ipv4.ProtocolNumber, nil
+	}
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(ip.To16()), Port: uint16(p)}, ipv6.ProtocolNumber, nil
+}
+
+// address of a listener, any overlay address of this machine when the ip is omitted
+//
+func listenAddr(network, address string) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, err
+	}
+
+	if host != "" {
+		return fullAddr(address)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return tcpip.FullAddress{}, 0, fmt.Errorf("invalid port %s", port)
+	}
+
+	proto := ipv4.ProtocolNumber
+	if strings.HasSuffix(network, "6") {
+		proto = ipv6.ProtocolNumber
+	}
+	return tcpip.FullAddress{NIC: nicID, Port: uint16(p)}, proto, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package netstack
+
+// icmp echo through the overlay. the stack answers the echo requests
+// to the overlay addresses of this machine by itself
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+var pingSeq uint32
+
+// sends an echo request to ip and waits for the reply until ctx is done,
+// returns the round trip time
+//
+func (d *Device) Ping(ctx context.Context, ip net.IP) (time.Duration, error) {
+	addr, proto, err := fullAddr(net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return 0, err
+	}
+
+	transport := icmp.ProtocolNumber6
+	request, reply := byte(header.ICMPv6EchoRequest), byte(header.ICMPv6EchoReply)
+	if proto == ipv4.ProtocolNumber {
+		transport = icmp.ProtocolNumber4
+		request, reply = byte(header.ICMPv4Echo), byte(header.ICMPv4EchoReply)
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := d.stack.NewEndpoint(transport, proto, &wq)
+	if tcpErr != nil {
+		return 0, fmt.Errorf("failed to create icmp endpoint, %s", tcpErr)
+	}
+	defer ep.Close()
+
+	we, readable := waiter.NewChannelEntry(waiter.ReadableEvents)
+	wq.EventRegister(&we)
+	defer wq.EventUnregister(&we)
+
+	if tcpErr := ep.Connect(addr); tcpErr != nil {
+		return 0, fmt.Errorf("failed to connect to %s, %s", ip.String(), tcpErr)
+	}
+
+	// the stack sets the identifier and the checksum
+	seq := uint16(atomic.AddUint32(&pingSeq, 1))
+	echo := make([]byte, header.ICMPv4MinimumSize)
+	echo[0] = request
+	binary.BigEndian.PutUint16(echo[6:], seq)
+
+	start := time.Now()
+	if _, tcpErr := ep.Write(bytes.NewReader(echo), tcpip.WriteOptions{}); tcpErr != nil {
+		return 0, fmt.Errorf("failed to send echo request to %s, %s", ip.String(), tcpErr)
+	}
+
+	for {
+		var b bytes.Buffer
+		_, tcpErr := ep.Read(&b, tcpip.ReadOptions{})
+		if _, ok := tcpErr.(*tcpip.ErrWouldBlock); ok {
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-readable:
+			}
+			continue
+		}
+		if tcpErr != nil {
+			return 0, fmt.Errorf("failed to read echo reply from %s, %s", ip.String(), tcpErr)
+		}
+
+		r := b.Bytes()
+		if len(r) >= header.ICMPv4MinimumSize && r[0] == reply && binary.BigEndian.Uint16(r[6:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
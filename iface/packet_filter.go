@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"sync"
+
+	"github.com/Notch-Technologies/dotshake/iface/filter"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// the inline filters of the userspace and netstack devices
+var (
+	filters   = make(map[string]*filter.Filter)
+	filtersMu = &sync.Mutex{}
+)
+
+// filters the packets from the remote peers written to the device of tunname
+//
+func withFilter(tunname string, d tun.Device) tun.Device {
+	f := filter.New()
+
+	filtersMu.Lock()
+	filters[tunname] = f
+	filtersMu.Unlock()
+
+	return f.Wrap(d)
+}
+
+func getFilter(tunname string) *filter.Filter {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+
+	return filters[tunname]
+}
+
+// filters the traffic from the remote peers to this machine with rs, nil accepts everything.
+// inline on the userspace and netstack devices, with nftables on the kernel device
+//
+func SetFilter(tunname string, rs *filter.Ruleset) error {
+	if f := getFilter(tunname); f != nil {
+		f.SetRuleset(rs)
+		return nil
+	}
+
+	if rs == nil {
+		return clearKernelFilter(tunname)
+	}
+	return setKernelFilter(tunname, rs)
+}
+
+func removeFilter(tunname string) error {
+	filtersMu.Lock()
+	_, ok := filters[tunname]
+	delete(filters, tunname)
+	filtersMu.Unlock()
+
+	if ok {
+		return nil
+	}
+	// the table outlives the kernel device
+	return clearKernelFilter(tunname)
+}
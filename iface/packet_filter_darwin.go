@@ -0,0 +1,20 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"errors"
+
+	"github.com/Notch-Technologies/dotshake/iface/filter"
+)
+
+// the devices on darwin are always in userspace and filtered inline
+func setKernelFilter(tunname string, rs *filter.Ruleset) error {
+	return errors.New("no userspace device of " + tunname + " to filter")
+}
+
+func clearKernelFilter(tunname string) error {
+	return nil
+}
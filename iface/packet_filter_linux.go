@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/Notch-Technologies/dotshake/iface/filter"
+)
+
+// the scripts set on the kernel devices, empty when cleared, not to run nft again for the same ruleset
+var (
+	nftScripts   = make(map[string]string)
+	nftScriptsMu = &sync.Mutex{}
+)
+
+func nftTable(tunname string) string {
+	return "dotshake_" + tunname
+}
+
+// replaces the nftables table of tunname with rs in one transaction,
+// the traffic from the remote peers is never left unfiltered while updating
+//
+func setKernelFilter(tunname string, rs *filter.Ruleset) error {
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		return fmt.Errorf("failed to filter the traffic of %s, nft is not found, %w", tunname, err)
+	}
+
+	script := filter.NftScript(nftTable(tunname), tunname, rs)
+
+	nftScriptsMu.Lock()
+	defer nftScriptsMu.Unlock()
+
+	if nftScripts[tunname] == script {
+		return nil
+	}
+
+	cmd := exec.Command(nft, "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set the packet filter of %s, %s %w", tunname, strings.TrimSpace(string(out)), err)
+	}
+	nftScripts[tunname] = script
+
+	return nil
+}
+
+// deletes the table, also the one left by a crashed process
+//
+func clearKernelFilter(tunname string) error {
+	nftScriptsMu.Lock()
+	defer nftScriptsMu.Unlock()
+
+	if script, ok := nftScripts[tunname]; ok && script == "" {
+		return nil
+	}
+	nftScripts[tunname] = ""
+
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		// nothing has been set without nft
+		return nil
+	}
+
+	// fails when the table does not exist
+	_ = exec.Command(nft, "delete", "table", "inet", nftTable(tunname)).Run()
+
+	return nil
+}
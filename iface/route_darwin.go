@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+func addSubnetRoute(tunname, prefix string) error {
+	return route("add", tunname, prefix)
+}
+
+func delSubnetRoute(tunname, prefix string) error {
+	return route("delete", tunname, prefix)
+}
+
+func route(action, tunname, prefix string) error {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+
+	family := "-inet"
+	if ipNet.IP.To4() == nil {
+		family = "-inet6"
+	}
+
+	cmd := exec.Command("route", "-n", action, family, "-net", ipNet.String(), "-interface", tunname)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to %s route %s, %s %w", action, prefix, strings.TrimSpace(string(out)), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+func addSubnetRoute(tunname, prefix string) error {
+	return ipCommand("route", "replace", prefix, "dev", tunname)
+}
+
+func delSubnetRoute(tunname, prefix string) error {
+	return ipCommand("route", "del", prefix, "dev", tunname)
+}
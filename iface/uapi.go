@@ -0,0 +1,157 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package iface
+
+// configuration of the userspace device in this process with the uapi text protocol,
+// used for the netstack interfaces, which have no uapi socket without privileges
+//
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func uapiKey(k wgtypes.Key) string {
+	return hex.EncodeToString(k[:])
+}
+
+func uapiConfig(c wgtypes.Config) string {
+	var b strings.Builder
+
+	if c.PrivateKey != nil {
+		fmt.Fprintf(&b, "private_key=%s\n", uapiKey(*c.PrivateKey))
+	}
+	if c.ListenPort != nil {
+		fmt.Fprintf(&b, "listen_port=%d\n", *c.ListenPort)
+	}
+	if c.FirewallMark != nil {
+		fmt.Fprintf(&b, "fwmark=%d\n", *c.FirewallMark)
+	}
+	if c.ReplacePeers {
+		b.WriteString("replace_peers=true\n")
+	}
+
+	for _, p := range c.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", uapiKey(p.PublicKey))
+
+		if p.Remove {
+			b.WriteString("remove=true\n")
+			continue
+		}
+		if p.UpdateOnly {
+			b.WriteString("update_only=true\n")
+		}
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", uapiKey(*p.PresharedKey))
+		}
+		if p.Endpoint != nil {
+			fmt.Fprintf(&b, "endpoint=%s\n", p.Endpoint.String())
+		}
+		if p.PersistentKeepaliveInterval != nil {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(p.PersistentKeepaliveInterval.Seconds()))
+		}
+		if p.ReplaceAllowedIPs {
+			b.WriteString("replace_allowed_ips=true\n")
+		}
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip.String())
+		}
+	}
+
+	return b.String()
+}
+
+// parses the peers of the output of a uapi get
+//
+func parseUAPIPeers(s string) ([]wgtypes.Peer, error) {
+	var peers []wgtypes.Peer
+	var p *wgtypes.Peer
+	var sec, nsec int64
+
+	flush := func() {
+		if p == nil {
+			return
+		}
+		if sec != 0 || nsec != 0 {
+			p.LastHandshakeTime = time.Unix(sec, nsec)
+		}
+		peers = append(peers, *p)
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		kv := strings.SplitN(sc.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k, v := kv[0], kv[1]
+
+		if k == "public_key" {
+			flush()
+
+			b, err := hex.DecodeString(v)
+			if err != nil {
+				return nil, err
+			}
+			key, err := wgtypes.NewKey(b)
+			if err != nil {
+				return nil, err
+			}
+			p = &wgtypes.Peer{PublicKey: key}
+			sec, nsec = 0, 0
+			continue
+		}
+
+		// the interface settings before the first peer
+		if p == nil {
+			continue
+		}
+
+		var err error
+		switch k {
+		case "preshared_key":
+			var b []byte
+			b, err = hex.DecodeString(v)
+			if err == nil {
+				p.PresharedKey, err = wgtypes.NewKey(b)
+			}
+		case "endpoint":
+			p.Endpoint, err = net.ResolveUDPAddr("udp", v)
+		case "persistent_keepalive_interval":
+			var n int
+			n, err = strconv.Atoi(v)
+			p.PersistentKeepaliveInterval = time.Duration(n) * time.Second
+		case "last_handshake_time_sec":
+			sec, err = strconv.ParseInt(v, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, err = strconv.ParseInt(v, 10, 64)
+		case "rx_bytes":
+			p.ReceiveBytes, err = strconv.ParseInt(v, 10, 64)
+		case "tx_bytes":
+			p.TransmitBytes, err = strconv.ParseInt(v, 10, 64)
+		case "allowed_ip":
+			var n *net.IPNet
+			_, n, err = net.ParseCIDR(v)
+			if err == nil {
+				p.AllowedIPs = append(p.AllowedIPs, *n)
+			}
+		case "protocol_version":
+			p.ProtocolVersion, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of %s, %w", k, p.PublicKey.String(), err)
+		}
+	}
+	flush()
+
+	return peers, sc.Err()
+}
@@ -6,13 +6,18 @@ package conn
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/Notch-Technologies/dotshake/dotlog"
 	"github.com/Notch-Technologies/dotshake/rcn/proxy"
 	"github.com/pion/ice/v2"
 )
 
+// how long Close waits for the wire proxy to stop
+const stopTimeout = 5 * time.Second
+
 type Conn struct {
 	agent      *ice.Agent
 	remoteConn *ice.Conn
@@ -66,16 +71,17 @@ func NewConn(
 }
 
 func (c *Conn) Start() error {
+	var remoteConn *ice.Conn
 	var err error
 	if c.wgPubKey > c.remoteWgPubKey {
-		c.remoteConn, err = c.agent.Dial(c.ctx, c.uname, c.pwd)
+		remoteConn, err = c.agent.Dial(c.ctx, c.uname, c.pwd)
 		if err != nil {
 			c.dotlog.Logger.Errorf("failed to dial agent")
 			return err
 		}
 		c.dotlog.Logger.Debugf("completed dial agent")
 	} else {
-		c.remoteConn, err = c.agent.Accept(c.ctx, c.uname, c.pwd)
+		remoteConn, err = c.agent.Accept(c.ctx, c.uname, c.pwd)
 		if err != nil {
 			c.dotlog.Logger.Errorf("failed to accept agent")
 			return err
@@ -83,7 +89,16 @@ func (c *Conn) Start() error {
 		c.dotlog.Logger.Debugf("completed accept agent")
 	}
 
-	err = c.wireproxy.StartProxy(c.remoteConn)
+	c.mu.Lock()
+	c.remoteConn = remoteConn
+	c.mu.Unlock()
+
+	// closed while dialing
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+
+	err = c.wireproxy.StartProxy(remoteConn)
 	if err != nil {
 		c.dotlog.Logger.Errorf("failed to start proxy, %s", err.Error())
 		return err
@@ -94,24 +109,37 @@ func (c *Conn) Start() error {
 	return nil
 }
 
+// stops dialing, stops the wire proxy and closes the ice conn.
+// waits stopTimeout at most for the goroutines of the wire proxy to exit
+//
 func (c *Conn) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// stops dialing or accepting
+	c.cancel()
+
 	if c.wireproxy == nil {
 		return nil
 	}
 
-	err := c.wireproxy.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	err := c.wireproxy.Stop(ctx)
 	if err != nil {
-		c.dotlog.Logger.Errorf("failed to stop wireproxy")
-		return err
+		c.dotlog.Logger.Errorf("failed to stop wireproxy, %s", err.Error())
 	}
 
-	// close the ice agent connection
-	c.cancel()
+	// closing the ice conn closes the agent as well
+	if c.remoteConn != nil {
+		cerr := c.remoteConn.Close()
+		if cerr != nil && !errors.Is(cerr, ice.ErrClosed) {
+			c.dotlog.Logger.Debugf("failed to close ice conn, %s", cerr.Error())
+		}
+	}
 
 	c.dotlog.Logger.Debugf("close conn")
 
-	return nil
+	return err
 }
@@ -0,0 +1,354 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package conn
+
+// lifecycle state of the connection to each remote machine.
+// ice updates it and rcn sock exposes it to the dotshake commands
+//
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/rcn/proxy"
+)
+
+type PeerState string
+
+const (
+	PeerNew          PeerState = "NEW"
+	PeerConnecting   PeerState = "CONNECTING"
+	PeerConnected    PeerState = "CONNECTED"
+	PeerDisconnected PeerState = "DISCONNECTED"
+	PeerRestarting   PeerState = "RESTARTING"
+	PeerFailed       PeerState = "FAILED"
+	PeerClosed       PeerState = "CLOSED"
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerNew:
+		return "new"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerRestarting:
+		return "restarting"
+	case PeerFailed:
+		return "failed"
+	case PeerClosed:
+		return "closed"
+	default:
+		return "unreachable"
+	}
+}
+
+var peerStateTransitions = map[PeerState][]PeerState{
+	PeerNew:          {PeerConnecting, PeerRestarting, PeerFailed, PeerClosed},
+	PeerConnecting:   {PeerConnected, PeerDisconnected, PeerRestarting, PeerFailed, PeerClosed},
+	PeerConnected:    {PeerDisconnected, PeerRestarting, PeerFailed, PeerClosed},
+	PeerDisconnected: {PeerConnected, PeerRestarting, PeerFailed, PeerClosed},
+	PeerRestarting:   {PeerConnecting, PeerConnected, PeerRestarting, PeerFailed, PeerClosed},
+	PeerFailed:       {PeerRestarting, PeerClosed},
+	PeerClosed:       {},
+}
+
+func (s PeerState) CanTransitionTo(next PeerState) bool {
+	for _, n := range peerStateTransitions[s] {
+		if n == next {
+			return true
+		}
+	}
+	return false
+}
+
+type PeerStatus struct {
+	RemoteMachineKey string
+	RemoteWgPubKey   string
+	State            PeerState
+	// ice restarts since the last successful connection
+	Restarts  int
+	UpdatedAt time.Time
+
+	// state of the ice agent and the types of the selected candidate pair,
+	// host, srflx, prflx or relay
+	IceState            string
+	LocalCandidateType  string
+	RemoteCandidateType string
+	// addresses of the selected candidate pair
+	LocalCandidateAddr  string
+	RemoteCandidateAddr string
+
+	// latest handshake of the wireguard peer, zero if it has never been made
+	LastHandshake time.Time
+	// bytes received from and sent to the wireguard peer
+	RxBytes int64
+	TxBytes int64
+
+	// round trip time of the path, zero until the first ping is answered
+	RTT time.Duration
+	// ratio of the pings lost in the latest sample
+	Loss float64
+	// samples taken by the control plane, the latest maxPathSamples
+	History []PathSample
+
+	// counters of the wire proxy, they start over when the ice of the peer is replaced
+	Proxy proxy.TrafficStats
+	// traffic per minute, the latest maxTrafficSamples
+	Traffic []TrafficSample
+
+	// tunnel mtu probed on the path MTUPathID, zero until it has been probed
+	PathMTU   int
+	MTUPathID string
+
+	// wireguard packets go through the relay server
+	Relayed bool
+
+	// address of the direct path found by the prober, empty when not on it
+	DirectPath string
+	// upgrades to and fallbacks from direct paths, the latest maxPathChanges
+	PathChanges []PathChange
+
+	LastError   string
+	LastErrorAt time.Time
+
+	// signals from the remote peer dropped because the inbox was full
+	SignalsDropped uint64
+}
+
+// returns how long ago the latest wireguard handshake was made, zero if never
+//
+func (p *PeerStatus) HandshakeAge() time.Duration {
+	if p.LastHandshake.IsZero() {
+		return 0
+	}
+	return time.Since(p.LastHandshake)
+}
+
+// returns how wireguard packets reach the remote peer,
+// direct, relay or the types of the selected candidate pair
+//
+func (p *PeerStatus) Path() string {
+	if p.DirectPath != "" {
+		return "direct"
+	}
+	if p.Relayed {
+		return "relay"
+	}
+	if p.LocalCandidateType == "" || p.RemoteCandidateType == "" {
+		return "-"
+	}
+	return p.LocalCandidateType + "/" + p.RemoteCandidateType
+}
+
+// identifies the path in use, changes when ice selects another pair,
+// the path is upgraded or falls back to the relay
+//
+func (p *PeerStatus) PathID() string {
+	remote := p.RemoteCandidateAddr
+	if p.DirectPath != "" {
+		remote = p.DirectPath
+	}
+	return p.Path() + " " + p.LocalCandidateAddr + " " + remote
+}
+
+// ten minutes of samples taken every 10 seconds
+const maxPathSamples = 60
+
+type PathSample struct {
+	At      time.Time
+	Path    string
+	RTT     time.Duration
+	Loss    float64
+	RxBytes int64
+	TxBytes int64
+}
+
+func (p *PeerStatus) AddPathSample(s PathSample) {
+	p.RTT = s.RTT
+	p.Loss = s.Loss
+	p.RxBytes = s.RxBytes
+	p.TxBytes = s.TxBytes
+
+	p.History = append(p.History, s)
+	if len(p.History) > maxPathSamples {
+		p.History = p.History[len(p.History)-maxPathSamples:]
+	}
+}
+
+// an hour of traffic
+const maxTrafficSamples = 60
+
+type TrafficSample struct {
+	// start of the minute
+	At time.Time
+	// bytes received from and sent to the wireguard peer
+	RxBytes int64
+	TxBytes int64
+	// traffic of the wire proxy
+	Proxy proxy.TrafficStats
+}
+
+// adds the traffic since the previous sample to the minute of at
+//
+func (p *PeerStatus) AddTraffic(at time.Time, rxBytes, txBytes int64, stats proxy.TrafficStats) {
+	minute := at.Truncate(time.Minute)
+
+	if n := len(p.Traffic); n > 0 && p.Traffic[n-1].At.Equal(minute) {
+		last := &p.Traffic[n-1]
+		last.RxBytes += rxBytes
+		last.TxBytes += txBytes
+		last.Proxy = last.Proxy.Add(stats)
+		return
+	}
+
+	p.Traffic = append(p.Traffic, TrafficSample{
+		At:      minute,
+		RxBytes: rxBytes,
+		TxBytes: txBytes,
+		Proxy:   stats,
+	})
+	if len(p.Traffic) > maxTrafficSamples {
+		p.Traffic = p.Traffic[len(p.Traffic)-maxTrafficSamples:]
+	}
+}
+
+const maxPathChanges = 8
+
+type PathChange struct {
+	At   time.Time
+	From string
+	To   string
+	// round trip time of the probe, zero when it is not measured
+	RTT    time.Duration
+	Reason string
+}
+
+func (p *PeerStatus) AddPathChange(c PathChange) {
+	p.PathChanges = append(p.PathChanges, c)
+	if len(p.PathChanges) > maxPathChanges {
+		p.PathChanges = p.PathChanges[len(p.PathChanges)-maxPathChanges:]
+	}
+}
+
+type PeerStatusStore struct {
+	peers map[string]*PeerStatus
+
+	mu *sync.Mutex
+}
+
+func NewPeerStatusStore() *PeerStatusStore {
+	return &PeerStatusStore{
+		peers: make(map[string]*PeerStatus),
+
+		mu: &sync.Mutex{},
+	}
+}
+
+// transition the state of the remote machine, returns false when the transition is not allowed.
+// adds the remote machine unless it is being closed
+//
+func (s *PeerStatusStore) SetState(remoteMachineKey string, next PeerState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.peers[remoteMachineKey]; !ok && next == PeerClosed {
+		return true
+	}
+
+	p := s.getOrCreate(remoteMachineKey)
+	if p.State == next {
+		return true
+	}
+
+	if !p.State.CanTransitionTo(next) {
+		return false
+	}
+
+	p.State = next
+	p.UpdatedAt = time.Now()
+
+	return true
+}
+
+// does nothing for a peer which is unknown or has been removed,
+// only SetState adds a peer
+//
+func (s *PeerStatusStore) Update(remoteMachineKey string, fn func(p *PeerStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[remoteMachineKey]
+	if !ok {
+		return
+	}
+
+	fn(p)
+}
+
+// the slices are copied as well, Update keeps writing to the ones of the store
+//
+func (p *PeerStatus) clone() PeerStatus {
+	c := *p
+	c.History = append([]PathSample(nil), p.History...)
+	c.Traffic = append([]TrafficSample(nil), p.Traffic...)
+	c.PathChanges = append([]PathChange(nil), p.PathChanges...)
+	return c
+}
+
+func (s *PeerStatusStore) Get(remoteMachineKey string) (PeerStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[remoteMachineKey]
+	if !ok {
+		return PeerStatus{}, false
+	}
+
+	return p.clone(), true
+}
+
+func (s *PeerStatusStore) Remove(remoteMachineKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.peers, remoteMachineKey)
+}
+
+// returns copies of the statuses ordered by remote machine key
+//
+func (s *PeerStatusStore) List() []PeerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]PeerStatus, 0, len(s.peers))
+	for _, p := range s.peers {
+		statuses = append(statuses, p.clone())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].RemoteMachineKey < statuses[j].RemoteMachineKey
+	})
+
+	return statuses
+}
+
+func (s *PeerStatusStore) getOrCreate(remoteMachineKey string) *PeerStatus {
+	p, ok := s.peers[remoteMachineKey]
+	if !ok {
+		p = &PeerStatus{
+			RemoteMachineKey: remoteMachineKey,
+			State:            PeerNew,
+			UpdatedAt:        time.Now(),
+		}
+		s.peers[remoteMachineKey] = p
+	}
+
+	return p
+}
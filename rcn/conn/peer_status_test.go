@@ -0,0 +1,153 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package conn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/rcn/proxy"
+)
+
+func TestPeerStatusStoreSetState(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []PeerState
+		// result of the last step
+		ok   bool
+		want PeerState
+	}{
+		{"new to connected through connecting", []PeerState{PeerNew, PeerConnecting, PeerConnected}, true, PeerConnected},
+		{"new to connected directly", []PeerState{PeerNew, PeerConnected}, false, PeerNew},
+		{"same state", []PeerState{PeerNew, PeerConnecting, PeerConnecting}, true, PeerConnecting},
+		{"reconnected", []PeerState{PeerNew, PeerConnecting, PeerConnected, PeerDisconnected, PeerConnected}, true, PeerConnected},
+		{"restart after failure", []PeerState{PeerNew, PeerFailed, PeerRestarting}, true, PeerRestarting},
+		{"failed does not connect", []PeerState{PeerNew, PeerFailed, PeerConnecting}, false, PeerFailed},
+		{"closed is final", []PeerState{PeerNew, PeerClosed, PeerRestarting}, false, PeerClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewPeerStatusStore()
+
+			var ok bool
+			for _, st := range tt.steps {
+				ok = s.SetState("mk", st)
+			}
+			if ok != tt.ok {
+				t.Fatalf("last transition returned %v, want %v", ok, tt.ok)
+			}
+
+			p, _ := s.Get("mk")
+			if p.State != tt.want {
+				t.Fatalf("got %s, want %s", p.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerStatusStoreClosedUnknownPeer(t *testing.T) {
+	s := NewPeerStatusStore()
+
+	if !s.SetState("mk", PeerClosed) {
+		t.Fatal("closing an unknown peer has been refused")
+	}
+	if _, ok := s.Get("mk"); ok {
+		t.Fatal("closing an unknown peer has added it")
+	}
+
+	// Update does not add a peer either
+	s.Update("mk", func(p *PeerStatus) { p.Restarts++ })
+	if len(s.List()) != 0 {
+		t.Fatalf("got %v, want no peers", s.List())
+	}
+}
+
+// the copies returned by List and Get do not change with the store
+//
+func TestPeerStatusStoreListCopies(t *testing.T) {
+	s := NewPeerStatusStore()
+	s.SetState("mk", PeerNew)
+
+	at := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.Update("mk", func(p *PeerStatus) {
+		p.AddTraffic(at, 1, 1, proxy.TrafficStats{})
+		p.AddPathSample(PathSample{At: at, RTT: time.Millisecond})
+		p.AddPathChange(PathChange{At: at, To: "relay"})
+	})
+
+	listed := s.List()[0]
+	got, _ := s.Get("mk")
+
+	// the same minute is added to the last sample in place
+	s.Update("mk", func(p *PeerStatus) {
+		p.AddTraffic(at.Add(time.Second), 10, 10, proxy.TrafficStats{})
+		p.History[0].RTT = time.Second
+		p.PathChanges[0].To = "direct"
+	})
+
+	for _, p := range []PeerStatus{listed, got} {
+		if p.Traffic[0].RxBytes != 1 || p.Traffic[0].TxBytes != 1 {
+			t.Fatalf("traffic of the copy has been changed, %+v", p.Traffic[0])
+		}
+		if p.History[0].RTT != time.Millisecond {
+			t.Fatalf("history of the copy has been changed, %+v", p.History[0])
+		}
+		if p.PathChanges[0].To != "relay" {
+			t.Fatalf("path changes of the copy have been changed, %+v", p.PathChanges[0])
+		}
+	}
+}
+
+func TestPeerStatusAddTraffic(t *testing.T) {
+	at := time.Date(2022, 1, 1, 0, 0, 30, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		samples []time.Time
+		// rx bytes of each minute, each sample adds one
+		want []int64
+	}{
+		{"same minute", []time.Time{at, at.Add(10 * time.Second)}, []int64{2}},
+		{"next minute", []time.Time{at, at.Add(time.Minute)}, []int64{1, 1}},
+		{"an hour and more", func() []time.Time {
+			ts := []time.Time{}
+			for i := 0; i < maxTrafficSamples+5; i++ {
+				ts = append(ts, at.Add(time.Duration(i)*time.Minute))
+			}
+			return ts
+		}(), func() []int64 {
+			want := make([]int64, maxTrafficSamples)
+			for i := range want {
+				want[i] = 1
+			}
+			return want
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PeerStatus{}
+			for _, ts := range tt.samples {
+				p.AddTraffic(ts, 1, 0, proxy.TrafficStats{})
+			}
+
+			if len(p.Traffic) != len(tt.want) {
+				t.Fatalf("got %d samples, want %d", len(p.Traffic), len(tt.want))
+			}
+			for i, w := range tt.want {
+				if p.Traffic[i].RxBytes != w {
+					t.Fatalf("sample %d has %d bytes, want %d", i, p.Traffic[i].RxBytes, w)
+				}
+				if !p.Traffic[i].At.Equal(p.Traffic[i].At.Truncate(time.Minute)) {
+					t.Fatalf("sample %d is not at the start of a minute, %s", i, p.Traffic[i].At)
+				}
+			}
+			if last := tt.samples[len(tt.samples)-1].Truncate(time.Minute); !p.Traffic[len(p.Traffic)-1].At.Equal(last) {
+				t.Fatalf("latest sample is at %s, want %s", p.Traffic[len(p.Traffic)-1].At, last)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ type ConnStatus string
 
 const Connect ConnStatus = "CONNECT"
 const DisConnect ConnStatus = "DISCONNECT"
+const Reconnecting ConnStatus = "RECONNECTING"
 
 func (s ConnStatus) String() string {
 	switch s {
@@ -20,6 +21,8 @@ func (s ConnStatus) String() string {
 		return "connect"
 	case DisConnect:
 		return "disconnet"
+	case Reconnecting:
+		return "reconnecting"
 	default:
 		return "unreachable"
 	}
@@ -38,6 +41,15 @@ func NewConnectedState() *ConnectState {
 	}
 }
 
+// the state of a connection that has not been established yet
+//
+func NewDisconnectedState() *ConnectState {
+	return &ConnectState{
+		State: DisConnect,
+		mu:    sync.Mutex{},
+	}
+}
+
 func (c *ConnectState) UpdateState(cs ConnStatus) ConnStatus {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -51,6 +63,9 @@ func (c *ConnectState) UpdateState(cs ConnStatus) ConnStatus {
 }
 
 func (c *ConnectState) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.State.String() == Connect.String() {
 		return true
 	}
@@ -87,6 +102,15 @@ func (c *ConnectState) DisConnected() {
 	c.State = DisConnect
 }
 
+// the connection has been lost and is being re-established
+//
+func (c *ConnectState) Reconnecting() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.State = Reconnecting
+}
+
 func (c *ConnectState) GetConnStatus() ConnStatus {
 	c.mu.Lock()
 	defer c.mu.Unlock()
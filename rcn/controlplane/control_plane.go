@@ -11,22 +11,42 @@ package controlplane
 
 import (
 	"errors"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
 	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/negotiation"
+	"github.com/Notch-Technologies/dotshake/backoff"
 	"github.com/Notch-Technologies/dotshake/client/grpc"
 	"github.com/Notch-Technologies/dotshake/conf"
 	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/iface"
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+	"github.com/Notch-Technologies/dotshake/rcn/proxy"
 	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
+	"github.com/Notch-Technologies/dotshake/rcn/relay"
 	"github.com/Notch-Technologies/dotshake/rcn/webrtc"
 	"github.com/Notch-Technologies/dotshake/wireguard"
 	"github.com/pion/ice/v2"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// a signal stream which has been up for this long is considered healthy
+// and the reconnect backoff starts over
+const signalStableDuration = 1 * time.Minute
+
+const (
+	stunTurnProbeInterval = 5 * time.Minute
+	stunTurnProbeTimeout  = 3 * time.Second
+	// fetch new credentials this long before the current ones expire
+	stunTurnRefreshBefore = 10 * time.Minute
+)
+
+// path mtus probed at the same time, the other peers are probed in the following samples
+const maxMTUProbes = 4
+
 type ControlPlane struct {
 	signalClient grpc.SignalClientImpl
 	serverClient grpc.ServerClientImpl
@@ -34,13 +54,38 @@ type ControlPlane struct {
 	sock *rcnsock.RcnSock
 
 	peerConns  map[string]*webrtc.Ice //  with ice structure per clientmachinekey
+	peerStatus *conn.PeerStatusStore
 	mk         string
+	// machine private key, proves mk to the relay server
+	mPrivKey   string
 	clientConf *conf.ClientConf
 	stconf     *webrtc.StunTurnConfig
+	udpMux     *webrtc.UDPMux
+	relay      *relay.Client
+	// looks for direct paths to the relayed peers on the udp mux
+	prober *webrtc.PathProber
+	// mtu of the interface set by applyMTU, the smallest path mtu of the peers.
+	// zero until it has been set, the kernel interface is created with its own default
+	mtu int
+	// a slot for each running path mtu probe
+	mtuProbes chan struct{}
+	// network of the overlay ipv4 addresses, set by applyRemotePeers
+	overlay *net.IPNet
+	// installed routes of the subnets advertised by the remote peers,
+	// false for the ones overlapping the local networks
+	subnetRoutes map[string]bool
+	// called when the remote peers have changed
+	onPeersChanged []func()
+
+	// state of the hangout machines stream,
+	// SyncRemoteMachine polls only while this is disconnected
+	hangoutState *conn.ConnectState
 
 	mu                  *sync.Mutex
 	ch                  chan struct{}
 	waitForRemoteConnCh chan *webrtc.Ice
+	// ices configured while holding mu, sent to waitForRemoteConnCh by startQueued after it is released
+	startQueue []*webrtc.Ice
 
 	dotlog *dotlog.DotLog
 }
@@ -50,6 +95,7 @@ func NewControlPlane(
 	serverClient grpc.ServerClientImpl,
 	sock *rcnsock.RcnSock,
 	mk string,
+	mPrivKey string,
 	clientConf *conf.ClientConf,
 	ch chan struct{},
 	dotlog *dotlog.DotLog,
@@ -61,8 +107,16 @@ func NewControlPlane(
 		sock: sock,
 
 		peerConns:  make(map[string]*webrtc.Ice),
+		peerStatus: conn.NewPeerStatusStore(),
 		mk:         mk,
+		mPrivKey:   mPrivKey,
 		clientConf: clientConf,
+		stconf:     webrtc.NewStunTurnConfig(),
+
+		subnetRoutes: make(map[string]bool),
+		mtuProbes:    make(chan struct{}, maxMTUProbes),
+
+		hangoutState: conn.NewDisconnectedState(),
 
 		mu:                  &sync.Mutex{},
 		ch:                  ch,
@@ -72,63 +126,162 @@ func NewControlPlane(
 	}
 }
 
-func (c *ControlPlane) parseStun(url, uname, pw string) (*ice.URL, error) {
-	stun, err := ice.ParseURL(url)
+func (c *ControlPlane) parseIceURL(url, uname, pw string) (*ice.URL, error) {
+	u, err := ice.ParseURL(url)
 	if err != nil {
 		return nil, err
 	}
 
-	stun.Username = uname
-	stun.Password = pw
-	return stun, err
+	u.Username = uname
+	u.Password = pw
+	return u, nil
 }
 
-func (c *ControlPlane) parseTurn(url, uname, pw string) (*ice.URL, error) {
-	turn, err := ice.ParseURL(url)
+// servers from the signal server come first, then the ones in the client config
+//
+func (c *ControlPlane) getStunTurnURLs() ([]*ice.URL, error) {
+	conf, err := c.signalClient.GetStunTurnConfig()
 	if err != nil {
 		return nil, err
 	}
-	turn.Username = uname
-	turn.Password = pw
 
-	return turn, err
+	var urls []*ice.URL
+
+	rtc := conf.GetRtcConfig()
+	if h := rtc.GetStunHost(); h.GetUrl() != "" {
+		stun, err := c.parseIceURL(h.GetUrl(), h.GetUsername(), h.GetPassword())
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, stun)
+	}
+
+	if h := rtc.GetTurnHost(); h.GetUrl() != "" {
+		turn, err := c.parseIceURL(h.GetUrl(), h.GetUsername(), h.GetPassword())
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, turn)
+	}
+
+	for _, s := range c.clientConf.IceServers {
+		for _, url := range s.URLs {
+			u, err := c.parseIceURL(url, s.Username, s.Password)
+			if err != nil {
+				c.dotlog.Logger.Warnf("skip invalid ice server [%s], %s", url, err.Error())
+				continue
+			}
+			urls = append(urls, u)
+		}
+	}
+
+	return urls, nil
 }
 
-// set stun turn url to use webrtc
+// listen the udp port shared by the ice agents of all remote peers
 // (shinta) be sure to call this function before using the ConnectSignalServer
 //
-func (c *ControlPlane) ConfigureStunTurnConf() error {
-	conf, err := c.signalClient.GetStunTurnConfig()
+func (c *ControlPlane) ListenUDPMux() error {
+	m, err := webrtc.NewUDPMux(int(c.clientConf.IcePort), c.dotlog)
 	if err != nil {
-		// TOOD: (shinta) retry
 		return err
 	}
 
-	stun, err := c.parseStun(
-		conf.RtcConfig.StunHost.Url,
-		conf.RtcConfig.TurnHost.Username,
-		conf.RtcConfig.TurnHost.Password,
-	)
+	c.udpMux = m
+	c.dotlog.Logger.Debugf("ice agents share udp port %d", m.Port())
+
+	p, err := webrtc.NewPathProber(m, c.mk, c.dotlog)
 	if err != nil {
 		return err
 	}
+	p.Start()
+	c.prober = p
 
-	turn, err := c.parseTurn(
-		conf.RtcConfig.TurnHost.Url,
-		conf.RtcConfig.TurnHost.Username,
-		conf.RtcConfig.TurnHost.Password,
-	)
+	return nil
+}
+
+// keep the stream to the relay server open when it is configured,
+// the ice of each remote peer falls back to it when it gives up
+// (shinta) be sure to call this function before using the ConnectSignalServer
+//
+func (c *ControlPlane) ConnectRelay() {
+	if c.clientConf.RelayURL == "" {
+		c.dotlog.Logger.Debugf("no relay server is configured")
+		return
+	}
+
+	c.relay = relay.NewClient(c.clientConf.RelayURL, c.mk, c.mPrivKey, c.clientConf.RelayToken, c.dotlog)
+	c.relay.OnPeer(c.startRelayByRemote)
+	c.relay.Start()
+}
+
+// the remote peer relays to us because its ice has given up, follow it
+//
+func (c *ControlPlane) startRelayByRemote(remoteMachineKey string) {
+	c.mu.Lock()
+	i, ok := c.peerConns[remoteMachineKey]
+	c.mu.Unlock()
+
+	if !ok {
+		c.dotlog.Logger.Debugf("[%s] is relaying to us, but it is not our peer", remoteMachineKey)
+		return
+	}
+
+	err := i.StartRelay()
 	if err != nil {
+		c.dotlog.Logger.Errorf("failed to relay [%s], %s", remoteMachineKey, err.Error())
+	}
+}
+
+// set stun turn url to use webrtc
+// (shinta) be sure to call this function before using the ConnectSignalServer
+//
+func (c *ControlPlane) ConfigureStunTurnConf() error {
+	urls, err := c.getStunTurnURLs()
+	if err != nil {
+		// TOOD: (shinta) retry
 		return err
 	}
 
-	stcof := webrtc.NewStunTurnConfig(stun, turn)
+	c.stconf.SetURLs(urls)
+	c.stconf.Probe(stunTurnProbeTimeout)
 
-	c.stconf = stcof
+	for _, s := range c.stconf.GetServers() {
+		c.dotlog.Logger.Debugf("ice server [%s], reachable: %t, rtt: %s", s.URL.String(), s.Reachable, s.RTT.String())
+	}
 
 	return nil
 }
 
+// re-probes the latency of the stun and turn servers and fetches new
+// credentials before they expire. agents created afterwards use them
+//
+func (c *ControlPlane) RefreshStunTurnConf() {
+	ticker := time.NewTicker(stunTurnProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ch:
+			return
+		case <-ticker.C:
+			// no servers yet when the first ConfigureStunTurnConf has failed
+			if len(c.stconf.GetServers()) == 0 || c.stconf.IsExpiredWithin(stunTurnRefreshBefore) {
+				urls, err := c.getStunTurnURLs()
+				if err != nil {
+					c.dotlog.Logger.Errorf("failed to refresh stun turn credentials, %s", err.Error())
+				} else {
+					c.stconf.SetURLs(urls)
+					c.dotlog.Logger.Debugf("refreshed stun turn credentials")
+					c.refreshExitNodeBypass()
+				}
+			}
+
+			c.stconf.Probe(stunTurnProbeTimeout)
+		}
+	}
+}
+
 func (c *ControlPlane) receiveSignalingProcess(
 	remotemk string,
 	msgType negotiation.NegotiationType,
@@ -158,53 +311,83 @@ func (c *ControlPlane) receiveSignalingProcess(
 }
 
 // through StartConnect, the results of the execution of functions such as
-// candidate required for udp hole punching are received from the dotengine side
+// candidate required for udp hole punching are received from the dotengine side.
+// when the stream is lost it is re-dialed with backoff, the wireguard tunnels
+// that have already been established keep working in the meantime
 //
 func (c *ControlPlane) ConnectSignalServer() {
 	go func() {
-		err := c.signalClient.StartConnect(c.mk, func(res *negotiation.NegotiationRequest) error {
-			c.mu.Lock()
-			defer c.mu.Unlock()
-
-			dstPeerMachineKey := res.GetDstPeerMachineKey()
-			if dstPeerMachineKey == "" {
-				c.dotlog.Logger.Errorf("empty dst peer machine key")
-				return errors.New("empty dst peer machine key")
+		b := backoff.NewBackoff(1*time.Second, 1*time.Minute)
+
+		for {
+			// zero until the first message of the server, a stream without one does not count as being connected
+			var connectedAt time.Time
+			err := c.signalClient.StartConnect(
+				c.mk,
+				func() { connectedAt = time.Now() },
+				c.receiveSignalRequest,
+			)
+
+			// the stream was up long enough, treat the next failure as the first one
+			if !connectedAt.IsZero() && time.Since(connectedAt) > signalStableDuration {
+				b.Reset()
 			}
 
-			peer := c.peerConns[res.GetDstPeerMachineKey()]
+			c.signalClient.Reconnecting()
 
-			// for initial offer
-			if peer == nil {
-				var err error
-				peer, err = c.initialOfferForRemotePeer(dstPeerMachineKey)
-				if err != nil {
-					c.dotlog.Logger.Errorf("empty remote peer connection, dst remote peer machine key is [%s]", dstPeerMachineKey)
-					return err
-				}
-			}
+			d := b.Duration()
+			c.dotlog.Logger.Warnf("signal stream has been closed, reconnect after %s. %v", d.String(), err)
 
-			err := c.receiveSignalingProcess(
-				res.GetDstPeerMachineKey(),
-				res.GetType(),
-				peer,
-				res.GetUFlag(),
-				res.GetPwd(),
-				res.GetCandidate(),
-			)
-			if err != nil {
-				return err
+			select {
+			case <-c.ch:
+				return
+			case <-time.After(d):
 			}
-			return nil
-		})
-		if err != nil {
-			close(c.ch)
-			return
 		}
 	}()
 	c.signalClient.WaitStartConnect()
 }
 
+// do not return an error here except when the stream itself is broken, it will close the stream
+//
+func (c *ControlPlane) receiveSignalRequest(res *negotiation.NegotiationRequest) error {
+	defer c.startQueued()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dstPeerMachineKey := res.GetDstPeerMachineKey()
+	if dstPeerMachineKey == "" {
+		c.dotlog.Logger.Errorf("empty dst peer machine key")
+		return nil
+	}
+
+	peer := c.peerConns[dstPeerMachineKey]
+
+	// for initial offer
+	if peer == nil {
+		var err error
+		peer, err = c.initialOfferForRemotePeer(dstPeerMachineKey)
+		if err != nil {
+			c.dotlog.Logger.Errorf("empty remote peer connection, dst remote peer machine key is [%s]", dstPeerMachineKey)
+			return nil
+		}
+	}
+
+	err := c.receiveSignalingProcess(
+		dstPeerMachineKey,
+		res.GetType(),
+		peer,
+		res.GetUFlag(),
+		res.GetPwd(),
+		res.GetCandidate(),
+	)
+	if err != nil {
+		c.dotlog.Logger.Errorf("failed to receive signaling process from [%s], %s", dstPeerMachineKey, err.Error())
+	}
+
+	return nil
+}
+
 func (c *ControlPlane) initialOfferForRemotePeer(dstPeerMk string) (*webrtc.Ice, error) {
 	c.dotlog.Logger.Debugf("initial connection for [%s]", dstPeerMk)
 
@@ -224,7 +407,7 @@ func (c *ControlPlane) initialOfferForRemotePeer(dstPeerMk string) (*webrtc.Ice,
 		}
 
 		c.peerConns[dstPeerMk] = i
-		c.waitForRemoteConnCh <- i
+		c.queueStart(i)
 		return c.peerConns[dstPeerMk], nil
 	}
 
@@ -232,38 +415,6 @@ func (c *ControlPlane) initialOfferForRemotePeer(dstPeerMk string) (*webrtc.Ice,
 	return nil, errors.New("failed to initial offer")
 }
 
-// keep the latest state of Peers received from the server
-//
-func (c *ControlPlane) syncRemotePeerConfig(remotePeers []*machine.RemotePeer) error {
-	remotePeerMap := make(map[string]struct{})
-	for _, p := range remotePeers {
-		remotePeerMap[p.GetRemoteClientMachineKey()] = struct{}{}
-	}
-
-	unnecessary := []string{}
-	for p := range c.peerConns {
-		if _, ok := remotePeerMap[p]; !ok {
-			unnecessary = append(unnecessary, p)
-		}
-	}
-
-	if len(unnecessary) == 0 {
-		return nil
-	}
-
-	for _, p := range unnecessary {
-		conn, exists := c.peerConns[p]
-		if exists {
-			delete(c.peerConns, p)
-			conn.Cleanup()
-		}
-		c.dotlog.Logger.Debugf("there are no peers, even though there should be")
-	}
-
-	c.dotlog.Logger.Debugf("completed peersConn delete in signal control plane => %v", unnecessary)
-	return nil
-}
-
 func (c *ControlPlane) configureIce(peer *machine.RemotePeer, myip, mycidr string) (*webrtc.Ice, error) {
 	k, err := wgtypes.ParseKey(c.clientConf.WgPrivateKey)
 	if err != nil {
@@ -279,12 +430,18 @@ func (c *ControlPlane) configureIce(peer *machine.RemotePeer, myip, mycidr strin
 		pk = k.String()
 	}
 
-	remoteip := strings.Join(peer.GetAllowedIPs(), ",")
+	remoteip := c.remoteAllowedIPs(peer)
 	i := webrtc.NewIce(
 		c.signalClient,
 
 		c.sock,
 
+		c.peerStatus,
+
+		c.udpMux,
+
+		c.relay,
+
 		peer.RemoteWgPubKey,
 		remoteip,
 		peer.GetRemoteClientMachineKey(),
@@ -304,37 +461,45 @@ func (c *ControlPlane) configureIce(peer *machine.RemotePeer, myip, mycidr strin
 		c.ch,
 	)
 
+	// nil when the udp mux could not be listened
+	if c.prober != nil {
+		c.prober.Register(i)
+	}
+
 	return i, nil
 }
 
-func (c *ControlPlane) NotifyRemotePeersConn(connPeers []*machine.RemotePeer, ip, cidr string) error {
-	for _, p := range connPeers {
-		c.dotlog.Logger.Debugf("wanna connect to remote machine => [%s]", p.GetRemoteClientMachineKey())
-
-		rmk := p.GetRemoteClientMachineKey()
-		_, ok := c.peerConns[rmk]
+// whether the ice is still the peer connection of its remote machine,
+// it may have been removed or replaced while waiting to be started
+//
+func (c *ControlPlane) isExistPeer(i *webrtc.Ice) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		if !ok {
-			i, err := c.configureIce(p, ip, cidr)
-			if err != nil {
-				return err
-			}
+	return c.peerConns[i.GetRemoteMachineKey()] == i
+}
 
-			c.peerConns[rmk] = i
-			c.waitForRemoteConnCh <- i
-			continue
-		}
+// be sure to lock mu before calling this function, and to call startQueued after unlocking it
+//
+func (c *ControlPlane) queueStart(i *webrtc.Ice) {
+	c.startQueue = append(c.startQueue, i)
+}
 
-		c.dotlog.Logger.Debugf("[%s] has [%s] peer connection,", c.mk, rmk)
+// hands the queued ices to WaitForRemoteConn, which takes mu
+//
+func (c *ControlPlane) startQueued() {
+	c.mu.Lock()
+	queue := c.startQueue
+	c.startQueue = nil
+	c.mu.Unlock()
 
-		return nil
+	for _, i := range queue {
+		select {
+		case c.waitForRemoteConnCh <- i:
+		case <-c.ch:
+			return
+		}
 	}
-	return nil
-}
-
-func (c *ControlPlane) isExistPeer(remoteMachineKey string) bool {
-	_, exist := c.peerConns[remoteMachineKey]
-	return exist
 }
 
 // function to wait until the channel is sent from SetupRemotePeerConn to waitForRemoteConnCh
@@ -343,7 +508,7 @@ func (c *ControlPlane) WaitForRemoteConn() {
 	for {
 		select {
 		case ice := <-c.waitForRemoteConnCh:
-			if !c.signalClient.IsReady() || !c.isExistPeer(ice.GetRemoteMachineKey()) {
+			if !c.signalClient.IsReady() || !c.isExistPeer(ice) {
 				c.dotlog.Logger.Errorf("signal client is not available, execute loop. applicable remote peer => [%s]", ice.GetRemoteMachineKey())
 				continue
 			}
@@ -365,74 +530,438 @@ func (c *ControlPlane) WaitForRemoteConn() {
 	}
 }
 
-// ConnectToHangoutMachines to keep the Peer's information up to date asynchronously
-// notify here when another machine or itself joinsHangOutMachines
-// when coming adding new peer or initial sync
+// WatchRemoteMachines keeps the hangout machines stream open so that the Peer's information is kept up to date.
+// the server notifies here when another machine or itself joins, leaves or changes.
+// when the stream is closed it is re-dialed with backoff, and SyncRemoteMachine polls until it comes back
+//
+func (c *ControlPlane) WatchRemoteMachines() {
+	b := backoff.NewBackoff(1*time.Second, 1*time.Minute)
+
+	for {
+		err := c.serverClient.ConnectToHangoutMachines(
+			c.mk,
+			func() {
+				c.hangoutState.Connected()
+				b.Reset()
+				c.dotlog.Logger.Debugf("connected to hangout machines stream")
+
+				// catch up with the changes made while the stream was down
+				err := c.syncRemoteMachines()
+				if err != nil {
+					c.dotlog.Logger.Errorf("failed to sync remote machines after connecting hangout machines, %s", err.Error())
+				}
+			},
+			c.receiveHangoutMachines,
+		)
+		c.hangoutState.DisConnected()
+
+		d := b.Duration()
+		c.dotlog.Logger.Warnf("hangout machines stream has been closed, reconnect after %s. %v", d.String(), err)
+
+		select {
+		case <-c.ch:
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+func (c *ControlPlane) receiveHangoutMachines(res *machine.HangOutMachinesResponse) error {
+	defer c.startQueued()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// TODO: (shinta) it seems a little confusing. will refactoring. https://github.com/Notch-Technologies/dotshake/issues/21
+	// the agent of a disconnected machine is gone, so remove ours as well
+	// to maintain agent integrity when the machine reconnects
+	//
+	if res.GetHangOutType() == machine.HangOutType_DISCONNECT {
+		c.dotlog.Logger.Debugf("[%s] has been disconnected", res.GetTargetMachineKey())
+		c.removePeerConn(res.GetTargetMachineKey())
+		c.applySubnetRoutes()
+		c.peersChanged()
+		return nil
+	}
+
+	// do not return an error here, it will close the stream
+	err := c.applyRemotePeers(res.GetRemotePeers(), res.GetIp(), res.GetCidr())
+	if err != nil {
+		c.dotlog.Logger.Errorf("failed to apply remote peers from hangout machines, %s", err.Error())
+	}
+
+	return nil
+}
+
+func (c *ControlPlane) removePeerConn(remoteMachineKey string) {
+	peer, ok := c.peerConns[remoteMachineKey]
+	if !ok {
+		return
+	}
+
+	delete(c.peerConns, remoteMachineKey)
+	if c.prober != nil {
+		c.prober.Unregister(peer)
+	}
+
+	err := peer.Cleanup()
+	if err != nil {
+		c.dotlog.Logger.Errorf("failed to cleanup [%s], %s", remoteMachineKey, err.Error())
+	}
+
+	c.peerStatus.Remove(remoteMachineKey)
+}
+
+// adds f to be called when the remote peers have changed, f must not block
+//
+func (c *ControlPlane) OnPeersChanged(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onPeersChanged = append(c.onPeersChanged, f)
+}
+
+// be sure to lock mu before calling this function
+//
+func (c *ControlPlane) peersChanged() {
+	for _, f := range c.onPeersChanged {
+		f()
+	}
+}
+
+// whether ip is routed to a remote peer, in its overlay addresses or the subnets it advertises
+//
+func (c *ControlPlane) IsRoutedToPeer(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, i := range c.peerConns {
+		if i == nil {
+			continue
+		}
+
+		for _, a := range strings.Split(i.GetRemoteIp(), ",") {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(a))
+			if err == nil && ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// whether ip is in the overlay, ipv4 or ipv6
+//
+func (c *ControlPlane) isOverlayIP(ip net.IP) bool {
+	if c.overlay != nil && c.overlay.Contains(ip) {
+		return true
+	}
+
+	if c.clientConf.IPv6Prefix != "" {
+		_, ipv6Overlay, err := net.ParseCIDR(c.clientConf.IPv6Prefix)
+		if err == nil && ipv6Overlay.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the overlay addresses of the remote peers by their machine keys, the ipv4 one first
+//
+func (c *ControlPlane) RemoteOverlayIPs() map[string][]net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := make(map[string][]net.IP)
+	for mk, i := range c.peerConns {
+		if i == nil {
+			continue
+		}
+
+		ips := []net.IP{}
+		for _, a := range strings.Split(i.GetRemoteIp(), ",") {
+			ip, ipNet, err := net.ParseCIDR(strings.TrimSpace(a))
+			if err != nil || !c.isOverlayIP(ip) {
+				continue
+			}
+			// a single address, not a subnet of the overlay
+			if ones, bits := ipNet.Mask.Size(); ones != bits {
+				continue
+			}
+
+			if ip.To4() != nil {
+				ips = append([]net.IP{ip}, ips...)
+			} else {
+				ips = append(ips, ip)
+			}
+		}
+		peers[mk] = ips
+	}
+
+	return peers
+}
+
+// apply the remote peers received from the server to peerConns
+// be sure to lock mu before calling this function, and to call startQueued after unlocking it
 //
-// func (c *ControlPlane) StartHangoutMachines() {
-// 	go func() {
-// 		c.serverClient.ConnectToHangoutMachines(c.mk, func(res *machine.HangOutMachinesResponse) error {
-// 			c.mu.Lock()
-// 			defer c.mu.Unlock()
-
-// 			if res.GetRemotePeers() != nil {
-// 				c.dotlog.Logger.Debugf("got remote peers => %v", res.GetRemotePeers())
-// 				err := c.syncRemotePeerConfig(res.GetRemotePeers())
-// 				if err != nil {
-// 					return err
-// 				}
-// 			}
-
-// 			// TODO: (shinta) it seems a little confusing. will refactoring. https://github.com/Notch-Technologies/dotshake/issues/21
-// 			// initialize to maintain agent integrity when a disconnected Machine reconnects
-// 			//
-// 			if res.GetHangOutType() == machine.HangOutType_DISCONNECT {
-// 				if peer, ok := c.peerConns[res.TargetMachineKey]; ok {
-// 					err := peer.Setup()
-// 					if err != nil {
-// 						c.dotlog.Logger.Errorf("failed to resetup %s, %s", res.TargetMachineKey, err.Error())
-// 					}
-// 				}
-// 				return nil
-// 			}
-
-// 			err := c.NotifyRemotePeersConn(res.GetRemotePeers(), res.Ip, res.Cidr)
-// 			if err != nil {
-// 				return err
-// 			}
-
-// 			return nil
-// 		})
-// 	}()
-// }
+func (c *ControlPlane) applyRemotePeers(remotePeers []*machine.RemotePeer, ip, cidr string) error {
+	if remotePeers == nil {
+		return nil
+	}
+
+	c.dotlog.Logger.Debugf("got remote peers => %v", remotePeers)
+
+	if _, overlay, err := net.ParseCIDR(ip + "/" + cidr); err == nil {
+		c.overlay = overlay
+	}
+
+	result, err := c.reconcileRemotePeers(remotePeers, ip, cidr)
+	if !result.IsEmpty() {
+		c.dotlog.Logger.Infof("reconciled remote peers, %s", result.String())
+	}
+
+	c.applySubnetRoutes()
+	if !result.IsEmpty() {
+		c.peersChanged()
+	}
+
+	return err
+}
+
+func (c *ControlPlane) syncRemoteMachines() error {
+	res, err := c.serverClient.SyncRemoteMachinesConfig(c.mk)
+	if err != nil {
+		return err
+	}
+
+	defer c.startQueued()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.applyRemotePeers(res.GetRemotePeers(), res.GetIp(), res.GetCidr())
+}
 
 // maintain flexible connections by updating remote machines
-// information on a regular basis, rather than only when other Machines join
+// information on a regular basis while the hangout machines stream is down
 //
-func (c *ControlPlane) SyncRemoteMachine() error {
+func (c *ControlPlane) SyncRemoteMachine() {
 	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
 	for {
 		select {
+		case <-c.ch:
+			return
 		case <-ticker.C:
-			res, err := c.serverClient.SyncRemoteMachinesConfig(c.mk)
+			if c.hangoutState.IsConnected() {
+				continue
+			}
+
+			err := c.syncRemoteMachines()
 			if err != nil {
-				return err
+				c.dotlog.Logger.Errorf("failed to sync remote machines, %s", err.Error())
 			}
+		}
+	}
+}
 
-			// TODO: (shinta) compare with existing c.peerConns and update only when there is a difference?
-			// maybe will be good perfomance
-			if res.GetRemotePeers() != nil {
-				err := c.syncRemotePeerConfig(res.GetRemotePeers())
-				if err != nil {
-					c.dotlog.Logger.Errorf("failed to sync remote peer config")
-					return err
-				}
+// samples the wireguard handshake and traffic and the path quality
+// of each remote machine so that the status shows whether the traffic actually flows
+//
+func (c *ControlPlane) MonitorPeerStatus() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	// counters of the previous sample to compute the loss and the traffic in between
+	prev := make(map[string]peerSample)
+
+	for {
+		select {
+		case <-c.ch:
+			return
+		case <-ticker.C:
+			err := c.samplePeers(prev)
+			if err != nil {
+				c.dotlog.Logger.Debugf("failed to sample peers, %s", err.Error())
 			}
 		}
 	}
 }
 
+// counters of a remote machine taken by samplePeers
+type peerSample struct {
+	path    proxy.PathStats
+	traffic proxy.TrafficStats
+	rxBytes int64
+	txBytes int64
+}
+
+// returns cur - prev, cur when the counter has started over
+//
+func counterDelta(cur, prev int64) int64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func (c *ControlPlane) samplePeers(prev map[string]peerSample) error {
+	i := iface.NewIface(c.clientConf.TunName, c.clientConf.WgPrivateKey, "", "", c.dotlog)
+	peers, err := i.GetRemotePeers()
+	if err != nil {
+		return err
+	}
+
+	wgPeers := make(map[string]wgtypes.Peer)
+	for _, p := range peers {
+		wgPeers[p.PublicKey.String()] = p
+	}
+
+	c.mu.Lock()
+	ices := make(map[string]*webrtc.Ice, len(c.peerConns))
+	for mk, i := range c.peerConns {
+		ices[mk] = i
+	}
+	c.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range c.peerStatus.List() {
+		var stats proxy.PathStats
+		var traffic proxy.TrafficStats
+		if i, ok := ices[s.RemoteMachineKey]; ok {
+			stats, _ = i.PathStats()
+			traffic, _ = i.TrafficStats()
+		}
+
+		var loss float64
+		last := prev[s.RemoteMachineKey]
+		// the counters start over when the ice of the peer has been replaced
+		if stats.Sent > last.path.Sent && stats.Lost >= last.path.Lost {
+			loss = float64(stats.Lost-last.path.Lost) / float64(stats.Sent-last.path.Sent)
+			if loss > 1 {
+				loss = 1
+			}
+		}
+
+		wp, ok := wgPeers[s.RemoteWgPubKey]
+		prev[s.RemoteMachineKey] = peerSample{
+			path:    stats,
+			traffic: traffic,
+			rxBytes: wp.ReceiveBytes,
+			txBytes: wp.TransmitBytes,
+		}
+
+		c.peerStatus.Update(s.RemoteMachineKey, func(p *conn.PeerStatus) {
+			if ok {
+				p.LastHandshake = wp.LastHandshakeTime
+			}
+			p.AddPathSample(conn.PathSample{
+				At:      now,
+				Path:    p.Path(),
+				RTT:     stats.RTT,
+				Loss:    loss,
+				RxBytes: wp.ReceiveBytes,
+				TxBytes: wp.TransmitBytes,
+			})
+
+			p.Proxy = traffic
+			p.AddTraffic(
+				now,
+				counterDelta(wp.ReceiveBytes, last.rxBytes),
+				counterDelta(wp.TransmitBytes, last.txBytes),
+				traffic.Sub(last.traffic),
+			)
+		})
+	}
+
+	for mk := range prev {
+		if _, ok := ices[mk]; !ok {
+			delete(prev, mk)
+		}
+	}
+
+	c.probePathMTUs(ices)
+
+	return c.applyMTU()
+}
+
+// probes the mtu of the paths which have changed since they were probed,
+// so that the interface mtu follows the path changes within a sample.
+// a peer is probed by one goroutine at a time, and at most maxMTUProbes peers at once
+//
+func (c *ControlPlane) probePathMTUs(ices map[string]*webrtc.Ice) {
+	for _, s := range c.peerStatus.List() {
+		if s.State != conn.PeerConnected && !s.Relayed {
+			continue
+		}
+
+		pathID := s.PathID()
+		if s.MTUPathID == pathID {
+			continue
+		}
+
+		i, ok := ices[s.RemoteMachineKey]
+		if !ok || i.IsProbingMTU() {
+			continue
+		}
+
+		select {
+		case c.mtuProbes <- struct{}{}:
+		default:
+			return
+		}
+
+		go func(mk string) {
+			defer func() { <-c.mtuProbes }()
+
+			_, err := i.ProbePathMTU(pathID)
+			if err != nil {
+				c.dotlog.Logger.Debugf("failed to probe path mtu of [%s], %s", mk, err.Error())
+			}
+		}(s.RemoteMachineKey)
+	}
+}
+
+// sets the interface mtu to the smallest path mtu of the peers. the path of a peer
+// which has not been probed yet may be as small as wireguard.DefaultMTU.
+// the interface is left alone while the mtu stays the same
+//
+func (c *ControlPlane) applyMTU() error {
+	mtu := 0
+	for _, s := range c.peerStatus.List() {
+		pathMTU := s.PathMTU
+		if pathMTU == 0 {
+			pathMTU = wireguard.DefaultMTU
+		}
+		if mtu == 0 || pathMTU < mtu {
+			mtu = pathMTU
+		}
+	}
+	if mtu == 0 {
+		mtu = wireguard.DefaultMTU
+	}
+
+	if mtu == c.mtu {
+		return nil
+	}
+
+	err := iface.SetMTU(c.clientConf.TunName, mtu)
+	if err != nil {
+		return err
+	}
+
+	c.dotlog.Logger.Infof("set mtu of %s to %d", c.clientConf.TunName, mtu)
+	c.mtu = mtu
+
+	return nil
+}
+
 func (c *ControlPlane) Close() error {
+	c.closeExitNode()
+	c.closeSubnetRoutes()
+
+	// keep closing the other peers when one of them fails
 	for mk, ice := range c.peerConns {
 		if ice == nil {
 			continue
@@ -440,12 +969,34 @@ func (c *ControlPlane) Close() error {
 
 		err := ice.Cleanup()
 		if err != nil {
-			return err
+			c.dotlog.Logger.Errorf("failed to close the %s, %s", mk, err.Error())
+			continue
 		}
 
 		c.dotlog.Logger.Debugf("close the %s", mk)
 	}
 
+	if c.relay != nil {
+		err := c.relay.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.prober != nil {
+		err := c.prober.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.udpMux != nil {
+		err := c.udpMux.Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	c.dotlog.Logger.Debugf("finished in closing the control plane")
 
 	return nil
@@ -0,0 +1,306 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package controlplane
+
+// exit node. a machine advertising itself as an exit node forwards the traffic of
+// the remote peers to the internet, and the server shares it with the default routes in its allowed ips.
+// a machine using an exit node keeps the default routes on the allowed ips of that one only,
+// refuses one which does not advertise itself, and routes all its traffic to the tunnel
+// except for the traffic of dotshake itself
+//
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
+	"github.com/Notch-Technologies/dotshake/client/grpc"
+	"github.com/Notch-Technologies/dotshake/iface"
+)
+
+const (
+	defaultRoute4 = "0.0.0.0/0"
+	defaultRoute6 = "::/0"
+)
+
+func isDefaultRoute(allowedIP string) bool {
+	return allowedIP == defaultRoute4 || allowedIP == defaultRoute6
+}
+
+// whether the remote peer is exitNode, by its overlay ip or machine key
+//
+func matchesExitNode(peer *machine.RemotePeer, exitNode string) bool {
+	if exitNode == "" {
+		return false
+	}
+
+	if peer.GetRemoteClientMachineKey() == exitNode {
+		return true
+	}
+	for _, a := range peer.GetAllowedIPs() {
+		if strings.Split(a, "/")[0] == exitNode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the server shares a machine advertising advertise-exit-node with a default route in its allowed ips
+//
+func advertisesExitNode(peer *machine.RemotePeer) bool {
+	for _, a := range peer.GetAllowedIPs() {
+		if isDefaultRoute(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the remote peer is the exit node of the client config and advertises itself as one
+//
+func (c *ControlPlane) isExitNode(peer *machine.RemotePeer) bool {
+	return matchesExitNode(peer, c.clientConf.ExitNode) && advertisesExitNode(peer)
+}
+
+// fails unless exitNode is a remote peer advertising itself as an exit node
+//
+func checkExitNode(remotePeers []*machine.RemotePeer, exitNode string) error {
+	for _, p := range remotePeers {
+		if !matchesExitNode(p, exitNode) {
+			continue
+		}
+
+		if !advertisesExitNode(p) {
+			return fmt.Errorf("%s does not advertise itself as an exit node", exitNode)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("exit node %s is not a remote peer", exitNode)
+}
+
+// the allowed ips of the remote peer with the default routes only when it is the exit node
+//
+func (c *ControlPlane) exitNodeAllowedIPs(peer *machine.RemotePeer) []string {
+	allowedIPs := []string{}
+	for _, a := range peer.GetAllowedIPs() {
+		if !isDefaultRoute(a) {
+			allowedIPs = append(allowedIPs, a)
+		}
+	}
+
+	if c.isExitNode(peer) {
+		allowedIPs = append(allowedIPs, defaultRoute4)
+		if c.clientConf.IPv6Prefix != "" {
+			allowedIPs = append(allowedIPs, defaultRoute6)
+		}
+	}
+
+	return allowedIPs
+}
+
+// applies the exit node settings of the client config.
+// (shinta) be sure to call this function after ConfigureStunTurnConf,
+// the stun and turn servers are bypassed
+//
+func (c *ControlPlane) ConfigureExitNode() error {
+	c.mu.Lock()
+	exitNode, advertise := c.clientConf.ExitNode, c.clientConf.AdvertiseExitNode
+	c.mu.Unlock()
+
+	if advertise {
+		err := c.SetAdvertiseExitNode(true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if exitNode != "" {
+		return c.SetExitNode(exitNode)
+	}
+
+	return nil
+}
+
+// routes all the traffic to the remote peer, exitNode is its overlay ip or machine key.
+// stops using an exit node when it is empty
+//
+func (c *ControlPlane) SetExitNode(exitNode string) error {
+	if exitNode != "" {
+		err := c.ValidateExitNode(exitNode)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.clientConf.ExitNode = exitNode
+	c.mu.Unlock()
+
+	// moves the default routes to the allowed ips of the new exit node
+	err := c.syncRemoteMachines()
+	if err != nil {
+		return err
+	}
+
+	if exitNode == "" {
+		return iface.ClearExitRoutes(c.clientConf.TunName)
+	}
+
+	c.dotlog.Logger.Infof("routing all traffic to exit node %s", exitNode)
+
+	return iface.SetExitRoutes(c.clientConf.TunName, c.exitNodeBypass(), c.clientConf.IPv6Prefix != "")
+}
+
+// fails unless exitNode is a remote peer which advertises itself as an exit node
+//
+func (c *ControlPlane) ValidateExitNode(exitNode string) error {
+	res, err := c.serverClient.SyncRemoteMachinesConfig(c.mk)
+	if err != nil {
+		return err
+	}
+
+	return checkExitNode(res.GetRemotePeers(), exitNode)
+}
+
+// the stun and turn servers may have changed with the refreshed config
+//
+func (c *ControlPlane) refreshExitNodeBypass() {
+	c.mu.Lock()
+	exitNode := c.clientConf.ExitNode
+	c.mu.Unlock()
+
+	if exitNode == "" {
+		return
+	}
+
+	err := iface.SetExitBypass(c.clientConf.TunName, c.exitNodeBypass())
+	if err != nil {
+		c.dotlog.Logger.Errorf("failed to update the servers bypassing the exit node, %s", err.Error())
+	}
+}
+
+// forwards the traffic of the remote peers to the internet and tells the server about it
+//
+func (c *ControlPlane) SetAdvertiseExitNode(advertise bool) error {
+	c.mu.Lock()
+	c.clientConf.AdvertiseExitNode = advertise
+	c.mu.Unlock()
+
+	overlay, err := c.sendAdvertise()
+	if err != nil {
+		return err
+	}
+
+	if !advertise {
+		return iface.DisableExitNode(c.clientConf.TunName)
+	}
+
+	c.dotlog.Logger.Infof("forwarding the traffic of the remote peers from %s as an exit node", overlay.String())
+
+	return iface.EnableExitNode(c.clientConf.TunName, overlay.String(), c.clientConf.IPv6Prefix)
+}
+
+// tells the server what this machine offers in the client config,
+// and applies the remote peers of the response. returns the overlay network
+//
+func (c *ControlPlane) sendAdvertise() (*net.IPNet, error) {
+	c.mu.Lock()
+	c.serverClient.SetAdvertise(grpc.Advertise{
+		ExitNode: c.clientConf.AdvertiseExitNode,
+		Routes:   c.clientConf.AdvertiseRoutes,
+	})
+	c.mu.Unlock()
+
+	res, err := c.serverClient.SyncRemoteMachinesConfig(c.mk)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	err = c.applyRemotePeers(res.GetRemotePeers(), res.GetIp(), res.GetCidr())
+	c.mu.Unlock()
+	c.startQueued()
+	if err != nil {
+		return nil, err
+	}
+
+	_, overlay, err := net.ParseCIDR(res.GetIp() + "/" + res.GetCidr())
+	if err != nil {
+		return nil, err
+	}
+
+	return overlay, nil
+}
+
+// ips of the servers which dotshake talks to outside of the tunnel,
+// the server, the signal server, the relay server and the stun and turn servers
+//
+func (c *ControlPlane) exitNodeBypass() []net.IP {
+	hosts := []string{
+		hostname(c.clientConf.GetServerHost()),
+		hostname(c.clientConf.GetSignalHost()),
+	}
+
+	if c.clientConf.RelayURL != "" {
+		u, err := url.Parse(c.clientConf.RelayURL)
+		if err == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+
+	for _, s := range c.stconf.GetServers() {
+		hosts = append(hosts, s.URL.Host)
+	}
+
+	seen := make(map[string]bool)
+	ips := []net.IP{}
+	for _, h := range hosts {
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		addrs, err := net.LookupIP(h)
+		if err != nil {
+			c.dotlog.Logger.Warnf("failed to resolve %s, its traffic goes through the exit node. %s", h, err.Error())
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+
+	return ips
+}
+
+// host of host:port
+//
+func hostname(hostport string) string {
+	h, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return h
+}
+
+// the ip rules and the forwarding outlive the interface
+//
+func (c *ControlPlane) closeExitNode() {
+	if c.clientConf.ExitNode != "" {
+		err := iface.ClearExitRoutes(c.clientConf.TunName)
+		if err != nil {
+			c.dotlog.Logger.Errorf("failed to clear the routes to the exit node, %s", err.Error())
+		}
+	}
+
+	if c.clientConf.AdvertiseExitNode {
+		err := iface.DisableExitNode(c.clientConf.TunName)
+		if err != nil {
+			c.dotlog.Logger.Errorf("failed to stop forwarding as an exit node, %s", err.Error())
+		}
+	}
+}
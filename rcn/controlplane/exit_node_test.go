@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package controlplane
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
+	"github.com/Notch-Technologies/dotshake/conf"
+)
+
+func TestCheckExitNode(t *testing.T) {
+	peers := []*machine.RemotePeer{
+		{RemoteClientMachineKey: "mk-exit", AllowedIPs: []string{"100.64.0.2/32", "0.0.0.0/0", "::/0"}},
+		{RemoteClientMachineKey: "mk-peer", AllowedIPs: []string{"100.64.0.3/32"}},
+	}
+
+	tests := []struct {
+		name     string
+		exitNode string
+		// a part of the error, empty when it is accepted
+		wantErr string
+	}{
+		{"by machine key", "mk-exit", ""},
+		{"by overlay ip", "100.64.0.2", ""},
+		{"not advertising", "mk-peer", "does not advertise"},
+		{"not advertising by overlay ip", "100.64.0.3", "does not advertise"},
+		{"unknown", "100.64.0.9", "is not a remote peer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkExitNode(peers, tt.exitNode)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExitNodeAllowedIPs(t *testing.T) {
+	advertising := &machine.RemotePeer{RemoteClientMachineKey: "mk-exit", AllowedIPs: []string{"100.64.0.2/32", "0.0.0.0/0", "::/0"}}
+	other := &machine.RemotePeer{RemoteClientMachineKey: "mk-peer", AllowedIPs: []string{"100.64.0.3/32", "0.0.0.0/0"}}
+	silent := &machine.RemotePeer{RemoteClientMachineKey: "mk-silent", AllowedIPs: []string{"100.64.0.4/32"}}
+
+	tests := []struct {
+		name       string
+		exitNode   string
+		ipv6Prefix string
+		peer       *machine.RemotePeer
+		want       string
+	}{
+		{"no exit node", "", "", advertising, "100.64.0.2/32"},
+		{"exit node", "mk-exit", "", advertising, "100.64.0.2/32,0.0.0.0/0"},
+		{"exit node with ipv6", "mk-exit", "fd00:d07::/64", advertising, "100.64.0.2/32,0.0.0.0/0,::/0"},
+		// the default routes go to the chosen exit node only
+		{"another advertising peer", "mk-exit", "", other, "100.64.0.3/32"},
+		{"chosen but not advertising", "mk-silent", "", silent, "100.64.0.4/32"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ControlPlane{clientConf: &conf.ClientConf{ExitNode: tt.exitNode, IPv6Prefix: tt.ipv6Prefix}}
+
+			got := strings.Join(c.exitNodeAllowedIPs(tt.peer), ",")
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
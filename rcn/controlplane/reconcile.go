@@ -0,0 +1,197 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package controlplane
+
+// reconcile compares the remote peers received from the server with peerConns
+// and the peers on the wireguard device, then adds, updates and removes
+// peers and their ice so that they match the server
+//
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
+	"github.com/Notch-Technologies/dotshake/iface"
+)
+
+type ReconcileResult struct {
+	Added   []string // remote machine keys
+	Updated []string // remote machine keys
+	Removed []string // remote machine keys
+	Stale   []string // wireguard pub keys left on the device without a peer connection
+}
+
+func (r *ReconcileResult) IsEmpty() bool {
+	return len(r.Added) == 0 && len(r.Updated) == 0 && len(r.Removed) == 0 && len(r.Stale) == 0
+}
+
+func (r *ReconcileResult) String() string {
+	return fmt.Sprintf(
+		"added: %v, updated: %v, removed: %v, stale: %v",
+		r.Added, r.Updated, r.Removed, r.Stale,
+	)
+}
+
+type peerChange int
+
+const (
+	peerUnchanged peerChange = iota
+	// no peer connection yet
+	peerAdded
+	// the allowed ips only, wireguard is updated in place
+	peerAllowedIPsChanged
+	// the wireguard pub key, the peer connection is recreated
+	peerReplaced
+)
+
+// wireguard pub key and allowed ips of a remote peer
+//
+type remotePeerConfig struct {
+	wgPubKey   string
+	allowedIPs string
+}
+
+// how the remote peer has changed, current is nil when there is no peer connection to it
+//
+func diffRemotePeer(current *remotePeerConfig, desired remotePeerConfig) peerChange {
+	switch {
+	case current == nil:
+		return peerAdded
+	case current.wgPubKey != desired.wgPubKey:
+		return peerReplaced
+	case current.allowedIPs != desired.allowedIPs:
+		return peerAllowedIPsChanged
+	default:
+		return peerUnchanged
+	}
+}
+
+// allowed ips of the remote peer joined with a comma,
+// including its ipv6 overlay address when the ipv6 prefix is configured
+// and the default routes when it is the exit node
+//
+func (c *ControlPlane) remoteAllowedIPs(peer *machine.RemotePeer) string {
+	allowedIPs := c.exitNodeAllowedIPs(peer)
+
+	if c.clientConf.IPv6Prefix != "" {
+		ip, err := iface.OverlayIPv6AllowedIP(c.clientConf.IPv6Prefix, peer.GetRemoteWgPubKey())
+		if err != nil {
+			c.dotlog.Logger.Warnf("failed to build ipv6 overlay address of [%s], %s", peer.GetRemoteClientMachineKey(), err.Error())
+		} else {
+			allowedIPs = append(allowedIPs, ip)
+		}
+	}
+
+	return strings.Join(allowedIPs, ",")
+}
+
+// be sure to lock mu before calling this function, and to call startQueued after unlocking it
+//
+func (c *ControlPlane) reconcileRemotePeers(
+	remotePeers []*machine.RemotePeer,
+	ip, cidr string,
+) (*ReconcileResult, error) {
+	result := &ReconcileResult{}
+
+	desired := make(map[string]*machine.RemotePeer)
+	for _, p := range remotePeers {
+		desired[p.GetRemoteClientMachineKey()] = p
+	}
+
+	for mk := range c.peerConns {
+		if _, ok := desired[mk]; !ok {
+			c.removePeerConn(mk)
+			result.Removed = append(result.Removed, mk)
+		}
+	}
+
+	var lastErr error
+	for mk, p := range desired {
+		want := remotePeerConfig{wgPubKey: p.GetRemoteWgPubKey(), allowedIPs: c.remoteAllowedIPs(p)}
+
+		i, exists := c.peerConns[mk]
+		var current *remotePeerConfig
+		if exists {
+			current = &remotePeerConfig{wgPubKey: i.GetRemoteWgPubKey(), allowedIPs: i.GetRemoteIp()}
+		}
+
+		switch diffRemotePeer(current, want) {
+		case peerUnchanged:
+			continue
+		case peerAllowedIPsChanged:
+			c.dotlog.Logger.Debugf("allowed ips of [%s] have been changed to [%s]", mk, want.allowedIPs)
+			err := i.UpdateAllowedIPs(want.allowedIPs)
+			if err != nil {
+				c.dotlog.Logger.Errorf("failed to update allowed ips of [%s], %s", mk, err.Error())
+				lastErr = err
+				continue
+			}
+			result.Updated = append(result.Updated, mk)
+			continue
+		case peerReplaced:
+			// renegotiate from scratch with the new wireguard pub key
+			c.dotlog.Logger.Debugf("wireguard pub key of [%s] has been changed, recreating the peer connection", mk)
+			c.removePeerConn(mk)
+		}
+
+		ni, err := c.configureIce(p, ip, cidr)
+		if err != nil {
+			c.dotlog.Logger.Errorf("failed to configure ice for [%s], %s", mk, err.Error())
+			lastErr = err
+			continue
+		}
+
+		c.peerConns[mk] = ni
+		c.queueStart(ni)
+
+		if exists {
+			result.Updated = append(result.Updated, mk)
+		} else {
+			result.Added = append(result.Added, mk)
+		}
+	}
+
+	result.Stale = c.removeStaleDevicePeers(desired, ip, cidr)
+
+	return result, lastErr
+}
+
+// the wireguard device can still have peers whose ice has already gone,
+// e.g. when cleanup failed or the peer was removed while dotshaker was stopped
+//
+func (c *ControlPlane) removeStaleDevicePeers(
+	desired map[string]*machine.RemotePeer,
+	ip, cidr string,
+) []string {
+	wgPubKeys := make(map[string]struct{})
+	for _, p := range desired {
+		wgPubKeys[p.GetRemoteWgPubKey()] = struct{}{}
+	}
+
+	i := iface.NewIface(c.clientConf.TunName, c.clientConf.WgPrivateKey, ip, cidr, c.dotlog)
+	peers, err := i.GetRemotePeers()
+	if err != nil {
+		c.dotlog.Logger.Debugf("failed to get peers on %s, %s", c.clientConf.TunName, err.Error())
+		return nil
+	}
+
+	stale := []string{}
+	for _, p := range peers {
+		k := p.PublicKey.String()
+		if _, ok := wgPubKeys[k]; ok {
+			continue
+		}
+
+		err := i.RemoveRemotePeer(c.clientConf.TunName, "", k)
+		if err != nil {
+			c.dotlog.Logger.Errorf("failed to remove stale peer [%s] on %s, %s", k, c.clientConf.TunName, err.Error())
+			continue
+		}
+		stale = append(stale, k)
+	}
+
+	return stale
+}
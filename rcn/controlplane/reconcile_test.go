@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package controlplane
+
+import (
+	"testing"
+
+	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
+	"github.com/Notch-Technologies/dotshake/conf"
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"go.uber.org/zap"
+)
+
+func testLog() *dotlog.DotLog {
+	return &dotlog.DotLog{Logger: zap.NewNop().Sugar()}
+}
+
+func TestDiffRemotePeer(t *testing.T) {
+	current := &remotePeerConfig{wgPubKey: "key-a", allowedIPs: "100.64.0.2/32"}
+
+	tests := []struct {
+		name    string
+		current *remotePeerConfig
+		desired remotePeerConfig
+		want    peerChange
+	}{
+		{"no peer connection", nil, remotePeerConfig{"key-a", "100.64.0.2/32"}, peerAdded},
+		{"same", current, remotePeerConfig{"key-a", "100.64.0.2/32"}, peerUnchanged},
+		{"allowed ips only", current, remotePeerConfig{"key-a", "100.64.0.2/32,0.0.0.0/0"}, peerAllowedIPsChanged},
+		{"wireguard pub key", current, remotePeerConfig{"key-b", "100.64.0.2/32"}, peerReplaced},
+		{"both", current, remotePeerConfig{"key-b", "100.64.0.3/32"}, peerReplaced},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffRemotePeer(tt.current, tt.desired)
+			if got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteAllowedIPs(t *testing.T) {
+	peer := &machine.RemotePeer{
+		RemoteClientMachineKey: "mk-exit",
+		RemoteWgPubKey:         "O9Y3qiMsXFlnDhUTNLUeTQGFbSeDtTKVZGZ/GAmcHms=",
+		AllowedIPs:             []string{"100.64.0.2/32", "0.0.0.0/0"},
+	}
+
+	tests := []struct {
+		name     string
+		exitNode string
+		want     string
+	}{
+		{"not the exit node", "", "100.64.0.2/32"},
+		{"other exit node", "100.64.0.3", "100.64.0.2/32"},
+		{"exit node by overlay ip", "100.64.0.2", "100.64.0.2/32,0.0.0.0/0"},
+		{"exit node by machine key", "mk-exit", "100.64.0.2/32,0.0.0.0/0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ControlPlane{
+				clientConf: &conf.ClientConf{ExitNode: tt.exitNode},
+				dotlog:     testLog(),
+			}
+
+			got := c.remoteAllowedIPs(peer)
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
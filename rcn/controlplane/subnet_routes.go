@@ -0,0 +1,228 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package controlplane
+
+// subnet routes. a machine advertising routes forwards the traffic of the remote peers
+// to the subnets of its local networks, so that one machine per site exposes a whole network.
+// the server shares the routes in the allowed ips of the machine, and the remote peers
+// route them to the tunnel, except for the subnets they are directly connected to
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Notch-Technologies/dotshake/iface"
+)
+
+// validates and normalizes the routes given to advertise, e.g. 192.168.1.1/24 to 192.168.1.0/24
+//
+func ParseRoutes(routes []string) ([]string, error) {
+	parsed := []string{}
+	seen := make(map[string]bool)
+	for _, r := range routes {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %s, %w", r, err)
+		}
+		if isDefaultRoute(ipNet.String()) {
+			return nil, errors.New("the default route is not a subnet, advertise the machine as an exit node instead")
+		}
+
+		if !seen[ipNet.String()] {
+			seen[ipNet.String()] = true
+			parsed = append(parsed, ipNet.String())
+		}
+	}
+
+	return parsed, nil
+}
+
+// applies the advertised routes of the client config
+//
+func (c *ControlPlane) ConfigureSubnetRouter() error {
+	c.mu.Lock()
+	routes := c.clientConf.AdvertiseRoutes
+	c.mu.Unlock()
+
+	if len(routes) == 0 {
+		return nil
+	}
+
+	return c.SetAdvertiseRoutes(routes)
+}
+
+// forwards the traffic of the remote peers to routes and tells the server about them.
+// stops forwarding when routes is empty
+//
+func (c *ControlPlane) SetAdvertiseRoutes(routes []string) error {
+	routes, err := ParseRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.clientConf.AdvertiseRoutes = routes
+	c.mu.Unlock()
+
+	overlay, err := c.sendAdvertise()
+	if err != nil {
+		return err
+	}
+
+	if len(routes) == 0 {
+		return iface.DisableSubnetRouter(c.clientConf.TunName)
+	}
+
+	c.dotlog.Logger.Infof("forwarding the traffic of the remote peers from %s to %s", overlay.String(), strings.Join(routes, ", "))
+
+	return iface.EnableSubnetRouter(c.clientConf.TunName, overlay.String(), c.clientConf.IPv6Prefix, routes)
+}
+
+// the allowed ips of the remote peer which are neither its overlay addresses nor default routes
+//
+func (c *ControlPlane) subnetRoutesOf(allowedIPs string) []string {
+	routes := []string{}
+	for _, a := range strings.Split(allowedIPs, ",") {
+		ip, ipNet, err := net.ParseCIDR(strings.TrimSpace(a))
+		if err != nil || isDefaultRoute(ipNet.String()) || c.isOverlayIP(ip) {
+			continue
+		}
+
+		routes = append(routes, ipNet.String())
+	}
+
+	return routes
+}
+
+// installs the routes of the subnets advertised by the remote peers and removes the ones left.
+// be sure to lock mu before calling this function
+//
+func (c *ControlPlane) applySubnetRoutes() {
+	desired := make(map[string]bool)
+	for _, i := range c.peerConns {
+		if i == nil {
+			continue
+		}
+		for _, r := range c.subnetRoutesOf(i.GetRemoteIp()) {
+			desired[r] = true
+		}
+	}
+
+	for r, installed := range c.subnetRoutes {
+		if desired[r] {
+			continue
+		}
+
+		delete(c.subnetRoutes, r)
+		if !installed {
+			continue
+		}
+
+		err := iface.DelSubnetRoute(c.clientConf.TunName, r)
+		if err != nil {
+			c.dotlog.Logger.Warnf("failed to remove the route to %s, %s", r, err.Error())
+			continue
+		}
+		c.dotlog.Logger.Infof("removed the route to %s", r)
+	}
+
+	for r := range desired {
+		if _, ok := c.subnetRoutes[r]; ok {
+			continue
+		}
+
+		// the route would take the local network away from this machine
+		if n := c.connectedNetwork(r); n != "" {
+			c.dotlog.Logger.Warnf("not routing %s to the tunnel, it overlaps %s this machine is connected to", r, n)
+			c.subnetRoutes[r] = false
+			continue
+		}
+
+		err := iface.AddSubnetRoute(c.clientConf.TunName, r)
+		if err != nil {
+			c.dotlog.Logger.Warnf("failed to add the route to %s, %s", r, err.Error())
+			continue
+		}
+		c.subnetRoutes[r] = true
+		c.dotlog.Logger.Infof("routing %s to the tunnel", r)
+	}
+}
+
+// the network of the other interfaces which overlaps route, empty when there is none
+//
+func (c *ControlPlane) connectedNetwork(route string) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	addrs := []string{}
+	for _, i := range ifaces {
+		if i.Name == c.clientConf.TunName || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		as, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range as {
+			addrs = append(addrs, a.String())
+		}
+	}
+
+	return overlappingNetwork(route, addrs)
+}
+
+// the network of the interface addresses, e.g. 192.168.1.10/24, which overlaps route.
+// empty when there is none, link local addresses do not count
+//
+func overlappingNetwork(route string, addrs []string) string {
+	_, routeNet, err := net.ParseCIDR(route)
+	if err != nil {
+		return ""
+	}
+
+	for _, a := range addrs {
+		ip, ipNet, err := net.ParseCIDR(a)
+		if err != nil || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.Contains(routeNet.IP) || routeNet.Contains(ipNet.IP) {
+			return ipNet.String()
+		}
+	}
+
+	return ""
+}
+
+func (c *ControlPlane) closeSubnetRoutes() {
+	for r, installed := range c.subnetRoutes {
+		if !installed {
+			continue
+		}
+
+		err := iface.DelSubnetRoute(c.clientConf.TunName, r)
+		if err != nil {
+			c.dotlog.Logger.Debugf("failed to remove the route to %s, %s", r, err.Error())
+		}
+	}
+	c.subnetRoutes = make(map[string]bool)
+
+	if len(c.clientConf.AdvertiseRoutes) > 0 {
+		err := iface.DisableSubnetRouter(c.clientConf.TunName)
+		if err != nil {
+			c.dotlog.Logger.Errorf("failed to stop forwarding to the advertised routes, %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package controlplane
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Notch-Technologies/dotshake/conf"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []string
+		want    string
+		wantErr bool
+	}{
+		{"normalized", []string{"192.168.1.1/24", "10.0.0.0/16"}, "192.168.1.0/24,10.0.0.0/16", false},
+		{"duplicates and blanks", []string{"192.168.1.0/24", " ", "192.168.1.9/24 "}, "192.168.1.0/24", false},
+		{"ipv6", []string{"fd00:1::1/64"}, "fd00:1::/64", false},
+		{"none", []string{}, "", false},
+		{"not a cidr", []string{"192.168.1.1"}, "", true},
+		{"default route", []string{"0.0.0.0/0"}, "", true},
+		{"ipv6 default route", []string{"::/0"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRoutes(tt.routes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Fatalf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlappingNetwork(t *testing.T) {
+	addrs := []string{"192.168.1.10/24", "10.1.2.3/16", "fe80::1/64", "2001:db8:1::10/64"}
+
+	tests := []struct {
+		name  string
+		route string
+		want  string
+	}{
+		{"same network", "192.168.1.0/24", "192.168.1.0/24"},
+		{"route inside the local network", "10.1.5.0/24", "10.1.0.0/16"},
+		{"route around the local network", "192.168.0.0/16", "192.168.1.0/24"},
+		{"separate", "172.16.0.0/12", ""},
+		{"ipv6", "2001:db8:1::/48", "2001:db8:1::/64"},
+		// link local addresses are on every interface
+		{"link local", "fe80::/10", ""},
+		{"invalid route", "not-a-route", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overlappingNetwork(tt.route, addrs); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubnetRoutesOf(t *testing.T) {
+	_, overlay, _ := net.ParseCIDR("100.64.0.0/10")
+	c := &ControlPlane{
+		clientConf: &conf.ClientConf{IPv6Prefix: "fd00:d07::/64"},
+		overlay:    overlay,
+	}
+
+	got := c.subnetRoutesOf("100.64.0.2/32,fd00:d07::2/128,0.0.0.0/0,::/0,192.168.1.0/24, 10.0.0.5/16,invalid")
+	want := "192.168.1.0/24,10.0.0.0/16"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("got %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"net"
+	"strings"
+)
+
+// points the resolver of the host at the server on ip for the domain and the routed domains,
+// the other names are forwarded to the servers the host used before.
+// Close restores the resolver
+//
+func (s *Server) ConfigureHost(tunname string, ip net.IP) error {
+	h := &hostResolver{tunname: tunname}
+
+	s.mu.Lock()
+	domains := []string{s.Domain()}
+	for fqdn := range s.routes {
+		domains = append(domains, strings.TrimSuffix(fqdn, "."))
+	}
+	s.mu.Unlock()
+
+	upstreams, err := h.set(ip, domains)
+	if err != nil {
+		h.restore()
+		return err
+	}
+
+	s.mu.Lock()
+	s.host = h
+	s.mu.Unlock()
+
+	s.SetUpstreams(upstreams)
+
+	return nil
+}
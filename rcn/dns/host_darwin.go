@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+// the resolver of the host on darwin, a file in /etc/resolver per domain
+// sends the names of the domain to the server and nothing else
+//
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+const resolverDir = "/etc/resolver"
+
+type hostResolver struct {
+	tunname string
+
+	ip net.IP
+	// the files written in resolverDir
+	paths map[string]bool
+}
+
+func (h *hostResolver) set(ip net.IP, domains []string) ([]string, error) {
+	err := os.MkdirAll(resolverDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	h.ip = ip
+
+	return nil, h.setDomains(domains)
+}
+
+// writes the files of domains and removes the others
+//
+func (h *hostResolver) setDomains(domains []string) error {
+	if h.paths == nil {
+		h.paths = make(map[string]bool)
+	}
+
+	conf := fmt.Sprintf("# generated by dotshake\nnameserver %s\n", h.ip.String())
+
+	desired := make(map[string]bool)
+	for _, d := range domains {
+		path := filepath.Join(resolverDir, d)
+		desired[path] = true
+
+		err := os.WriteFile(path, []byte(conf), 0644)
+		if err != nil {
+			return err
+		}
+		h.paths[path] = true
+	}
+
+	for path := range h.paths {
+		if desired[path] {
+			continue
+		}
+
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(h.paths, path)
+	}
+
+	return nil
+}
+
+func (h *hostResolver) restore() error {
+	return h.setDomains(nil)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+// the resolver of the host on linux. with systemd-resolved, the server becomes the dns server
+// of the tun for the domain and the routed domains only. otherwise /etc/resolv.conf is replaced by one pointing at the server,
+// and the original is kept next to it until it is restored, also after a crash
+//
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	resolvConf       = "/etc/resolv.conf"
+	resolvConfBackup = "/etc/resolv.conf.dotshake"
+	resolvConfHeader = "# generated by dotshake, the original is in " + resolvConfBackup
+)
+
+type hostResolver struct {
+	tunname string
+
+	// the tun has been configured through systemd-resolved
+	resolved bool
+	// resolv.conf has been replaced
+	replaced bool
+}
+
+// domains are the domain of the machines first and the routed domains.
+// returns the upstream servers to forward the other names to,
+// none with systemd-resolved which asks the server about the domains only
+//
+func (h *hostResolver) set(ip net.IP, domains []string) ([]string, error) {
+	if usesResolved() {
+		err := resolvectl("dns", h.tunname, ip.String())
+		if err != nil {
+			return nil, err
+		}
+		h.resolved = true
+
+		return nil, h.setDomains(domains)
+	}
+
+	current, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+
+	original := current
+	if bytes.HasPrefix(current, []byte(resolvConfHeader)) {
+		// left by a run which did not restore it
+		original, err = os.ReadFile(resolvConfBackup)
+		if err != nil {
+			return nil, fmt.Errorf("%s is generated by dotshake but %s is gone, %w", resolvConf, resolvConfBackup, err)
+		}
+	} else {
+		// moves a symlink rather than writing through it
+		err = os.Rename(resolvConf, resolvConfBackup)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.replaced = true
+
+	nameservers, search, options := parseResolvConf(original)
+
+	conf := &strings.Builder{}
+	fmt.Fprintln(conf, resolvConfHeader)
+	fmt.Fprintf(conf, "nameserver %s\n", ip.String())
+	fmt.Fprintf(conf, "search %s\n", strings.Join(append([]string{domains[0]}, search...), " "))
+	for _, o := range options {
+		fmt.Fprintf(conf, "options %s\n", o)
+	}
+
+	err = os.WriteFile(resolvConf, []byte(conf.String()), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := []string{}
+	for _, n := range nameservers {
+		if n != ip.String() {
+			upstreams = append(upstreams, n)
+		}
+	}
+
+	return upstreams, nil
+}
+
+// the server is the only nameserver of resolv.conf and gets all the queries anyway
+//
+func (h *hostResolver) setDomains(domains []string) error {
+	if !h.resolved {
+		return nil
+	}
+
+	args := []string{"domain", h.tunname}
+	for _, d := range domains {
+		args = append(args, "~"+d)
+	}
+	return resolvectl(args...)
+}
+
+func (h *hostResolver) restore() error {
+	if h.resolved {
+		h.resolved = false
+		// fails when the tun is gone, which takes its settings with it
+		_ = resolvectl("revert", h.tunname)
+	}
+
+	if h.replaced {
+		h.replaced = false
+		err := os.Rename(resolvConfBackup, resolvConf)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s from %s, %w", resolvConf, resolvConfBackup, err)
+		}
+	}
+
+	return nil
+}
+
+// whether the host resolves through the stub of systemd-resolved
+//
+func usesResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+
+	if target, err := os.Readlink(resolvConf); err == nil && strings.Contains(target, "/run/systemd/resolve/") {
+		return true
+	}
+
+	b, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return false
+	}
+	nameservers, _, _ := parseResolvConf(b)
+	for _, n := range nameservers {
+		if n == "127.0.0.53" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func resolvectl(args ...string) error {
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to resolvectl %s, %s %w", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+func parseResolvConf(b []byte) (nameservers, search, options []string) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			nameservers = append(nameservers, fields[1])
+		case "search", "domain":
+			search = append(search, fields[1:]...)
+		case "options":
+			options = append(options, strings.Join(fields[1:], " "))
+		}
+	}
+
+	return nameservers, search, options
+}
@@ -0,0 +1,318 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+// the names of the remote peers. the server asks the dns server of each remote peer
+// for the ptr record of its overlay address, the same way the remote peers learn the name of this machine
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// asking the remote peers for their names
+	watchInterval = 30 * time.Second
+	lookupTimeout = 3 * time.Second
+
+	// asking again, the hostname of a machine rarely changes
+	renameInterval = 10 * time.Minute
+)
+
+// dials the remote peers, through the tunnel
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+type peerName struct {
+	name string
+	ips  []net.IP
+
+	// when the name has been asked for, whether it was answered or not
+	asked time.Time
+}
+
+// named remote peers ordered by their first address
+//
+func sortedPeers(peers map[string]*peerName) []*peerName {
+	sorted := []*peerName{}
+	for _, p := range peers {
+		if p.name != "" && len(p.ips) > 0 {
+			sorted = append(sorted, p)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].ips[0].To16(), sorted[j].ips[0].To16()) < 0
+	})
+
+	return sorted
+}
+
+// keeps the names of the remote peers and the routes in sync with the remote peers until Close.
+// peers returns the overlay addresses of the remote peers by their machine keys,
+// routes returns the nameservers of the routed domains
+//
+func (s *Server) WatchPeers(peers func() map[string][]net.IP, routes func() map[string][]string) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		s.SetRoutes(routes())
+		s.refreshPeers(peers())
+
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		case <-s.refresh:
+		}
+	}
+}
+
+// tells WatchPeers that the remote peers have changed
+//
+func (s *Server) Refresh() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) refreshPeers(peers map[string][]net.IP) {
+	s.mu.Lock()
+	// the ones that have left
+	for mk := range s.peers {
+		if _, ok := peers[mk]; !ok {
+			delete(s.peers, mk)
+		}
+	}
+
+	ask := make(map[string]net.IP)
+	for mk, ips := range peers {
+		if len(ips) == 0 {
+			continue
+		}
+
+		p, ok := s.peers[mk]
+		if !ok {
+			p = &peerName{}
+			s.peers[mk] = p
+		}
+		p.ips = ips
+
+		// unnamed peers are asked again on every tick, they may not be connected yet
+		if p.name == "" || time.Since(p.asked) > renameInterval {
+			ask[mk] = ips[0]
+		}
+	}
+	s.rebuild()
+	s.mu.Unlock()
+
+	if len(ask) == 0 {
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	names := make(map[string]string)
+	for mk, ip := range ask {
+		wg.Add(1)
+		go func(mk string, ip net.IP) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+			defer cancel()
+
+			name, err := lookupName(ctx, s.dial, ip)
+			if err != nil {
+				s.dotlog.Logger.Debugf("failed to ask %s for its name, %s", ip.String(), err.Error())
+			}
+
+			mu.Lock()
+			names[mk] = name
+			mu.Unlock()
+		}(mk, ip)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for mk, name := range names {
+		p, ok := s.peers[mk]
+		if !ok {
+			continue
+		}
+		p.asked = time.Now()
+
+		// keeps the last name while the peer does not answer
+		if name != "" && name != p.name {
+			s.dotlog.Logger.Infof("%s is %s", p.ips[0].String(), name+"."+s.domain)
+			p.name = name
+		}
+	}
+	s.rebuild()
+}
+
+// asks the dns server on ip for the name of ip
+//
+func lookupName(ctx context.Context, dial DialFunc, ip net.IP) (string, error) {
+	name, err := dnsmessage.NewName(reverseName(ip))
+	if err != nil {
+		return "", err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: false})
+	err = b.StartQuestions()
+	if err != nil {
+		return "", err
+	}
+	err = b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return "", err
+	}
+	req, err := b.Finish()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := exchange(ctx, dial, "udp", net.JoinHostPort(ip.String(), "53"), req)
+	if err != nil {
+		return "", err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(res)
+	if err != nil {
+		return "", err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return "", errors.New(h.RCode.String())
+	}
+
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			return "", errors.New("no ptr record")
+		}
+		if rh.Type != dnsmessage.TypePTR {
+			err = p.SkipAnswer()
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		ptr, err := p.PTRResource()
+		if err != nil {
+			return "", err
+		}
+
+		label := Label(strings.Split(ptr.PTR.String(), ".")[0])
+		if label == "" {
+			return "", errors.New("invalid name " + ptr.PTR.String())
+		}
+		return label, nil
+	}
+}
+
+// a dns label from the hostname, e.g. my-laptop from My_Laptop.local
+//
+func Label(hostname string) string {
+	hostname = strings.ToLower(strings.Split(hostname, ".")[0])
+
+	var b strings.Builder
+	for _, r := range hostname {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
+
+// the name of the ptr record of ip, e.g. 1.0.64.100.in-addr.arpa.
+//
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." +
+			strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0])) + ".in-addr.arpa."
+	}
+
+	const hex = "0123456789abcdef"
+	ip16 := ip.To16()
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip16[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip16[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+// the ip of the name of a ptr record, empty when it is not one
+//
+func reverseIP(name string) string {
+	name = strings.ToLower(name)
+
+	if strings.HasSuffix(name, ".in-addr.arpa.") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return ""
+		}
+		ip := net.ParseIP(labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0])
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	}
+
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(nibbles) != 32 {
+			return ""
+		}
+
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		ip := net.ParseIP(b.String())
+		if ip == nil {
+			return ""
+		}
+		return ip.String()
+	}
+
+	return ""
+}
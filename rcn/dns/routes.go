@@ -0,0 +1,168 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+// split dns. the queries for the routed domains, e.g. corp.example, are forwarded
+// to their own nameservers through the tunnel instead of the upstream servers,
+// and the resolver of the host sends the routed domains to the server
+//
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// parses the routes in the form of domain=nameserver,nameserver, e.g. corp.example=10.0.0.53.
+// returns the valid ones with the error of the first invalid one
+//
+func ParseRoutes(values []string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+
+	var firstErr error
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		domain, nameservers, ok := strings.Cut(v, "=")
+		if !ok {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invalid dns route %s, domain=nameserver is expected", v)
+			}
+			continue
+		}
+
+		err := addRoute(routes, domain, strings.Split(nameservers, ","))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return routes, firstErr
+}
+
+// validates and normalizes the routes of the client config,
+// returns the valid ones with the error of the first invalid one
+//
+func NormalizeRoutes(routes map[string][]string) (map[string][]string, error) {
+	normalized := make(map[string][]string)
+
+	var firstErr error
+	for domain, nameservers := range routes {
+		err := addRoute(normalized, domain, nameservers)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return normalized, firstErr
+}
+
+func addRoute(routes map[string][]string, domain string, nameservers []string) error {
+	domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" {
+		return fmt.Errorf("empty domain of the nameservers %s", strings.Join(nameservers, ","))
+	}
+
+	for _, ns := range nameservers {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+
+		host := ns
+		if h, _, err := net.SplitHostPort(ns); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid nameserver %s of %s, an ip or ip:port is expected", ns, domain)
+		}
+
+		routes[domain] = append(routes[domain], ns)
+	}
+
+	if len(routes[domain]) == 0 {
+		return fmt.Errorf("no nameserver of %s", domain)
+	}
+
+	return nil
+}
+
+// the ip of the nameserver, ip or ip:port
+//
+func NameserverIP(ns string) net.IP {
+	if h, _, err := net.SplitHostPort(ns); err == nil {
+		ns = h
+	}
+	return net.ParseIP(ns)
+}
+
+// forwards the queries for the domains to the nameservers, replaces the routes set before
+//
+func (s *Server) SetRoutes(routes map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fqdns := make(map[string][]string)
+	for domain, nameservers := range routes {
+		fqdn := strings.Trim(strings.ToLower(domain), ".") + "."
+		for _, ns := range nameservers {
+			if _, _, err := net.SplitHostPort(ns); err != nil {
+				ns = net.JoinHostPort(ns, "53")
+			}
+			fqdns[fqdn] = append(fqdns[fqdn], ns)
+		}
+	}
+
+	if sameRoutes(s.routes, fqdns) {
+		return
+	}
+	s.routes = fqdns
+
+	domains := []string{}
+	for fqdn, nameservers := range fqdns {
+		domains = append(domains, strings.TrimSuffix(fqdn, "."))
+		s.dotlog.Logger.Infof("routing the queries for %s to %s", strings.TrimSuffix(fqdn, "."), strings.Join(nameservers, ", "))
+	}
+	sort.Strings(domains)
+
+	if s.host != nil {
+		err := s.host.setDomains(append([]string{s.Domain()}, domains...))
+		if err != nil {
+			s.dotlog.Logger.Errorf("failed to set the routed domains on the resolver of the host, %s", err.Error())
+		}
+	}
+}
+
+// the nameservers of the longest routed domain of name.
+// be sure to lock mu before calling this function
+//
+func (s *Server) route(name string) []string {
+	var longest string
+	for fqdn := range s.routes {
+		if (name == fqdn || strings.HasSuffix(name, "."+fqdn)) && len(fqdn) > len(longest) {
+			longest = fqdn
+		}
+	}
+
+	return s.routes[longest]
+}
+
+func sameRoutes(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for domain, nameservers := range a {
+		if strings.Join(nameservers, ",") != strings.Join(b[domain], ",") {
+			return false
+		}
+	}
+
+	return true
+}
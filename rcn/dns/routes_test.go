@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		routes map[string][]string
+		err    bool
+	}{
+		{"none", nil, map[string][]string{}, false},
+		{
+			"nameservers",
+			[]string{"corp.example=10.0.0.53,10.0.0.54:5353", "lab.example=fd00::53"},
+			map[string][]string{"corp.example": {"10.0.0.53", "10.0.0.54:5353"}, "lab.example": {"fd00::53"}},
+			false,
+		},
+		{
+			"normalized domain",
+			[]string{" Corp.Example. = 10.0.0.53 , "},
+			map[string][]string{"corp.example": {"10.0.0.53"}},
+			false,
+		},
+		{
+			"same domain twice",
+			[]string{"corp.example=10.0.0.53", "corp.example.=10.0.0.54"},
+			map[string][]string{"corp.example": {"10.0.0.53", "10.0.0.54"}},
+			false,
+		},
+		{"empty values", []string{"", " "}, map[string][]string{}, false},
+		{"no nameserver", []string{"corp.example"}, map[string][]string{}, true},
+		{"empty nameservers", []string{"corp.example="}, map[string][]string{}, true},
+		{"empty domain", []string{"=10.0.0.53"}, map[string][]string{}, true},
+		{"hostname as nameserver", []string{"corp.example=ns.corp.example"}, map[string][]string{}, true},
+		{
+			"valid ones are kept",
+			[]string{"corp.example=ns.corp.example", "lab.example=10.1.0.53"},
+			map[string][]string{"lab.example": {"10.1.0.53"}},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := ParseRoutes(tt.values)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(routes, tt.routes) {
+				t.Fatalf("got %v, want %v", routes, tt.routes)
+			}
+		})
+	}
+}
+
+func TestNormalizeRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string][]string
+		want   map[string][]string
+		err    bool
+	}{
+		{"none", nil, map[string][]string{}, false},
+		{
+			"normalized domain",
+			map[string][]string{"Corp.Example.": {" 10.0.0.53", "10.0.0.54:5353"}},
+			map[string][]string{"corp.example": {"10.0.0.53", "10.0.0.54:5353"}},
+			false,
+		},
+		{"no nameserver", map[string][]string{"corp.example": {}}, map[string][]string{}, true},
+		{"invalid nameserver", map[string][]string{"corp.example": {"10.0.0.300"}}, map[string][]string{}, true},
+		{
+			"valid ones are kept",
+			map[string][]string{"": {"10.0.0.53"}, "lab.example": {"10.1.0.53"}},
+			map[string][]string{"lab.example": {"10.1.0.53"}},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes, err := NormalizeRoutes(tt.routes)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(routes, tt.want) {
+				t.Fatalf("got %v, want %v", routes, tt.want)
+			}
+		})
+	}
+}
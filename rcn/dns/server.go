@@ -0,0 +1,541 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+// dns package serves the names of the machines on the overlay address.
+// <hostname>.<domain> resolves to the overlay addresses of the machine and the overlay
+// addresses resolve back to their names, everything else is forwarded to the upstream servers.
+// the names of the remote peers are learned from their own dns servers
+//
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DefaultDomain = "dotshake"
+
+	// ttl of the answers about the machines, the remote peers come and go
+	ttl = 60
+
+	// waiting for an upstream server
+	forwardTimeout = 3 * time.Second
+
+	// reading a query over tcp
+	tcpReadTimeout = 10 * time.Second
+
+	maxMessageSize = 65535
+)
+
+var errNoUpstream = errors.New("no upstream dns server")
+
+type Server struct {
+	// fqdn, e.g. dotshake.
+	domain string
+
+	// overlay addresses of the machines by their names, and the names by the addresses
+	hosts map[string][]net.IP
+	names map[string]string
+
+	// this machine
+	self    string
+	selfIPs []net.IP
+
+	// names of the remote peers by their machine keys
+	peers map[string]*peerName
+
+	upstreams []string
+
+	// nameservers of the routed domains by their fqdns, reached through dial
+	routes map[string][]string
+	dial   DialFunc
+
+	pcs []net.PacketConn
+	lns []net.Listener
+
+	mu      *sync.RWMutex
+	closed  chan struct{}
+	refresh chan struct{}
+
+	// restores the resolver of the host on Close, nil when it is not configured
+	host *hostResolver
+
+	dotlog *dotlog.DotLog
+}
+
+// dial reaches the remote peers and the nameservers of the routed domains
+//
+func NewServer(domain string, dial DialFunc, dotlog *dotlog.DotLog) *Server {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	if domain == "" {
+		domain = DefaultDomain
+	}
+
+	return &Server{
+		domain: domain + ".",
+
+		hosts: make(map[string][]net.IP),
+		names: make(map[string]string),
+		peers: make(map[string]*peerName),
+
+		routes: make(map[string][]string),
+		dial:   dial,
+
+		mu:      &sync.RWMutex{},
+		closed:  make(chan struct{}),
+		refresh: make(chan struct{}, 1),
+
+		dotlog: dotlog,
+	}
+}
+
+// the domain without the trailing dot
+//
+func (s *Server) Domain() string {
+	return strings.TrimSuffix(s.domain, ".")
+}
+
+// names this machine after hostname
+//
+func (s *Server) SetSelf(hostname string, ips []net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.self = Label(hostname)
+	s.selfIPs = ips
+	s.rebuild()
+}
+
+// the servers the queries outside of the domain are forwarded to, ip or ip:port
+//
+func (s *Server) SetUpstreams(upstreams []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.upstreams = nil
+	for _, u := range upstreams {
+		if _, _, err := net.SplitHostPort(u); err != nil {
+			u = net.JoinHostPort(u, "53")
+		}
+		s.upstreams = append(s.upstreams, u)
+	}
+}
+
+// rebuilds the records from this machine and the named remote peers.
+// a name taken by this machine or by a remote peer with a smaller address is not given again.
+// be sure to lock mu before calling this function
+//
+func (s *Server) rebuild() {
+	s.hosts = make(map[string][]net.IP)
+	s.names = make(map[string]string)
+
+	add := func(name string, ips []net.IP) {
+		if name == "" || len(ips) == 0 {
+			return
+		}
+		if _, ok := s.hosts[name]; ok {
+			s.dotlog.Logger.Debugf("%s is taken, %s is not named", name+"."+s.domain, ips[0].String())
+			return
+		}
+
+		s.hosts[name] = ips
+		for _, ip := range ips {
+			s.names[ip.String()] = name
+		}
+	}
+
+	add(s.self, s.selfIPs)
+	for _, p := range sortedPeers(s.peers) {
+		add(p.name, p.ips)
+	}
+}
+
+// serves the queries on pc and ln until Close, either may be nil
+//
+func (s *Server) Serve(pc net.PacketConn, ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pc != nil {
+		s.pcs = append(s.pcs, pc)
+		go s.servePacket(pc)
+	}
+	if ln != nil {
+		s.lns = append(s.lns, ln)
+		go s.serveStream(ln)
+	}
+}
+
+func (s *Server) servePacket(pc net.PacketConn) {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				s.dotlog.Logger.Errorf("failed to read dns query, %s", err.Error())
+			}
+			return
+		}
+
+		req := append([]byte{}, buf[:n]...)
+		go func() {
+			res, err := s.handle(req, "udp")
+			if err != nil {
+				s.dotlog.Logger.Debugf("failed to answer dns query from %s, %s", addr.String(), err.Error())
+				return
+			}
+
+			_, err = pc.WriteTo(res, addr)
+			if err != nil {
+				s.dotlog.Logger.Debugf("failed to write dns answer to %s, %s", addr.String(), err.Error())
+			}
+		}()
+	}
+}
+
+func (s *Server) serveStream(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				s.dotlog.Logger.Errorf("failed to accept dns conn, %s", err.Error())
+			}
+			return
+		}
+
+		go s.serveConn(c)
+	}
+}
+
+// answers the length prefixed queries on c until it is idle
+//
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpReadTimeout))
+
+		req, err := readStream(c)
+		if err != nil {
+			return
+		}
+
+		res, err := s.handle(req, "tcp")
+		if err != nil {
+			s.dotlog.Logger.Debugf("failed to answer dns query from %s, %s", c.RemoteAddr().String(), err.Error())
+			return
+		}
+
+		err = writeStream(c, res)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answers a query, network is the one it came over and is forwarded over
+//
+func (s *Server) handle(req []byte, network string) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(req)
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return reply(h, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	name := strings.ToLower(q.Name.String())
+
+	// the domain itself exists, it just has no addresses
+	if name == s.domain {
+		return s.answerApex(h, q)
+	}
+
+	if strings.HasSuffix(name, "."+s.domain) {
+		return s.answerHost(h, q, strings.TrimSuffix(name, "."+s.domain))
+	}
+
+	if q.Type == dnsmessage.TypePTR {
+		s.mu.RLock()
+		host, ok := s.names[reverseIP(name)]
+		s.mu.RUnlock()
+		if ok {
+			return s.answerPTR(h, q, host)
+		}
+	}
+
+	s.mu.RLock()
+	nameservers, dial := s.route(name), s.dial
+	if len(nameservers) == 0 {
+		nameservers, dial = s.upstreams, (&net.Dialer{}).DialContext
+	}
+	s.mu.RUnlock()
+
+	res, err := forward(dial, nameservers, req, network)
+	if err != nil {
+		s.dotlog.Logger.Debugf("failed to forward dns query for %s, %s", name, err.Error())
+		rcode := dnsmessage.RCodeServerFailure
+		if errors.Is(err, errNoUpstream) {
+			rcode = dnsmessage.RCodeRefused
+		}
+		return reply(h, &q, rcode, nil)
+	}
+
+	return res, nil
+}
+
+func (s *Server) answerHost(h dnsmessage.Header, q dnsmessage.Question, host string) ([]byte, error) {
+	s.mu.RLock()
+	ips, ok := s.hosts[host]
+	s.mu.RUnlock()
+
+	if !ok {
+		return reply(h, &q, dnsmessage.RCodeNameError, nil)
+	}
+
+	return reply(h, &q, dnsmessage.RCodeSuccess, func(b *dnsmessage.Builder) error {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				if err := b.AResource(rh, a); err != nil {
+					return err
+				}
+			} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip.To16())
+				if err := b.AAAAResource(rh, aaaa); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// answers the soa of the domain, and no data with the soa to the other types
+// so that the resolvers cache the absence of the records
+//
+func (s *Server) answerApex(h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	soa, err := s.soa()
+	if err != nil {
+		return nil, err
+	}
+
+	return reply(h, &q, dnsmessage.RCodeSuccess, func(b *dnsmessage.Builder) error {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl}
+		if q.Type == dnsmessage.TypeSOA {
+			return b.SOAResource(rh, soa)
+		}
+
+		err := b.StartAuthorities()
+		if err != nil {
+			return err
+		}
+		return b.SOAResource(rh, soa)
+	})
+}
+
+func (s *Server) soa() (dnsmessage.SOAResource, error) {
+	ns, err := dnsmessage.NewName(s.domain)
+	if err != nil {
+		return dnsmessage.SOAResource{}, err
+	}
+	mbox, err := dnsmessage.NewName("hostmaster." + s.domain)
+	if err != nil {
+		return dnsmessage.SOAResource{}, err
+	}
+
+	return dnsmessage.SOAResource{
+		NS:      ns,
+		MBox:    mbox,
+		Serial:  1,
+		Refresh: ttl,
+		Retry:   ttl,
+		Expire:  ttl,
+		MinTTL:  ttl,
+	}, nil
+}
+
+func (s *Server) answerPTR(h dnsmessage.Header, q dnsmessage.Question, host string) ([]byte, error) {
+	ptr, err := dnsmessage.NewName(host + "." + s.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply(h, &q, dnsmessage.RCodeSuccess, func(b *dnsmessage.Builder) error {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl}
+		return b.PTRResource(rh, dnsmessage.PTRResource{PTR: ptr})
+	})
+}
+
+// builds the response to the query of h and q, answers adds the answers
+//
+func reply(
+	h dnsmessage.Header,
+	q *dnsmessage.Question,
+	rcode dnsmessage.RCode,
+	answers func(b *dnsmessage.Builder) error,
+) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Authoritative:      answers != nil || rcode == dnsmessage.RCodeNameError,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+
+	err := b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if q != nil {
+		err = b.Question(*q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if answers != nil {
+		err = b.StartAnswers()
+		if err != nil {
+			return nil, err
+		}
+		err = answers(&b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// sends the query to the nameservers in turn, returns the first response
+//
+func forward(dial DialFunc, nameservers []string, req []byte, network string) ([]byte, error) {
+	if len(nameservers) == 0 {
+		return nil, errNoUpstream
+	}
+
+	var err error
+	for _, ns := range nameservers {
+		var res []byte
+		res, err = exchange(context.Background(), dial, network, ns, req)
+		if err == nil {
+			return res, nil
+		}
+	}
+
+	return nil, err
+}
+
+// sends req to addr and waits for the response with the same id
+//
+func exchange(ctx context.Context, dial DialFunc, network, addr string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, forwardTimeout)
+	defer cancel()
+
+	c, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+
+	if network == "tcp" {
+		err = writeStream(c, req)
+		if err != nil {
+			return nil, err
+		}
+		return readStream(c)
+	}
+
+	_, err = c.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// a late response to another query
+		if n >= 2 && buf[0] == req[0] && buf[1] == req[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func readStream(r io.Reader) ([]byte, error) {
+	var l uint16
+	err := binary.Read(r, binary.BigEndian, &l)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, l)
+	_, err = io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeStream(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// stops serving and restores the resolver of the host
+//
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+
+	for _, pc := range s.pcs {
+		pc.Close()
+	}
+	for _, ln := range s.lns {
+		ln.Close()
+	}
+
+	if s.host != nil {
+		return s.host.restore()
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testLog() *dotlog.DotLog {
+	return &dotlog.DotLog{Logger: zap.NewNop().Sugar()}
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0xd07, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	req, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// the rcode and the answers and authorities of res, e.g. "A 100.64.0.1" or "SOA dotshake."
+//
+func parseResponse(t *testing.T, res []byte) (dnsmessage.RCode, []string, []string) {
+	t.Helper()
+
+	var m dnsmessage.Message
+	err := m.Unpack(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.ID != 0xd07 || !m.Header.Response {
+		t.Fatalf("not the response to the query, %+v", m.Header)
+	}
+
+	describe := func(rs []dnsmessage.Resource) []string {
+		out := []string{}
+		for _, r := range rs {
+			switch b := r.Body.(type) {
+			case *dnsmessage.AResource:
+				out = append(out, "A "+net.IP(b.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				out = append(out, "AAAA "+net.IP(b.AAAA[:]).String())
+			case *dnsmessage.PTRResource:
+				out = append(out, "PTR "+b.PTR.String())
+			case *dnsmessage.SOAResource:
+				out = append(out, "SOA "+b.NS.String())
+			default:
+				out = append(out, r.Header.Type.String())
+			}
+		}
+		return out
+	}
+
+	return m.Header.RCode, describe(m.Answers), describe(m.Authorities)
+}
+
+func TestServerAnswer(t *testing.T) {
+	s := NewServer("", nil, testLog())
+	s.SetSelf("My Host", []net.IP{net.ParseIP("100.64.0.1"), net.ParseIP("fd00:d07::1")})
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       dnsmessage.Type
+		rcode       dnsmessage.RCode
+		answers     string
+		authorities string
+	}{
+		{"a", "my-host.dotshake.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "A 100.64.0.1", ""},
+		{"aaaa", "my-host.dotshake.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, "AAAA fd00:d07::1", ""},
+		{"case insensitive", "MY-HOST.DotShake.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "A 100.64.0.1", ""},
+		{"no record of the type", "my-host.dotshake.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, "", ""},
+		{"unknown host", "other.dotshake.", dnsmessage.TypeA, dnsmessage.RCodeNameError, "", ""},
+		{"apex", "dotshake.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, "", "SOA dotshake."},
+		{"apex aaaa", "dotshake.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, "", "SOA dotshake."},
+		{"apex soa", "dotshake.", dnsmessage.TypeSOA, dnsmessage.RCodeSuccess, "SOA dotshake.", ""},
+		{"ptr", "1.0.64.100.in-addr.arpa.", dnsmessage.TypePTR, dnsmessage.RCodeSuccess, "PTR my-host.dotshake.", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := s.handle(query(t, tt.qname, tt.qtype), "udp")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rcode, answers, authorities := parseResponse(t, res)
+			if rcode != tt.rcode {
+				t.Fatalf("got %s, want %s", rcode, tt.rcode)
+			}
+			if got := strings.Join(answers, ","); got != tt.answers {
+				t.Fatalf("got answers %q, want %q", got, tt.answers)
+			}
+			if got := strings.Join(authorities, ","); got != tt.authorities {
+				t.Fatalf("got authorities %q, want %q", got, tt.authorities)
+			}
+		})
+	}
+}
+
+// answers every query with 192.0.2.1 over udp and tcp on the same port of the loopback
+//
+func startUpstream(t *testing.T) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	ln, err := net.Listen("tcp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	answer := func(req []byte) []byte {
+		var p dnsmessage.Parser
+		h, err := p.Start(req)
+		if err != nil {
+			return nil
+		}
+		q, err := p.Question()
+		if err != nil {
+			return nil
+		}
+		res, _ := reply(h, &q, dnsmessage.RCodeSuccess, func(b *dnsmessage.Builder) error {
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 1}
+			return b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+		})
+		return res
+	}
+
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := readStream(c)
+			if err == nil {
+				writeStream(c, answer(req))
+			}
+			c.Close()
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestServerForward(t *testing.T) {
+	upstream := startUpstream(t)
+
+	// a closed port, the query is refused by the loopback
+	closed, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	// the nameservers of the routed domains are behind the tunnel, dial reaches the upstream instead
+	var dialedMu sync.Mutex
+	dialed := []string{}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialedMu.Lock()
+		dialed = append(dialed, address)
+		dialedMu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, upstream)
+	}
+
+	tests := []struct {
+		name      string
+		upstreams []string
+		routes    map[string][]string
+		qname     string
+		network   string
+		rcode     dnsmessage.RCode
+		answers   string
+		dialed    string
+	}{
+		{"upstream", []string{upstream}, nil, "example.com.", "udp", dnsmessage.RCodeSuccess, "A 192.0.2.1", ""},
+		{"upstream over tcp", []string{upstream}, nil, "example.com.", "tcp", dnsmessage.RCodeSuccess, "A 192.0.2.1", ""},
+		{"next upstream", []string{closedAddr, upstream}, nil, "example.com.", "udp", dnsmessage.RCodeSuccess, "A 192.0.2.1", ""},
+		{"no upstream", nil, nil, "example.com.", "udp", dnsmessage.RCodeRefused, "", ""},
+		{"upstream failing", []string{closedAddr}, nil, "example.com.", "udp", dnsmessage.RCodeServerFailure, "", ""},
+		{
+			"routed domain",
+			nil,
+			map[string][]string{"corp.example": {"10.0.0.53"}},
+			"db.corp.example.",
+			"udp",
+			dnsmessage.RCodeSuccess,
+			"A 192.0.2.1",
+			"10.0.0.53:53",
+		},
+		{
+			"longest routed domain",
+			[]string{closedAddr},
+			map[string][]string{"corp.example": {"10.0.0.53"}, "eu.corp.example": {"10.1.0.53:5353"}},
+			"db.eu.corp.example.",
+			"udp",
+			dnsmessage.RCodeSuccess,
+			"A 192.0.2.1",
+			"10.1.0.53:5353",
+		},
+		{
+			"outside the routed domains",
+			[]string{upstream},
+			map[string][]string{"corp.example": {"10.0.0.53"}},
+			"corp.example.com.",
+			"udp",
+			dnsmessage.RCodeSuccess,
+			"A 192.0.2.1",
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("", dial, testLog())
+			s.SetUpstreams(tt.upstreams)
+			s.SetRoutes(tt.routes)
+
+			dialedMu.Lock()
+			dialed = nil
+			dialedMu.Unlock()
+
+			res, err := s.handle(query(t, tt.qname, dnsmessage.TypeA), tt.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rcode, answers, _ := parseResponse(t, res)
+			if rcode != tt.rcode {
+				t.Fatalf("got %s, want %s", rcode, tt.rcode)
+			}
+			if got := strings.Join(answers, ","); got != tt.answers {
+				t.Fatalf("got answers %q, want %q", got, tt.answers)
+			}
+
+			dialedMu.Lock()
+			defer dialedMu.Unlock()
+			if got := strings.Join(dialed, ","); got != tt.dialed {
+				t.Fatalf("dialed %q, want %q", got, tt.dialed)
+			}
+		})
+	}
+}
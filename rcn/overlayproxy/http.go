@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package overlayproxy
+
+// http proxy, CONNECT tunnels and plain requests with an absolute url
+//
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+)
+
+type HTTPServer struct {
+	dial DialFunc
+
+	srv   *http.Server
+	conns *conns
+
+	dotlog *dotlog.DotLog
+}
+
+func NewHTTPServer(dial DialFunc, dotlog *dotlog.DotLog) *HTTPServer {
+	return &HTTPServer{
+		dial:  dial,
+		conns: newConns(),
+
+		dotlog: dotlog,
+	}
+}
+
+// listens on addr, e.g. localhost:8080, and serves until Close
+//
+func (s *HTTPServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			return dialHost(ctx, s.dial, host, port)
+		},
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	s.srv = &http.Server{
+		Handler: &httpProxyHandler{
+			s: s,
+			rp: &httputil.ReverseProxy{
+				// the request already carries the absolute url of the target
+				Director:  func(r *http.Request) {},
+				Transport: transport,
+			},
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.dotlog.Logger.Infof("http proxy listening on %s", ln.Addr().String())
+
+	go func() {
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.dotlog.Logger.Errorf("http proxy stopped, %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+type httpProxyHandler struct {
+	s  *HTTPServer
+	rp *httputil.ReverseProxy
+}
+
+func (h *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		h.s.connect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "only proxy requests are served", http.StatusBadRequest)
+		return
+	}
+
+	// hop-by-hop headers meant for this proxy
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+	r.RequestURI = ""
+
+	h.rp.ServeHTTP(w, r)
+}
+
+func (s *HTTPServer) connect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	remote, err := dialHost(ctx, s.dial, host, port)
+	cancel()
+	if err != nil {
+		s.dotlog.Logger.Debugf("http proxy failed to dial %s, %s", r.Host, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		remote.Close()
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	if !s.conns.add(c) {
+		c.Close()
+		remote.Close()
+		return
+	}
+	defer s.conns.remove(c)
+
+	_, err = c.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		c.Close()
+		remote.Close()
+		return
+	}
+
+	// the client may have sent data right after the request
+	if n := brw.Reader.Buffered(); n > 0 {
+		b, _ := brw.Reader.Peek(n)
+		if _, err := remote.Write(b); err != nil {
+			c.Close()
+			remote.Close()
+			return
+		}
+	}
+
+	pipe(c, remote)
+}
+
+func (s *HTTPServer) Close() error {
+	var err error
+	if s.srv != nil {
+		err = s.srv.Close()
+	}
+	s.conns.closeAll()
+
+	return err
+}
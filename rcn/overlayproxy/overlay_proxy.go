@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package overlayproxy
+
+// overlayproxy package serves the local socks5 and http connect proxies,
+// which carry the connections of the apps into the overlay so that they can
+// reach the remote peers by overlay ip without a tun device on this machine
+//
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// dials an ip and a port through the overlay, the netstack or the interface
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// resolves host with the resolver of the system and dials the addresses in turn
+//
+func dialHost(ctx context.Context, dial DialFunc, host, port string) (net.Conn, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return dial(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := errors.New("no address for " + host)
+	for _, a := range addrs {
+		c, err := dial(ctx, "tcp", net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// copies between the two conns until both directions are done
+//
+func pipe(a, b net.Conn) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, _ = io.Copy(dst, src)
+		// let the other side see the end of the stream
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// conns accepted by a proxy, closed together by Close
+type conns struct {
+	m      map[net.Conn]struct{}
+	closed bool
+
+	mu *sync.Mutex
+}
+
+func newConns() *conns {
+	return &conns{
+		m:  make(map[net.Conn]struct{}),
+		mu: &sync.Mutex{},
+	}
+}
+
+// returns false when the proxy is closed
+//
+func (c *conns) add(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.m[conn] = struct{}{}
+	return true
+}
+
+func (c *conns) remove(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.m, conn)
+}
+
+func (c *conns) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for conn := range c.m {
+		conn.Close()
+	}
+	c.m = make(map[net.Conn]struct{})
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package overlayproxy
+
+// socks5 proxy of rfc 1928 without authentication, only the connect command
+//
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+)
+
+const (
+	socks5Version = 5
+
+	socks5NoAuth       = 0
+	socks5NoAcceptable = 0xff
+
+	socks5Connect = 1
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5HostUnreachable     = 4
+	socks5CommandNotSupported = 7
+	socks5AddrNotSupported    = 8
+
+	// the client has to send its request within this time
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+var errSocks5Version = errors.New("not a socks5 client")
+
+type Socks5Server struct {
+	dial DialFunc
+
+	ln    net.Listener
+	conns *conns
+
+	dotlog *dotlog.DotLog
+}
+
+func NewSocks5Server(dial DialFunc, dotlog *dotlog.DotLog) *Socks5Server {
+	return &Socks5Server{
+		dial:  dial,
+		conns: newConns(),
+
+		dotlog: dotlog,
+	}
+}
+
+// listens on addr, e.g. localhost:1080, and serves until Close
+//
+func (s *Socks5Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	s.dotlog.Logger.Infof("socks5 proxy listening on %s", ln.Addr().String())
+
+	go s.serve()
+
+	return nil
+}
+
+func (s *Socks5Server) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		if !s.conns.add(c) {
+			c.Close()
+			return
+		}
+
+		go func() {
+			defer s.conns.remove(c)
+
+			err := s.handle(c)
+			if err != nil {
+				s.dotlog.Logger.Debugf("socks5 proxy of %s, %s", c.RemoteAddr().String(), err.Error())
+			}
+		}()
+	}
+}
+
+func (s *Socks5Server) handle(c net.Conn) error {
+	defer c.Close()
+
+	_ = c.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	br := bufio.NewReader(c)
+
+	err := s.negotiate(br, c)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := s.readRequest(br, c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	remote, err := dialHost(ctx, s.dial, host, port)
+	cancel()
+	if err != nil {
+		_ = writeSocks5Reply(c, socks5HostUnreachable, nil)
+		return fmt.Errorf("failed to dial %s, %w", net.JoinHostPort(host, port), err)
+	}
+
+	err = writeSocks5Reply(c, socks5Succeeded, remote.LocalAddr())
+	if err != nil {
+		remote.Close()
+		return err
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	// the client may have sent data right after the request
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err := remote.Write(b); err != nil {
+			remote.Close()
+			return err
+		}
+	}
+
+	pipe(c, remote)
+
+	return nil
+}
+
+// selects no authentication, the only method supported
+//
+func (s *Socks5Server) negotiate(br *bufio.Reader, c net.Conn) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return errSocks5Version
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			_, err := c.Write([]byte{socks5Version, socks5NoAuth})
+			return err
+		}
+	}
+
+	_, _ = c.Write([]byte{socks5Version, socks5NoAcceptable})
+	return errors.New("the client requires authentication")
+}
+
+func (s *Socks5Server) readRequest(br *bufio.Reader, c net.Conn) (string, string, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", "", errSocks5Version
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		b := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", "", err
+		}
+		host = net.IP(b).String()
+	case socks5AddrIPv6:
+		b := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", "", err
+		}
+		host = net.IP(b).String()
+	case socks5AddrDomain:
+		l, err := br.ReadByte()
+		if err != nil {
+			return "", "", err
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return "", "", err
+		}
+		host = string(b)
+	default:
+		_ = writeSocks5Reply(c, socks5AddrNotSupported, nil)
+		return "", "", fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(br, p); err != nil {
+		return "", "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(p)))
+
+	if hdr[1] != socks5Connect {
+		_ = writeSocks5Reply(c, socks5CommandNotSupported, nil)
+		return "", "", fmt.Errorf("unsupported command %d", hdr[1])
+	}
+
+	return host, port, nil
+}
+
+// replies with the bound address, 0.0.0.0:0 when unknown
+//
+func writeSocks5Reply(c net.Conn, code byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if a, ok := bound.(*net.TCPAddr); ok {
+		ip = a.IP
+		port = a.Port
+	}
+
+	b := []byte{socks5Version, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+
+	_, err := c.Write(b)
+	return err
+}
+
+func (s *Socks5Server) Close() error {
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	s.conns.closeAll()
+
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package rcn
+
+import (
+	"net"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/iface"
+	"github.com/Notch-Technologies/dotshake/iface/filter"
+)
+
+// compiling the packet filter again, for the tags pushed by the server
+const filterInterval = 30 * time.Second
+
+// keeps the packet filter in sync with the policy and the remote peers until Close
+//
+func (r *Rcn) watchFilter() {
+	ticker := time.NewTicker(filterInterval)
+	defer ticker.Stop()
+
+	for {
+		r.applyFilter()
+
+		select {
+		case <-r.closed:
+			return
+		case <-ticker.C:
+		case <-r.filterRefresh:
+		}
+	}
+}
+
+// tells watchFilter that the policy or the remote peers have changed
+//
+func (r *Rcn) refreshFilter() {
+	select {
+	case r.filterRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// compiles the policy of the client config against the remote peers and sets it on the interface.
+// an invalid policy drops all the new connections but the always accepted ones rather than leaving this machine open
+//
+func (r *Rcn) applyFilter() {
+	// nil when the machine could not be fetched
+	if r.iface == nil {
+		return
+	}
+
+	r.mu.Lock()
+	policy := r.clientConf.PacketFilter
+	r.mu.Unlock()
+
+	self := r.overlayIPs()
+	rs, err := filter.Compile(policy, self, r.filterPeers())
+	if err != nil {
+		r.dotlog.Logger.Errorf("invalid packet filter, dropping all the new connections from the remote peers, %s", err.Error())
+		rs, _ = filter.Compile(&filter.Policy{}, self, nil)
+	}
+
+	// the interface is being removed
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+
+	err = iface.SetFilter(r.iface.Tun, rs)
+	if err != nil {
+		r.dotlog.Logger.Errorf("failed to set the packet filter, %s", err.Error())
+	}
+}
+
+// the overlay addresses of this machine
+//
+func (r *Rcn) overlayIPs() []net.IP {
+	ips := []net.IP{}
+	if ip := net.ParseIP(r.iface.IP); ip != nil {
+		ips = append(ips, ip)
+	}
+	if ip6, _, err := net.ParseCIDR(r.iface.IPv6); err == nil {
+		ips = append(ips, ip6)
+	}
+	return ips
+}
+
+// the remote peers with the tags pushed by the server and the ones of the client config
+//
+func (r *Rcn) filterPeers() []filter.Peer {
+	tags, err := filter.ParseTags(r.serverClient.PeerTags())
+	if err != nil {
+		r.dotlog.Logger.Warnf("ignoring the peer tags from the server, %s", err.Error())
+	}
+
+	r.mu.Lock()
+	for peer, t := range r.clientConf.PeerTags {
+		tags[peer] = append(tags[peer], t...)
+	}
+	r.mu.Unlock()
+
+	peers := []filter.Peer{}
+	for mk, ips := range r.cp.RemoteOverlayIPs() {
+		p := filter.Peer{MachineKey: mk, IPs: ips, Tags: tags[mk]}
+		for _, ip := range ips {
+			p.Tags = append(p.Tags, tagsOf(tags, ip)...)
+		}
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
+// the tags keyed by ip
+//
+func tagsOf(tags map[string][]string, ip net.IP) []string {
+	var t []string
+	for peer, tt := range tags {
+		if peerIP := net.ParseIP(peer); peerIP != nil && peerIP.Equal(ip) {
+			t = append(t, tt...)
+		}
+	}
+	return t
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+// data path between wireguard and the conn to the remote peer
+// through the loopback socket, used unless the userspace device has its own bind.
+//
+// packets from wireguard are read from the local conn in batches (recvmmsg on linux)
+// and written to the remote conn in batches as well (sendmmsg on linux) when it is
+// a udp socket or a direct conn, one by one to ice and relay conns. packets from
+// the remote conn are queued and written to wireguard in batches by a single writer.
+// buffers are pooled, and read errors back off instead of spinning
+//
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/backoff"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// larger than the wireguard messages of the largest tunnel mtu probed
+	maxPacketSize = 1500
+	// packets read or written with one system call
+	batchSize = 64
+	// packets from the remote conns waiting for the writer to wireguard
+	toLocalQueueSize = 512
+
+	minErrorBackoff = 10 * time.Millisecond
+	maxErrorBackoff = 1 * time.Second
+)
+
+type packet struct {
+	buf []byte
+	n   int
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &packet{buf: make([]byte, maxPacketSize)}
+	},
+}
+
+func getPacket() *packet {
+	return packetPool.Get().(*packet)
+}
+
+func putPacket(p *packet) {
+	p.n = 0
+	packetPool.Put(p)
+}
+
+func newBatch() []ipv4.Message {
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+	}
+	return msgs
+}
+
+// conns to the remote peer which write the packets of msgs at once to their own address,
+// e.g. the direct conns of the prober
+//
+type batchWriter interface {
+	WriteBatch(msgs []ipv4.Message) (int, error)
+}
+
+// a connected udp socket
+//
+type udpBatchWriter struct {
+	pc *ipv4.PacketConn
+}
+
+func (u *udpBatchWriter) WriteBatch(msgs []ipv4.Message) (int, error) {
+	for i := range msgs {
+		msgs[i].Addr = nil
+	}
+	return writeBatch(u.pc, msgs)
+}
+
+// nil when the packets have to be written to remote one by one
+//
+func remoteBatchWriter(remote net.Conn) batchWriter {
+	switch c := remote.(type) {
+	case batchWriter:
+		return c
+	case *net.UDPConn:
+		if c.RemoteAddr() != nil {
+			return &udpBatchWriter{pc: ipv4.NewPacketConn(c)}
+		}
+	}
+	return nil
+}
+
+// sleeps after an error so that a broken conn does not spin,
+// returns false when ctx is done meanwhile
+//
+func waitAfterError(ctx context.Context, b *backoff.Backoff) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(b.Duration()):
+		return true
+	}
+}
+
+func (w *WireProxy) monLocalToRemoteProxy() {
+	pc := ipv4.NewPacketConn(w.localConn)
+	msgs := newBatch()
+	// the packets of msgs cut to their length
+	out := make([]ipv4.Message, batchSize)
+	for i := range out {
+		out[i].Buffers = make([][]byte, 1)
+	}
+	eb := backoff.NewBackoff(minErrorBackoff, maxErrorBackoff)
+
+	// the batch writer of the remote conn, kept until it is replaced
+	var (
+		lastRemote net.Conn
+		bw         batchWriter
+	)
+
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			if w.ctx.Err() != nil || isClosedConnError(err) {
+				return
+			}
+
+			w.dotlog.Logger.Errorf("failed to read from wireguard for [%s], %s", w.remoteIp, err.Error())
+			w.traffic.txError(1)
+			if !waitAfterError(w.ctx, eb) {
+				return
+			}
+			continue
+		}
+		eb.Reset()
+
+		remote := w.getRemoteConn()
+		if remote == nil {
+			w.traffic.txError(n)
+			continue
+		}
+		if w.IsNoProxy() {
+			continue
+		}
+
+		if remote != lastRemote {
+			lastRemote, bw = remote, remoteBatchWriter(remote)
+		}
+
+		if bw != nil {
+			for i, m := range msgs[:n] {
+				out[i].Buffers[0] = m.Buffers[0][:m.N]
+			}
+
+			written, err := bw.WriteBatch(out[:n])
+			for _, m := range out[:written] {
+				w.traffic.tx(len(m.Buffers[0]))
+			}
+			if err != nil {
+				// wireguard retransmits
+				w.dotlog.Logger.Debugf("failed to write to [%s], %s", w.remoteIp, err.Error())
+				w.traffic.txError(n - written)
+			}
+			continue
+		}
+
+		for i, m := range msgs[:n] {
+			_, err = remote.Write(m.Buffers[0][:m.N])
+			if err != nil {
+				// wireguard retransmits, the rest of the batch would most likely fail too
+				w.dotlog.Logger.Debugf("failed to write to [%s], %s", w.remoteIp, err.Error())
+				w.traffic.txError(n - i)
+				break
+			}
+			w.traffic.tx(m.N)
+		}
+	}
+}
+
+func (w *WireProxy) monRemoteToLocalProxy(ctx context.Context, remote net.Conn) {
+	eb := backoff.NewBackoff(minErrorBackoff, maxErrorBackoff)
+
+	for {
+		p := getPacket()
+
+		n, err := remote.Read(p.buf)
+		if err != nil {
+			putPacket(p)
+
+			if ctx.Err() != nil || isClosedConnError(err) {
+				w.dotlog.Logger.Debugf("stop proxying [%s] from %s", w.remoteIp, remote.RemoteAddr().String())
+				return
+			}
+
+			w.dotlog.Logger.Errorf("failed to read from [%s], %s", w.remoteIp, err.Error())
+			w.traffic.rxError(1)
+			if !waitAfterError(ctx, eb) {
+				return
+			}
+			continue
+		}
+		eb.Reset()
+		p.n = n
+
+		// replaced while reading
+		if ctx.Err() != nil {
+			putPacket(p)
+			return
+		}
+
+		if isControlPacket(p.buf[:n]) {
+			w.handleControl(remote, p.buf[:n])
+			putPacket(p)
+			continue
+		}
+
+		if w.IsNoProxy() {
+			putPacket(p)
+			continue
+		}
+
+		if w.bindEP != nil {
+			if w.bind.Deliver(w.bindEP, p.buf[:n]) {
+				w.traffic.rx(n)
+			} else {
+				w.traffic.rxError(1)
+			}
+			putPacket(p)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			putPacket(p)
+			return
+		case w.toLocal <- p:
+		}
+	}
+}
+
+// writes the queued packets to wireguard, as many as are queued up to batchSize at once
+//
+func (w *WireProxy) writeToLocal() {
+	pc := ipv4.NewPacketConn(w.localConn)
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+	pkts := make([]*packet, 0, batchSize)
+	eb := backoff.NewBackoff(minErrorBackoff, maxErrorBackoff)
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case p := <-w.toLocal:
+			pkts = append(pkts, p)
+		}
+
+	fill:
+		for len(pkts) < batchSize {
+			select {
+			case p := <-w.toLocal:
+				pkts = append(pkts, p)
+			default:
+				break fill
+			}
+		}
+
+		for i, p := range pkts {
+			msgs[i].Buffers[0] = p.buf[:p.n]
+		}
+
+		written, err := writeBatch(pc, msgs[:len(pkts)])
+
+		for i, p := range pkts {
+			if i < written {
+				w.traffic.rx(p.n)
+			}
+			putPacket(p)
+		}
+		w.traffic.rxError(len(pkts) - written)
+		pkts = pkts[:0]
+
+		if err != nil {
+			if w.ctx.Err() != nil || isClosedConnError(err) {
+				return
+			}
+
+			w.dotlog.Logger.Errorf("failed to write to wireguard for [%s], %s", w.remoteIp, err.Error())
+			if !waitAfterError(w.ctx, eb) {
+				return
+			}
+			continue
+		}
+		eb.Reset()
+	}
+}
+
+// sendmmsg may write a part of the batch, writes the rest until all of them are written.
+// returns how many of them have been written
+//
+func writeBatch(pc *ipv4.PacketConn, msgs []ipv4.Message) (int, error) {
+	written := 0
+	for written < len(msgs) {
+		n, err := pc.WriteBatch(msgs[written:], 0)
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
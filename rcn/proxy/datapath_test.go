@@ -0,0 +1,273 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+)
+
+// about the size of a wireguard message of a full tunnel mtu
+const benchPacketSize = 1400
+
+func testLog() *dotlog.DotLog {
+	return &dotlog.DotLog{Logger: zap.NewNop().Sugar()}
+}
+
+func listenLoopback(tb testing.TB) *net.UDPConn {
+	tb.Helper()
+
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func dialLoopback(tb testing.TB, to *net.UDPConn) *net.UDPConn {
+	tb.Helper()
+
+	c, err := net.DialUDP("udp4", nil, to.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+// the ends of the data path: wireguard, which talks to the local conn of the proxy,
+// and the remote peer, which talks to the remote conn
+type dataPathEnds struct {
+	wg    *net.UDPConn
+	local *net.UDPConn
+
+	peer   *net.UDPConn
+	remote *net.UDPConn
+}
+
+func newDataPathEnds(tb testing.TB) *dataPathEnds {
+	tb.Helper()
+
+	e := &dataPathEnds{wg: listenLoopback(tb), peer: listenLoopback(tb)}
+	e.local = dialLoopback(tb, e.wg)
+	e.remote = dialLoopback(tb, e.peer)
+	return e
+}
+
+func (e *dataPathEnds) close() {
+	e.wg.Close()
+	e.local.Close()
+	e.peer.Close()
+	e.remote.Close()
+}
+
+// how long to wait for the rest of the packets once none arrives, they are counted as lost
+const transferIdleTimeout = 100 * time.Millisecond
+
+// sends len(msgs) packets from src to dst through the proxy, returns how many of them have arrived.
+// the pings of the proxy are skipped
+//
+func transfer(tb testing.TB, src, dst *ipv4.PacketConn, to net.Addr, msgs []ipv4.Message) int {
+	tb.Helper()
+
+	for i := range msgs {
+		msgs[i].Addr = to
+		msgs[i].Buffers[0] = msgs[i].Buffers[0][:benchPacketSize]
+	}
+	_, err := writeBatch(src, msgs)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for i := range msgs {
+		msgs[i].Buffers[0] = msgs[i].Buffers[0][:cap(msgs[i].Buffers[0])]
+	}
+
+	received := 0
+	for received < len(msgs) {
+		dst.SetReadDeadline(time.Now().Add(transferIdleTimeout))
+		n, err := dst.ReadBatch(msgs[received:], 0)
+		if err != nil {
+			// the socket buffers or the proxy queues have overflowed
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			tb.Fatal(err)
+		}
+		for _, m := range msgs[received : received+n] {
+			if !isControlPacket(m.Buffers[0][:m.N]) {
+				received++
+			}
+		}
+	}
+
+	return received
+}
+
+// one packet per system call in both directions, as the proxy did before batching
+//
+func startSinglePacketPath(e *dataPathEnds) (stop func()) {
+	pipe := func(from, to net.Conn) {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := from.Read(buf)
+			if err != nil {
+				return
+			}
+			_, err = to.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	go pipe(e.local, e.remote)
+	go pipe(e.remote, e.local)
+
+	return e.close
+}
+
+func startBatchPath(tb testing.TB, e *dataPathEnds) (stop func()) {
+	w := NewWireProxy(nil, "", "", "", "", "", testLog(), nil)
+	w.localConn = e.local
+	w.startMon()
+	w.setRemoteConn(e.remote, false, false)
+
+	return func() {
+		w.cancelFunc()
+		e.close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := w.wait(ctx)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// compares the proxy reading and writing one packet per system call with the batched data path.
+// each op is one packet from the remote peer to wireguard and one back.
+// packets lost on the way are counted instead of failing, pkts/s is of the delivered ones
+//
+func BenchmarkDataPath(b *testing.B) {
+	paths := []struct {
+		name  string
+		start func(b *testing.B, e *dataPathEnds) func()
+	}{
+		{"single", func(b *testing.B, e *dataPathEnds) func() { return startSinglePacketPath(e) }},
+		{"batch", func(b *testing.B, e *dataPathEnds) func() { return startBatchPath(b, e) }},
+	}
+
+	for _, p := range paths {
+		b.Run(p.name, func(b *testing.B) {
+			e := newDataPathEnds(b)
+			stop := p.start(b, e)
+			defer stop()
+
+			wg, peer := ipv4.NewPacketConn(e.wg), ipv4.NewPacketConn(e.peer)
+			msgs := newBatch()
+
+			b.SetBytes(2 * benchPacketSize)
+			b.ResetTimer()
+
+			delivered := 0
+			for sent := 0; sent < b.N; sent += batchSize {
+				n := batchSize
+				if b.N-sent < n {
+					n = b.N - sent
+				}
+
+				delivered += transfer(b, peer, wg, e.remote.LocalAddr(), msgs[:n])
+				delivered += transfer(b, wg, peer, e.local.LocalAddr(), msgs[:n])
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(delivered)/b.Elapsed().Seconds(), "pkts/s")
+			b.ReportMetric(100*float64(2*b.N-delivered)/float64(2*b.N), "%loss")
+		})
+	}
+}
+
+// the remote conns which write in batches
+//
+func TestRemoteBatchWriter(t *testing.T) {
+	peer := listenLoopback(t)
+	defer peer.Close()
+	connected := dialLoopback(t, peer)
+	defer connected.Close()
+	unconnected := listenLoopback(t)
+	defer unconnected.Close()
+	pipe, pipePeer := net.Pipe()
+	defer pipe.Close()
+	defer pipePeer.Close()
+
+	tests := []struct {
+		name   string
+		remote net.Conn
+		batch  bool
+	}{
+		{"connected udp socket", connected, true},
+		{"unconnected udp socket", unconnected, false},
+		{"stream", pipe, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remoteBatchWriter(tt.remote) != nil; got != tt.batch {
+				t.Fatalf("got %v, want %v", got, tt.batch)
+			}
+		})
+	}
+}
+
+// every packet of a batch from wireguard arrives at the remote peer in order
+//
+func TestDataPathBatchToRemote(t *testing.T) {
+	e := newDataPathEnds(t)
+	stop := startBatchPath(t, e)
+	defer stop()
+
+	wg, peer := ipv4.NewPacketConn(e.wg), ipv4.NewPacketConn(e.peer)
+
+	// a batch is small enough for the socket buffers of the loopback
+	msgs := newBatch()
+	for i := range msgs {
+		msgs[i].Addr = e.local.LocalAddr()
+		msgs[i].Buffers[0] = []byte{0xff, byte(i)}
+	}
+	_, err := writeBatch(wg, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := newBatch()
+	received := []byte{}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(received) < batchSize {
+		n, err := peer.ReadBatch(got, 0)
+		if err != nil {
+			t.Fatalf("%d of %d packets have arrived, %s", len(received), batchSize, err.Error())
+		}
+		for _, m := range got[:n] {
+			b := m.Buffers[0][:m.N]
+			if isControlPacket(b) {
+				continue
+			}
+			received = append(received, b[1])
+		}
+	}
+
+	for i, b := range received {
+		if int(b) != i {
+			t.Fatalf("packet %d arrived at %d", b, i)
+		}
+	}
+}
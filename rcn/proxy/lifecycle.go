@@ -0,0 +1,146 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+// every goroutine of the wire proxy is tracked, so that Stop can close
+// the conns they are blocked on, wait for them and report the ones left over
+//
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+func (w *WireProxy) goTracked(name string, fn func()) {
+	w.runningMu.Lock()
+	w.running[name]++
+	w.runningMu.Unlock()
+
+	w.goroutines.Add(1)
+	go func() {
+		defer func() {
+			w.runningMu.Lock()
+			w.running[name]--
+			if w.running[name] == 0 {
+				delete(w.running, name)
+			}
+			w.runningMu.Unlock()
+
+			w.goroutines.Done()
+		}()
+
+		fn()
+	}()
+}
+
+func (w *WireProxy) goRemoteReader(ctx context.Context, remote net.Conn) {
+	w.runningMu.Lock()
+	w.readConns[remote]++
+	w.runningMu.Unlock()
+
+	w.goTracked("remote reader", func() {
+		defer func() {
+			w.runningMu.Lock()
+			w.readConns[remote]--
+			if w.readConns[remote] == 0 {
+				delete(w.readConns, remote)
+			}
+			w.runningMu.Unlock()
+		}()
+
+		w.monRemoteToLocalProxy(ctx, remote)
+	})
+}
+
+// names of the goroutines still running, with their count
+//
+func (w *WireProxy) Running() []string {
+	w.runningMu.Lock()
+	defer w.runningMu.Unlock()
+
+	names := make([]string, 0, len(w.running))
+	for name, n := range w.running {
+		names = append(names, fmt.Sprintf("%s x%d", name, n))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// stops proxying, closes the local conn and the remote conns being read
+// and waits until ctx is done for the goroutines to exit.
+// the wire proxy can not be started again
+//
+func (w *WireProxy) Stop(ctx context.Context) error {
+	w.cancelFunc()
+
+	w.mu.Lock()
+	localConn, bind, bindEP := w.localConn, w.bind, w.bindEP
+	remote := w.remoteConn
+	w.remoteConn = nil
+	if w.remoteCancel != nil {
+		w.remoteCancel()
+		w.remoteCancel = nil
+	}
+	w.mu.Unlock()
+
+	if bindEP != nil {
+		bind.Unregister(bindEP)
+	}
+
+	// unblocks the reader of the local conn
+	if localConn != nil {
+		localConn.Close()
+	}
+
+	// unblocks the readers of the remote conns, the replaced ones as well
+	w.runningMu.Lock()
+	conns := make([]net.Conn, 0, len(w.readConns)+1)
+	for c := range w.readConns {
+		conns = append(conns, c)
+	}
+	w.runningMu.Unlock()
+	if remote != nil {
+		conns = append(conns, remote)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+
+	err := w.wait(ctx)
+	if err != nil {
+		w.dotlog.Logger.Warnf("wire proxy of [%s] has left goroutines, %s", w.remoteIp, err.Error())
+	}
+
+	if localConn == nil && bindEP == nil {
+		w.dotlog.Logger.Errorf("error is unexpected, you are most likely referring to locallConn without calling the setup function")
+		return err
+	}
+
+	rerr := w.iface.RemoveRemotePeer(w.wgIface, w.remoteIp, w.remoteWgPubKey)
+	if rerr != nil {
+		return rerr
+	}
+
+	return err
+}
+
+func (w *WireProxy) wait(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		w.goroutines.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("still running after %s: %s", ctx.Err().Error(), strings.Join(w.Running(), ", "))
+	}
+}
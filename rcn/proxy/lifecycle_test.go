@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/iface"
+	"go.uber.org/goleak"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// a netstack interface, wireguard is configured in this process without any privilege
+//
+func newTestIface(t *testing.T) *iface.Iface {
+	t.Helper()
+
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := iface.UserspaceNetworking + "-proxy-test"
+	i := iface.NewIface(tun, k.String(), "100.64.0.1/10", "100.64.0.0/10", testLog())
+	err = iface.CreateIface(i, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { iface.RemoveIface(tun, testLog()) })
+
+	return i
+}
+
+func TestWireProxyStopLeavesNoGoroutines(t *testing.T) {
+	i := newTestIface(t)
+
+	remoteKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the goroutines of the interface live until the cleanup
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	paths := []struct {
+		name string
+		// the loopback socket to wireguard, the bind of the interface is used when nil
+		local func(t *testing.T) *net.UDPConn
+	}{
+		{"bind", func(t *testing.T) *net.UDPConn { return nil }},
+		{"loopback", func(t *testing.T) *net.UDPConn {
+			wg := listenLoopback(t)
+			t.Cleanup(func() { wg.Close() })
+			return dialLoopback(t, wg)
+		}},
+	}
+
+	for _, p := range paths {
+		t.Run(p.name, func(t *testing.T) {
+			for n := 0; n < 20; n++ {
+				w := NewWireProxy(i, remoteKey.PublicKey().String(), "100.64.0.2/32", i.Tun, "", "", testLog(), nil)
+				if local := p.local(t); local != nil {
+					// setup keeps the local conn it already has
+					w.localConn = local
+				}
+
+				remote, peer := net.Pipe()
+				err := w.StartRelayProxy(remote)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the reader of the replaced conn has to exit as well
+				switched, switchedPeer := net.Pipe()
+				w.SwitchRemoteConn(switched, true)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err = w.Stop(ctx)
+				cancel()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if running := w.Running(); len(running) != 0 {
+					t.Fatalf("still running after Stop, %v", running)
+				}
+
+				peer.Close()
+				switchedPeer.Close()
+			}
+		})
+	}
+}
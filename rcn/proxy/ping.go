@@ -0,0 +1,176 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+// the wire proxies ping each other through the conn in use to measure
+// the round trip time and the loss of the path.
+//
+// a ping, like the other control packets of the wire proxy, starts with pingMagic,
+// so it is neither a stun message, which the ice agent would take, nor a wireguard
+// message, whose first byte is the message type 1 to 4 followed by three zero bytes.
+// older peers hand it to wireguard, which drops it
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pingInterval = 2 * time.Second
+	// a ping without a reply for this long is lost
+	pingTimeout = 5 * time.Second
+
+	pingLen = 12
+)
+
+var pingMagic = []byte("dsp")
+
+// types of the control packets
+const (
+	pingRequest byte = 1
+	pingReply   byte = 2
+	mtuProbe    byte = 3
+	mtuAck      byte = 4
+)
+
+type PathStats struct {
+	// round trip time of the latest reply, zero when no reply has arrived yet
+	RTT time.Duration
+	// pings sent and pings lost since the wire proxy has been created
+	Sent uint64
+	Lost uint64
+}
+
+type pinger struct {
+	pending map[uint64]time.Time
+	nextID  uint64
+
+	stats PathStats
+
+	mu *sync.Mutex
+}
+
+func newPinger() *pinger {
+	return &pinger{
+		pending: make(map[uint64]time.Time),
+		mu:      &sync.Mutex{},
+	}
+}
+
+func isControlPacket(b []byte) bool {
+	return len(b) >= pingLen && bytes.Equal(b[:len(pingMagic)], pingMagic)
+}
+
+func encodePing(t byte, id uint64) []byte {
+	b := make([]byte, pingLen)
+	copy(b, pingMagic)
+	b[len(pingMagic)] = t
+	binary.BigEndian.PutUint64(b[4:], id)
+	return b
+}
+
+func (p *pinger) request() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	p.pending[p.nextID] = time.Now()
+	p.stats.Sent++
+
+	return encodePing(pingRequest, p.nextID)
+}
+
+func (p *pinger) reply(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sentAt, ok := p.pending[id]
+	if !ok {
+		return
+	}
+	delete(p.pending, id)
+
+	p.stats.RTT = time.Since(sentAt)
+}
+
+func (p *pinger) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, sentAt := range p.pending {
+		if time.Since(sentAt) > pingTimeout {
+			delete(p.pending, id)
+			p.stats.Lost++
+		}
+	}
+}
+
+func (p *pinger) getStats() PathStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+func (w *WireProxy) PathStats() PathStats {
+	return w.pinger.getStats()
+}
+
+func (w *WireProxy) startPing() {
+	w.startPingOnce.Do(func() {
+		w.goTracked("pinger", w.pingLoop)
+	})
+}
+
+func (w *WireProxy) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			w.pinger.expire()
+
+			remote := w.getRemoteConn()
+			if remote == nil {
+				continue
+			}
+
+			_, err := remote.Write(w.pinger.request())
+			if err != nil {
+				w.dotlog.Logger.Debugf("failed to ping [%s], %s", w.remoteIp, err.Error())
+			}
+		}
+	}
+}
+
+// answers a ping or an mtu probe of the remote peer through the conn it has arrived on
+//
+func (w *WireProxy) handleControl(remote net.Conn, b []byte) {
+	id := binary.BigEndian.Uint64(b[4:])
+
+	switch b[len(pingMagic)] {
+	case pingRequest:
+		_, err := remote.Write(encodePing(pingReply, id))
+		if err != nil {
+			w.dotlog.Logger.Debugf("failed to reply to the ping of [%s], %s", w.remoteIp, err.Error())
+		}
+	case pingReply:
+		w.pinger.reply(id)
+	case mtuProbe:
+		_, err := remote.Write(encodePing(mtuAck, id))
+		if err != nil {
+			w.dotlog.Logger.Debugf("failed to ack the mtu probe of [%s], %s", w.remoteIp, err.Error())
+		}
+	case mtuAck:
+		w.mtuProber.ack(id)
+	}
+}
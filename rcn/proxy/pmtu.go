@@ -0,0 +1,136 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+// path mtu discovery with padded probes through the conn in use.
+// the probes are control packets of the wire proxy padded to the size of a
+// wireguard message, the remote wire proxy acks each probe which has arrived.
+// the udp mux sets the don't fragment bit, so oversized probes are dropped on the way
+//
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/wireguard"
+)
+
+const (
+	// header and authentication tag of a wireguard data message
+	wgMessageOverhead = 32
+
+	mtuProbeTimeout  = 1 * time.Second
+	mtuProbeAttempts = 2
+)
+
+var errNoRemoteConn = errors.New("no conn to the remote peer")
+
+type mtuProber struct {
+	pending map[uint64]chan struct{}
+	nextID  uint64
+
+	mu *sync.Mutex
+}
+
+func newMTUProber() *mtuProber {
+	return &mtuProber{
+		pending: make(map[uint64]chan struct{}),
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (p *mtuProber) register() (uint64, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	ch := make(chan struct{})
+	p.pending[p.nextID] = ch
+
+	return p.nextID, ch
+}
+
+func (p *mtuProber) unregister(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, id)
+}
+
+func (p *mtuProber) ack(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, ok := p.pending[id]
+	if !ok {
+		return
+	}
+	delete(p.pending, id)
+	close(ch)
+}
+
+// returns the largest tunnel mtu the path in use carries, searched between
+// wireguard.DefaultMTU and the mtu whose wireguard messages are maxDatagram long
+//
+func (w *WireProxy) ProbeMTU(maxDatagram int) (int, error) {
+	lo := wireguard.DefaultMTU + wgMessageOverhead
+	hi := maxDatagram
+
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+
+		ok, err := w.probeDatagram(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return lo - wgMessageOverhead, nil
+}
+
+// sends a probe of size bytes and reports whether it has been acked
+//
+func (w *WireProxy) probeDatagram(size int) (bool, error) {
+	for attempt := 0; attempt < mtuProbeAttempts; attempt++ {
+		remote := w.getRemoteConn()
+		if remote == nil {
+			return false, errNoRemoteConn
+		}
+
+		id, ackCh := w.mtuProber.register()
+
+		b := make([]byte, size)
+		copy(b, encodePing(mtuProbe, id))
+
+		_, err := remote.Write(b)
+		if err != nil {
+			w.mtuProber.unregister(id)
+			if isClosedConnError(err) {
+				return false, err
+			}
+			// e.g. larger than the mtu of the local link
+			return false, nil
+		}
+
+		select {
+		case <-w.ctx.Done():
+			w.mtuProber.unregister(id)
+			return false, w.ctx.Err()
+		case <-ackCh:
+			return true, nil
+		case <-time.After(mtuProbeTimeout):
+			w.mtuProber.unregister(id)
+		}
+	}
+
+	return false, nil
+}
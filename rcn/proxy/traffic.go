@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+// counters of the wireguard packets proxied for the remote peer.
+// rx is from the remote peer to wireguard, tx is from wireguard to the remote peer.
+// control packets are not counted
+//
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+type TrafficStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	// packets read from the remote conns but not handed to wireguard,
+	// failed reads and writes and the packets dropped by the full queues
+	RxErrors uint64
+
+	TxBytes   uint64
+	TxPackets uint64
+	// packets from wireguard which could not be written to the remote conn
+	TxErrors uint64
+}
+
+// returns the traffic since prev, s itself when the counters have started over
+//
+func (s TrafficStats) Sub(prev TrafficStats) TrafficStats {
+	if s.RxBytes < prev.RxBytes || s.RxPackets < prev.RxPackets || s.RxErrors < prev.RxErrors ||
+		s.TxBytes < prev.TxBytes || s.TxPackets < prev.TxPackets || s.TxErrors < prev.TxErrors {
+		return s
+	}
+
+	return TrafficStats{
+		RxBytes:   s.RxBytes - prev.RxBytes,
+		RxPackets: s.RxPackets - prev.RxPackets,
+		RxErrors:  s.RxErrors - prev.RxErrors,
+
+		TxBytes:   s.TxBytes - prev.TxBytes,
+		TxPackets: s.TxPackets - prev.TxPackets,
+		TxErrors:  s.TxErrors - prev.TxErrors,
+	}
+}
+
+func (s TrafficStats) Add(o TrafficStats) TrafficStats {
+	return TrafficStats{
+		RxBytes:   s.RxBytes + o.RxBytes,
+		RxPackets: s.RxPackets + o.RxPackets,
+		RxErrors:  s.RxErrors + o.RxErrors,
+
+		TxBytes:   s.TxBytes + o.TxBytes,
+		TxPackets: s.TxPackets + o.TxPackets,
+		TxErrors:  s.TxErrors + o.TxErrors,
+	}
+}
+
+type trafficCounters struct {
+	rxBytes   uint64
+	rxPackets uint64
+	rxErrors  uint64
+
+	txBytes   uint64
+	txPackets uint64
+	txErrors  uint64
+}
+
+func (c *trafficCounters) rx(n int) {
+	atomic.AddUint64(&c.rxBytes, uint64(n))
+	atomic.AddUint64(&c.rxPackets, 1)
+}
+
+func (c *trafficCounters) rxError(packets int) {
+	atomic.AddUint64(&c.rxErrors, uint64(packets))
+}
+
+func (c *trafficCounters) tx(n int) {
+	atomic.AddUint64(&c.txBytes, uint64(n))
+	atomic.AddUint64(&c.txPackets, 1)
+}
+
+func (c *trafficCounters) txError(packets int) {
+	atomic.AddUint64(&c.txErrors, uint64(packets))
+}
+
+func (c *trafficCounters) stats() TrafficStats {
+	return TrafficStats{
+		RxBytes:   atomic.LoadUint64(&c.rxBytes),
+		RxPackets: atomic.LoadUint64(&c.rxPackets),
+		RxErrors:  atomic.LoadUint64(&c.rxErrors),
+
+		TxBytes:   atomic.LoadUint64(&c.txBytes),
+		TxPackets: atomic.LoadUint64(&c.txPackets),
+		TxErrors:  atomic.LoadUint64(&c.txErrors),
+	}
+}
+
+// counters since the wire proxy has been created
+//
+func (w *WireProxy) TrafficStats() TrafficStats {
+	return w.traffic.stats()
+}
+
+// remote conn handed to the bind, which writes the packets from wireguard by itself
+//
+type countingConn struct {
+	net.Conn
+
+	traffic *trafficCounters
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.traffic.txError(1)
+		return n, err
+	}
+	c.traffic.tx(n)
+	return n, nil
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Notch-Technologies/dotshake/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// the allowed ips are replaced on the peer which wireguard already has,
+// its endpoint is kept
+//
+func TestWireProxyUpdateAllowedIPs(t *testing.T) {
+	i := newTestIface(t)
+
+	remoteKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := remoteKey.PublicKey()
+
+	w := NewWireProxy(i, pub.String(), "100.64.0.2/32", i.Tun, "", "", testLog(), nil)
+
+	// the peer is not on wireguard yet, the allowed ips are used once it is configured
+	err = w.UpdateAllowedIPs("100.64.0.2/32,10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers, _ := i.GetRemotePeers(); len(peers) != 0 {
+		t.Fatalf("peer has been added by the update, %v", peers)
+	}
+
+	remote, peer := net.Pipe()
+	defer peer.Close()
+	err = w.configureNoProxy(&addrConn{Conn: remote, remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.UpdateAllowedIPs("100.64.0.2/32,0.0.0.0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := i.GetRemotePeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].PublicKey != pub {
+		t.Fatalf("got peers %v, want only %s", peers, pub.String())
+	}
+
+	got := []string{}
+	for _, a := range peers[0].AllowedIPs {
+		got = append(got, a.String())
+	}
+	want := []string{"100.64.0.2/32", "0.0.0.0/0"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got allowed ips %v, want %v", got, want)
+	}
+
+	ep := peers[0].Endpoint
+	if ep == nil || !ep.IP.Equal(net.IPv4(192, 0, 2, 1)) || ep.Port != wireguard.WgPort {
+		t.Fatalf("endpoint has not been kept, %v", ep)
+	}
+}
+
+// a conn with the remote address of the ice candidate
+//
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -6,7 +6,10 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
+	"sync"
 
 	"github.com/Notch-Technologies/dotshake/dotlog"
 	"github.com/Notch-Technologies/dotshake/iface"
@@ -20,18 +23,49 @@ type WireProxy struct {
 	// proxy config
 	remoteWgPubKey string // remote peer wg pub key
 	remoteIp       string // remote peer ip
+	allowedIPs     string // allowed ips on wireguard, remoteIp until they are updated
 	wgIface        string // your wg iface
 	listenAddr     string // proxy addr
 	preSharedKey   string // your preshared key
 
+	// ice conn, relay conn or direct conn currently used to reach the remote peer
 	remoteConn net.Conn
-	localConn  net.Conn
+	localConn  *net.UDPConn
+	relayed    bool
+	// wireguard talks to the remote peer directly,
+	// remoteConn only carries the pings
+	noProxy bool
+
+	// stops the reader of remoteConn when it is replaced
+	remoteCancel context.CancelFunc
+	// packets read from the remote conns, written to wireguard in batches
+	toLocal chan *packet
+
+	// set instead of localConn for the userspace device,
+	// its bind exchanges the packets with the remote conn without the loopback socket
+	bind   *iface.ICEBind
+	bindEP *iface.VirtualEndpoint
+
+	startLocalOnce *sync.Once
+	mu             *sync.RWMutex
+	// serializes the configuration of the remote peer on wireguard
+	configMu *sync.Mutex
+
+	// goroutines Stop waits for, by name
+	goroutines *sync.WaitGroup
+	running    map[string]int
+	// remote conns with a running reader, closed by Stop to unblock them
+	readConns map[net.Conn]int
+	runningMu *sync.Mutex
+
+	pinger        *pinger
+	startPingOnce *sync.Once
+	mtuProber     *mtuProber
+
+	traffic *trafficCounters
 
 	agent *ice.Agent
 
-	// localProxyBuffer  []byte
-	// remoteProxyBuffer []byte
-
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 
@@ -56,16 +90,31 @@ func NewWireProxy(
 
 		remoteWgPubKey: remoteWgPubKey,
 		remoteIp:       remoteip,
+		allowedIPs:     remoteip,
 
 		wgIface:      wgiface,
 		listenAddr:   listenAddr,
 		preSharedKey: presharedkey,
 
-		// localProxyBuffer:  make([]byte, 1500),
-		// remoteProxyBuffer: make([]byte, 1500),
-
 		agent: agent,
 
+		toLocal: make(chan *packet, toLocalQueueSize),
+
+		startLocalOnce: &sync.Once{},
+		mu:             &sync.RWMutex{},
+		configMu:       &sync.Mutex{},
+
+		goroutines: &sync.WaitGroup{},
+		running:    make(map[string]int),
+		readConns:  make(map[net.Conn]int),
+		runningMu:  &sync.Mutex{},
+
+		pinger:        newPinger(),
+		startPingOnce: &sync.Once{},
+		mtuProber:     newMTUProber(),
+
+		traffic: &trafficCounters{},
+
 		ctx:        ctx,
 		cancelFunc: cancel,
 
@@ -73,9 +122,28 @@ func NewWireProxy(
 	}
 }
 
-func (w *WireProxy) setup(remote *ice.Conn) error {
-	w.remoteConn = remote
-	udpConn, err := net.Dial("udp", w.listenAddr)
+// the local conn to wireguard is kept while the remote conn is switched
+//
+func (w *WireProxy) setup() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.localConn != nil || w.bindEP != nil {
+		return nil
+	}
+
+	if b := w.iface.Bind(); b != nil {
+		w.bind = b
+		w.bindEP = b.Register()
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", w.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
 		return err
 	}
@@ -84,10 +152,89 @@ func (w *WireProxy) setup(remote *ice.Conn) error {
 	return nil
 }
 
-func (w *WireProxy) configureNoProxy() error {
+// replaces the conn to the remote peer, packets from the previous one are no longer proxied
+//
+func (w *WireProxy) setRemoteConn(remote net.Conn, relayed, noProxy bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.remoteCancel != nil {
+		w.remoteCancel()
+		w.remoteCancel = nil
+	}
+
+	// stopped, nothing is proxied anymore
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	w.remoteConn = remote
+	w.relayed = relayed
+	w.noProxy = noProxy
+
+	if w.bindEP != nil {
+		if noProxy {
+			w.bindEP.SetConn(nil)
+		} else {
+			w.bindEP.SetConn(&countingConn{Conn: remote, traffic: w.traffic})
+		}
+	}
+
+	if remote == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	w.remoteCancel = cancel
+	w.goRemoteReader(ctx, remote)
+	w.startPing()
+}
+
+func (w *WireProxy) getRemoteConn() net.Conn {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.remoteConn
+}
+
+// switches the conn to the remote peer without reconfiguring wireguard,
+// only while proxying. returns the previous conn to switch back to it later
+//
+func (w *WireProxy) SwitchRemoteConn(remote net.Conn, relayed bool) (net.Conn, bool) {
+	w.mu.RLock()
+	prev, prevRelayed := w.remoteConn, w.relayed
+	w.mu.RUnlock()
+
+	w.setRemoteConn(remote, relayed, false)
+
+	return prev, prevRelayed
+}
+
+func (w *WireProxy) RemoteConn() net.Conn {
+	return w.getRemoteConn()
+}
+
+func (w *WireProxy) IsNoProxy() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.noProxy
+}
+
+func (w *WireProxy) IsRelayed() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.relayed
+}
+
+func (w *WireProxy) configureNoProxy(remote net.Conn) error {
 	w.dotlog.Logger.Debugf("using no proxy")
 
-	udpAddr, err := net.ResolveUDPAddr("udp", w.remoteConn.RemoteAddr().String())
+	w.configMu.Lock()
+	defer w.configMu.Unlock()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", remote.RemoteAddr().String())
 	if err != nil {
 		return err
 	}
@@ -95,7 +242,7 @@ func (w *WireProxy) configureNoProxy() error {
 
 	err = w.iface.ConfigureToRemotePeer(
 		w.remoteWgPubKey,
-		w.remoteIp,
+		w.allowedIPs,
 		udpAddr,
 		wireguard.DefaultWgKeepAlive,
 		w.preSharedKey,
@@ -109,17 +256,35 @@ func (w *WireProxy) configureNoProxy() error {
 
 }
 
+// replaces the allowed ips of the remote peer on wireguard without renegotiating,
+// the configuration which follows uses them as well
+//
+func (w *WireProxy) UpdateAllowedIPs(allowedIPs string) error {
+	w.configMu.Lock()
+	defer w.configMu.Unlock()
+
+	w.allowedIPs = allowedIPs
+	if w.ctx.Err() != nil {
+		return nil
+	}
+
+	return w.iface.UpdatePeer(w.remoteWgPubKey, allowedIPs)
+}
+
 func (w *WireProxy) configureWireProxy() error {
 	w.dotlog.Logger.Debugf("using wire proxy")
 
-	udpAddr, err := net.ResolveUDPAddr(w.localConn.LocalAddr().Network(), w.localConn.LocalAddr().String())
+	w.configMu.Lock()
+	defer w.configMu.Unlock()
+
+	udpAddr, err := w.localEndpoint()
 	if err != nil {
 		return err
 	}
 
 	err = w.iface.ConfigureToRemotePeer(
 		w.remoteWgPubKey,
-		w.remoteIp,
+		w.allowedIPs,
 		udpAddr,
 		wireguard.DefaultWgKeepAlive,
 		w.preSharedKey,
@@ -132,20 +297,15 @@ func (w *WireProxy) configureWireProxy() error {
 	return nil
 }
 
-func (w *WireProxy) Stop() error {
-	w.cancelFunc()
-
-	if w.localConn == nil {
-		w.dotlog.Logger.Errorf("error is unexpected, you are most likely referring to locallConn without calling the setup function")
-		return nil
-	}
-
-	err := w.iface.RemoveRemotePeer(w.wgIface, w.remoteIp, w.remoteWgPubKey)
-	if err != nil {
-		return err
+// the endpoint of the remote peer on wireguard,
+// the virtual endpoint of the bind or the local conn
+//
+func (w *WireProxy) localEndpoint() (*net.UDPAddr, error) {
+	if w.bindEP != nil {
+		return w.bindEP.UDPAddr(), nil
 	}
 
-	return nil
+	return net.ResolveUDPAddr(w.localConn.LocalAddr().Network(), w.localConn.LocalAddr().String())
 }
 
 func shouldUseProxy(pair *ice.CandidatePair) bool {
@@ -170,6 +330,10 @@ func shouldUseProxy(pair *ice.CandidatePair) bool {
 	return true
 }
 
+func isClosedConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
 func IsPublicIP(ip net.IP) bool {
 	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() {
 		return false
@@ -178,7 +342,7 @@ func IsPublicIP(ip net.IP) bool {
 }
 
 func (w *WireProxy) StartProxy(remote *ice.Conn) error {
-	err := w.setup(remote)
+	err := w.setup()
 	if err != nil {
 		return err
 	}
@@ -194,74 +358,53 @@ func (w *WireProxy) StartProxy(remote *ice.Conn) error {
 		if err != nil {
 			return err
 		}
+		w.setRemoteConn(remote, false, false)
 		w.startMon()
 
 		return nil
 	}
 
-	err = w.configureNoProxy()
+	err = w.configureNoProxy(remote)
 	if err != nil {
 		return err
 	}
 
+	// wireguard talks to the remote peer directly, the ice conn is kept only for the pings
+	w.setRemoteConn(remote, false, true)
 	w.startMon()
 
 	return nil
 }
 
-func (w *WireProxy) startMon() {
-	w.dotlog.Logger.Debugf("starting monitoring proxy")
-	go w.monLocalToRemoteProxy()
-	go w.monRemoteToLocalProxy()
-}
+// proxies wireguard packets through the relay server,
+// used when ice can not connect to the remote peer at all
+//
+func (w *WireProxy) StartRelayProxy(remote net.Conn) error {
+	err := w.setup()
+	if err != nil {
+		return err
+	}
 
-func (w *WireProxy) monLocalToRemoteProxy() {
-	buf := make([]byte, 1500)
-	for {
-		select {
-		case <-w.ctx.Done():
-			return
-		default:
-			n, err := w.localConn.Read(buf)
-			if err != nil {
-				w.dotlog.Logger.Errorf("localConn cannot read remoteProxyBuffer [%s], size is %d", string(buf), n)
-				continue
-			}
-
-			_, err = w.remoteConn.Write(buf[:n])
-			if err != nil {
-				w.dotlog.Logger.Errorf("localConn cannot write remoteProxyBuffer [%s], size is %d", string(buf), n)
-				continue
-			}
-
-			// TODO: gathering buffer with dotmon
-			// w.dotlog.Logger.Debugf("remoteConn read remoteProxyBuffer [%s]", w.remoteProxyBuffer[:n])
-		}
+	err = w.configureWireProxy()
+	if err != nil {
+		return err
 	}
+
+	w.setRemoteConn(remote, true, false)
+	w.startMon()
+
+	return nil
 }
 
-func (w *WireProxy) monRemoteToLocalProxy() {
-	buf := make([]byte, 1500)
-	for {
-		select {
-		case <-w.ctx.Done():
-			w.dotlog.Logger.Errorf("close the local proxy. close the remote ip here [%s], ", w.remoteIp)
+func (w *WireProxy) startMon() {
+	w.startLocalOnce.Do(func() {
+		// the bind reads and writes wireguard packets by itself
+		if w.bindEP != nil || w.ctx.Err() != nil {
 			return
-		default:
-			n, err := w.remoteConn.Read(buf)
-			if err != nil {
-				w.dotlog.Logger.Errorf("remoteConn cannot read localProxyBuffer [%s], size is %d", string(buf), n)
-				continue
-			}
-
-			_, err = w.localConn.Write(buf[:n])
-			if err != nil {
-				w.dotlog.Logger.Errorf("localConn cannot write localProxyBuffer [%s], size is %d", string(buf), n)
-				continue
-			}
-
-			// TODO: gathering buffer with dotmon
-			// w.dotlog.Logger.Debugf("localConn read localProxyBuffer [%s]", w.localProxyBuffer[:n])
 		}
-	}
+
+		w.dotlog.Logger.Debugf("starting monitoring proxy")
+		w.goTracked("local reader", w.monLocalToRemoteProxy)
+		w.goTracked("local writer", w.writeToLocal)
+	})
 }
@@ -10,19 +10,27 @@ package rcn
 //
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"os"
 	"sync"
 
 	"github.com/Notch-Technologies/dotshake/client/grpc"
 	"github.com/Notch-Technologies/dotshake/conf"
 	"github.com/Notch-Technologies/dotshake/dotlog"
 	"github.com/Notch-Technologies/dotshake/iface"
+	"github.com/Notch-Technologies/dotshake/iface/netstack"
 	"github.com/Notch-Technologies/dotshake/rcn/controlplane"
+	"github.com/Notch-Technologies/dotshake/rcn/dns"
+	"github.com/Notch-Technologies/dotshake/rcn/overlayproxy"
 	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type Rcn struct {
-	cp *controlplane.ControlPlane
+	cp   *controlplane.ControlPlane
+	sock *rcnsock.RcnSock
 
 	serverClient grpc.ServerClientImpl
 
@@ -30,6 +38,15 @@ type Rcn struct {
 
 	iface *iface.Iface
 
+	socks5    *overlayproxy.Socks5Server
+	httpProxy *overlayproxy.HTTPServer
+
+	dns *dns.Server
+
+	// tells watchFilter that the policy or the remote peers have changed
+	filterRefresh chan struct{}
+	closed        chan struct{}
+
 	mk string
 	mu *sync.Mutex
 
@@ -41,32 +58,46 @@ func NewRcn(
 	serverClient grpc.ServerClientImpl,
 	clientConf *conf.ClientConf,
 	mk string,
+	mPrivKey string,
 	ch chan struct{},
 	dotlog *dotlog.DotLog,
 ) *Rcn {
+	sock := rcnsock.NewRcnSock(dotlog, ch)
+	if clientConf.RcnSockAddr != "" {
+		sock = rcnsock.NewRcnSockAt(clientConf.RcnSockAddr, dotlog, ch)
+	}
+
 	cp := controlplane.NewControlPlane(
 		signalClient,
 		serverClient,
-		rcnsock.NewRcnSock(dotlog, ch),
+		sock,
 		mk,
+		mPrivKey,
 		clientConf,
 		ch,
 		dotlog,
 	)
 
-	return &Rcn{
-		cp: cp,
+	r := &Rcn{
+		cp:   cp,
+		sock: sock,
 
 		serverClient: serverClient,
 
 		clientConf: clientConf,
 
+		filterRefresh: make(chan struct{}, 1),
+		closed:        make(chan struct{}),
+
 		mk: mk,
 
 		mu: &sync.Mutex{},
 
 		dotlog: dotlog,
 	}
+	sock.SetPrefsApplier(r)
+
+	return r
 }
 
 func (r *Rcn) Start() {
@@ -76,24 +107,147 @@ func (r *Rcn) Start() {
 			r.dotlog.Logger.Errorf("failed to create iface, %s", err.Error())
 		}
 
-		err = r.cp.ConfigureStunTurnConf()
+		r.startControlPlane()
+	}()
+}
+
+// joins the network on a netstack in this process, for the programs embedding dotshake.
+// returns once the netstack is up, the remote peers are connected in the background.
+// unlike the userspace networking mode of the daemon, the connections from the remote peers
+// reach only the listeners of the netstack
+//
+func (r *Rcn) StartNetstack() (*netstack.Device, error) {
+	if !iface.IsUserspaceNetworking(r.clientConf.TunName) {
+		return nil, fmt.Errorf("%s is not a userspace networking interface", r.clientConf.TunName)
+	}
+
+	err := r.newIface()
+	if err != nil {
+		return nil, err
+	}
+
+	ns := r.iface.Netstack()
+	r.sock.SetPinger(ns)
+
+	go r.startControlPlane()
+
+	return ns, nil
+}
+
+func (r *Rcn) startControlPlane() {
+	r.startOverlayProxies()
+
+	err := r.cp.ListenUDPMux()
+	if err != nil {
+		r.dotlog.Logger.Errorf("ice agents listen their own ports without the shared one, %s", err.Error())
+	}
+
+	r.cp.ConnectRelay()
+
+	err = r.cp.ConfigureStunTurnConf()
+	if err != nil {
+		r.dotlog.Logger.Errorf("failed to set up puncher, %s", err.Error())
+	}
+
+	r.cp.ConnectSignalServer()
+
+	go r.cp.WaitForRemoteConn()
+
+	go r.cp.WatchRemoteMachines()
+
+	go r.cp.SyncRemoteMachine()
+
+	go r.cp.MonitorPeerStatus()
+
+	go r.cp.RefreshStunTurnConf()
+
+	err = r.cp.ConfigureExitNode()
+	if err != nil {
+		r.dotlog.Logger.Errorf("failed to configure exit node, %s", err.Error())
+	}
+
+	err = r.cp.ConfigureSubnetRouter()
+	if err != nil {
+		r.dotlog.Logger.Errorf("failed to configure subnet router, %s", err.Error())
+	}
+
+	err = r.startDNS()
+	if err != nil {
+		r.dotlog.Logger.Errorf("failed to start dns server, %s", err.Error())
+	}
+
+	r.cp.OnPeersChanged(r.refreshFilter)
+	go r.watchFilter()
+
+	r.dotlog.Logger.Debugf("started rcn")
+}
+
+// applies the prefs sent by the dotshake command. all of them are validated first,
+// an invalid one leaves the prefs as they were
+//
+func (r *Rcn) ApplyPrefs(p rcnsock.Prefs) error {
+	routes, err := controlplane.ParseRoutes(p.AdvertiseRoutes)
+	if err != nil {
+		return err
+	}
+
+	dnsRoutes, err := dns.NormalizeRoutes(p.DNSRoutes)
+	if err != nil {
+		return err
+	}
+
+	if p.PacketFilter != nil {
+		err = p.PacketFilter.Validate()
 		if err != nil {
-			r.dotlog.Logger.Errorf("failed to set up puncher, %s", err.Error())
+			return err
 		}
+	}
 
-		r.cp.ConnectSignalServer()
+	if p.ExitNode != "" {
+		err = r.cp.ValidateExitNode(p.ExitNode)
+		if err != nil {
+			return err
+		}
+	}
 
-		go r.cp.WaitForRemoteConn()
+	err = r.cp.SetAdvertiseExitNode(p.AdvertiseExitNode)
+	if err != nil {
+		return err
+	}
 
-		// r.cp.StartHangoutMachines()
+	err = r.cp.SetAdvertiseRoutes(routes)
+	if err != nil {
+		return err
+	}
 
-		go r.cp.SyncRemoteMachine()
+	r.mu.Lock()
+	r.clientConf.DNSRoutes = dnsRoutes
+	if r.dns != nil {
+		r.dns.Refresh()
+	}
+	r.clientConf.PacketFilter = p.PacketFilter
+	r.mu.Unlock()
+	r.refreshFilter()
 
-		r.dotlog.Logger.Debugf("started rcn")
-	}()
+	return r.cp.SetExitNode(p.ExitNode)
 }
 
 func (r *Rcn) createIface() error {
+	err := r.newIface()
+	if err != nil {
+		return err
+	}
+
+	// the services of this machine are reachable from the remote peers as through a tun device
+	if ns := r.iface.Netstack(); ns != nil {
+		r.sock.SetPinger(ns)
+		ns.ForwardTCPToLocalhost()
+	}
+
+	return nil
+}
+
+func (r *Rcn) newIface() error {
 	wgPrivateKey, err := wgtypes.ParseKey(r.clientConf.WgPrivateKey)
 	if err != nil {
 		r.dotlog.Logger.Warnf("failed to parse wg private key, because %v", err)
@@ -109,18 +263,187 @@ func (r *Rcn) createIface() error {
 	}
 
 	r.iface = iface.NewIface(r.clientConf.TunName, r.clientConf.WgPrivateKey, m.Ip, m.Cidr, r.dotlog)
+
+	if r.clientConf.IPv6Prefix != "" {
+		addr, err := iface.OverlayIPv6Addr(r.clientConf.IPv6Prefix, wgPrivateKey.PublicKey().String())
+		if err != nil {
+			r.dotlog.Logger.Errorf("failed to build ipv6 overlay address, %s", err.Error())
+		} else {
+			r.iface.IPv6 = addr
+		}
+	}
 	return iface.CreateIface(r.iface, r.dotlog)
 }
 
+// starts the local proxies configured in the client config
+//
+func (r *Rcn) startOverlayProxies() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.clientConf.Socks5Listen != "" {
+		r.socks5 = overlayproxy.NewSocks5Server(r.dialOverlay, r.dotlog)
+		err := r.socks5.ListenAndServe(r.clientConf.Socks5Listen)
+		if err != nil {
+			r.dotlog.Logger.Errorf("failed to listen socks5 proxy on %s, %s", r.clientConf.Socks5Listen, err.Error())
+		}
+	}
+
+	if r.clientConf.HTTPProxyListen != "" {
+		r.httpProxy = overlayproxy.NewHTTPServer(r.dialOverlay, r.dotlog)
+		err := r.httpProxy.ListenAndServe(r.clientConf.HTTPProxyListen)
+		if err != nil {
+			r.dotlog.Logger.Errorf("failed to listen http proxy on %s, %s", r.clientConf.HTTPProxyListen, err.Error())
+		}
+	}
+}
+
+// serves the names of the machines on the overlay address, and points the resolver
+// of the host at it unless the interface is a netstack, which the host cannot reach
+//
+func (r *Rcn) startDNS() error {
+	// nil when the machine could not be fetched
+	if r.iface == nil {
+		return nil
+	}
+
+	ip := net.ParseIP(r.iface.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid overlay ip %s", r.iface.IP)
+	}
+	ips := []net.IP{ip}
+	if ip6, _, err := net.ParseCIDR(r.iface.IPv6); err == nil {
+		ips = append(ips, ip6)
+	}
+
+	s := dns.NewServer(r.clientConf.DNSDomain, r.dialOverlay, r.dotlog)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	s.SetSelf(hostname, ips)
+
+	addr := net.JoinHostPort(ip.String(), "53")
+	ns := r.iface.Netstack()
+
+	var pc net.PacketConn
+	var ln net.Listener
+	if ns != nil {
+		pc, err = ns.ListenPacket("udp", addr)
+		if err == nil {
+			ln, err = ns.Listen("tcp", addr)
+		}
+	} else {
+		pc, err = net.ListenPacket("udp", addr)
+		if err == nil {
+			ln, err = net.Listen("tcp", addr)
+		}
+	}
+	if err != nil {
+		if pc != nil {
+			pc.Close()
+		}
+		return err
+	}
+	s.Serve(pc, ln)
+
+	r.mu.Lock()
+	r.dns = s
+	r.mu.Unlock()
+
+	if ns == nil && !r.clientConf.DisableHostDNS {
+		err = s.ConfigureHost(r.iface.Tun, ip)
+		if err != nil {
+			r.dotlog.Logger.Errorf("failed to configure the resolver of the host, %s", err.Error())
+		}
+	}
+
+	r.cp.OnPeersChanged(s.Refresh)
+	go s.WatchPeers(r.cp.RemoteOverlayIPs, r.dnsRoutes)
+
+	r.dotlog.Logger.Infof("serving dns on %s for %s", addr, s.Domain())
+
+	return nil
+}
+
+// the nameservers of the domains pushed by the server and of the client config,
+// only the ones reachable through the remote peers
+//
+func (r *Rcn) dnsRoutes() map[string][]string {
+	routes, err := dns.ParseRoutes(r.serverClient.DNSRoutes())
+	if err != nil {
+		r.dotlog.Logger.Warnf("ignoring the dns routes from the server, %s", err.Error())
+	}
+
+	r.mu.Lock()
+	local, err := dns.NormalizeRoutes(r.clientConf.DNSRoutes)
+	r.mu.Unlock()
+	if err != nil {
+		r.dotlog.Logger.Warnf("ignoring a dns route of the client config, %s", err.Error())
+	}
+
+	for domain, nameservers := range local {
+		routes[domain] = nameservers
+	}
+
+	reachable := make(map[string][]string)
+	for domain, nameservers := range routes {
+		for _, ns := range nameservers {
+			if r.cp.IsRoutedToPeer(dns.NameserverIP(ns)) {
+				reachable[domain] = append(reachable[domain], ns)
+			}
+		}
+	}
+
+	return reachable
+}
+
+// dials through the netstack when the interface has one, through the kernel otherwise
+//
+func (r *Rcn) dialOverlay(ctx context.Context, network, address string) (net.Conn, error) {
+	if r.iface != nil {
+		if ns := r.iface.Netstack(); ns != nil {
+			return ns.Dial(ctx, network, address)
+		}
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
 func (r *Rcn) Close() {
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	if r.socks5 != nil {
+		r.socks5.Close()
+	}
+	if r.httpProxy != nil {
+		r.httpProxy.Close()
+	}
+	if r.dns != nil {
+		err := r.dns.Close()
+		if err != nil {
+			r.dotlog.Logger.Errorf("failed to close dns server, %s", err.Error())
+		}
+	}
+	r.mu.Unlock()
+
 	err := r.cp.Close()
 	if err != nil {
 		r.dotlog.Logger.Errorf("failed to close control plane, because %s", err.Error())
 	}
 
-	err = iface.RemoveIface(r.iface.Tun, r.dotlog)
-	if err != nil {
-		r.dotlog.Logger.Errorf("failed to remove iface, because %s", err.Error())
+	// nil when the machine could not be fetched
+	if r.iface != nil {
+		err = iface.RemoveIface(r.iface.Tun, r.dotlog)
+		if err != nil {
+			r.dotlog.Logger.Errorf("failed to remove iface, because %s", err.Error())
+		}
 	}
 
 	r.dotlog.Logger.Debugf("closed complete rcn")
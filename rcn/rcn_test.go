@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package rcn
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/login_session"
+	"github.com/Notch-Technologies/client-go/notch/dotshake/v1/machine"
+	"github.com/Notch-Technologies/dotshake/client/grpc"
+	"github.com/Notch-Technologies/dotshake/conf"
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/iface/filter"
+	"github.com/Notch-Technologies/dotshake/rcn/controlplane"
+	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
+	"go.uber.org/zap"
+)
+
+// a server without any remote peer, which records the advertisements
+type fakeServerClient struct {
+	advertised []grpc.Advertise
+}
+
+func (f *fakeServerClient) GetMachine(mk, wgPubKey string) (*machine.GetMachineResponse, error) {
+	return &machine.GetMachineResponse{}, nil
+}
+
+func (f *fakeServerClient) SyncRemoteMachinesConfig(mk string) (*machine.SyncMachinesResponse, error) {
+	return &machine.SyncMachinesResponse{}, nil
+}
+
+func (f *fakeServerClient) ConnectToHangoutMachines(mk string, connected func(), handler func(msg *machine.HangOutMachinesResponse) error) error {
+	return nil
+}
+
+func (f *fakeServerClient) JoinHangoutMachines(mk string) (*machine.HangOutMachinesResponse, error) {
+	return &machine.HangOutMachinesResponse{}, nil
+}
+
+func (f *fakeServerClient) ConnectStreamPeerLoginSession(mk string) (*login_session.PeerLoginSessionResponse, error) {
+	return &login_session.PeerLoginSessionResponse{}, nil
+}
+
+func (f *fakeServerClient) SetAdvertise(a grpc.Advertise) { f.advertised = append(f.advertised, a) }
+func (f *fakeServerClient) DNSRoutes() []string           { return nil }
+func (f *fakeServerClient) PeerTags() []string            { return nil }
+
+// an invalid pref leaves all of them as they were, nothing is advertised
+func TestApplyInvalidPrefs(t *testing.T) {
+	valid := rcnsock.Prefs{
+		AdvertiseExitNode: true,
+		AdvertiseRoutes:   []string{"192.168.1.0/24"},
+		DNSRoutes:         map[string][]string{"corp.example": {"10.0.0.53"}},
+		PacketFilter:      &filter.Policy{Rules: []filter.Rule{{Src: []string{"*"}, Proto: "tcp", Ports: []string{"22"}}}},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *rcnsock.Prefs)
+	}{
+		{"route", func(p *rcnsock.Prefs) { p.AdvertiseRoutes = []string{"192.168.1.0/33"} }},
+		{"default route", func(p *rcnsock.Prefs) { p.AdvertiseRoutes = []string{"0.0.0.0/0"} }},
+		{"dns route", func(p *rcnsock.Prefs) { p.DNSRoutes = map[string][]string{"corp.example": {"ns.corp.example"}} }},
+		{"packet filter", func(p *rcnsock.Prefs) {
+			p.PacketFilter = &filter.Policy{Rules: []filter.Rule{{Src: []string{"*"}, Proto: "sctp"}}}
+		}},
+		{"exit node", func(p *rcnsock.Prefs) { p.ExitNode = "100.64.0.2" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &fakeServerClient{}
+			clientConf := &conf.ClientConf{}
+			dotlog := &dotlog.DotLog{Logger: zap.NewNop().Sugar()}
+			r := &Rcn{
+				cp:           controlplane.NewControlPlane(nil, sc, nil, "mk", "", clientConf, nil, dotlog),
+				serverClient: sc,
+				clientConf:   clientConf,
+				mu:           &sync.Mutex{},
+				dotlog:       dotlog,
+			}
+
+			p := valid
+			tt.modify(&p)
+
+			err := r.ApplyPrefs(p)
+			if err == nil {
+				t.Fatal("applied the invalid prefs")
+			}
+
+			if clientConf.AdvertiseExitNode || clientConf.AdvertiseRoutes != nil || clientConf.DNSRoutes != nil ||
+				clientConf.PacketFilter != nil || clientConf.ExitNode != "" {
+				t.Fatalf("prefs have been applied, %+v", clientConf)
+			}
+			if len(sc.advertised) > 0 {
+				t.Fatalf("advertised %+v", sc.advertised)
+			}
+		})
+	}
+}
@@ -8,20 +8,47 @@ package rcnsock
 //
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/Notch-Technologies/dotshake/client/grpc"
 	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
 )
 
+// how long the daemon waits for the echo reply of a ping
+const pingTimeout = 5 * time.Second
+
+// pings the remote peers through the overlay, the netstack of the userspace networking mode
+type Pinger interface {
+	Ping(ctx context.Context, ip net.IP) (time.Duration, error)
+}
+
+// applies the prefs sent by the dotshake command
+type PrefsApplier interface {
+	ApplyPrefs(p Prefs) error
+}
+
 type RcnSock struct {
 	signalClient grpc.SignalClientImpl
 
+	peerStatus *conn.PeerStatusStore
+
+	pinger       Pinger
+	prefsApplier PrefsApplier
+	mu           *sync.Mutex
+
 	ip   string
 	cidr string
 
+	// unix socket the rcn listens on and the commands dial
+	addr string
+
 	dotlog *dotlog.DotLog
 
 	ch chan struct{}
@@ -32,8 +59,22 @@ type RcnSock struct {
 func NewRcnSock(
 	dotlog *dotlog.DotLog,
 	ch chan struct{},
+) *RcnSock {
+	return NewRcnSockAt(sockaddr, dotlog, ch)
+}
+
+// on another unix socket than the one of the daemon,
+// for the programs embedding the rcn
+//
+func NewRcnSockAt(
+	addr string,
+	dotlog *dotlog.DotLog,
+	ch chan struct{},
 ) *RcnSock {
 	return &RcnSock{
+		mu: &sync.Mutex{},
+
+		addr: addr,
 
 		dotlog: dotlog,
 
@@ -42,8 +83,8 @@ func NewRcnSock(
 }
 
 func (s *RcnSock) cleanup() error {
-	if _, err := os.Stat(sockaddr); err == nil {
-		if err := os.RemoveAll(sockaddr); err != nil {
+	if _, err := os.Stat(s.addr); err == nil {
+		if err := os.RemoveAll(s.addr); err != nil {
 			return err
 		}
 	}
@@ -69,6 +110,12 @@ func (s *RcnSock) listen(conn net.Conn) {
 			mes.DialDotshakeStatus.Ip = s.ip
 			mes.DialDotshakeStatus.Cidr = s.cidr
 			mes.DialDotshakeStatus.Status = status
+		case PeerStatusConn:
+			mes.PeerStatuses = s.peerStatus.List()
+		case PingConn:
+			s.ping(mes.Ping)
+		case PrefsConn:
+			s.applyPrefs(mes.Prefs)
 		}
 
 		err = encoder.Encode(mes)
@@ -79,8 +126,74 @@ func (s *RcnSock) listen(conn net.Conn) {
 	}
 }
 
+func (s *RcnSock) SetPinger(p Pinger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pinger = p
+}
+
+func (s *RcnSock) SetPrefsApplier(a PrefsApplier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prefsApplier = a
+}
+
+func (s *RcnSock) applyPrefs(p *Prefs) {
+	if p == nil {
+		return
+	}
+
+	s.mu.Lock()
+	a := s.prefsApplier
+	s.mu.Unlock()
+
+	if a == nil {
+		p.Error = "the daemon is not running"
+		return
+	}
+
+	err := a.ApplyPrefs(*p)
+	if err != nil {
+		p.Error = err.Error()
+	}
+}
+
+func (s *RcnSock) ping(p *Ping) {
+	if p == nil {
+		return
+	}
+
+	s.mu.Lock()
+	pinger := s.pinger
+	s.mu.Unlock()
+
+	if pinger == nil {
+		p.Error = "ping is served only in the userspace networking mode, use the ping command of the system"
+		return
+	}
+
+	ip := net.ParseIP(p.IP)
+	if ip == nil {
+		p.Error = "invalid ip " + p.IP
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	rtt, err := pinger.Ping(ctx, ip)
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+	p.RTT = rtt
+}
+
 func (s *RcnSock) Connect(
 	signalClient grpc.SignalClientImpl,
+	peerStatus *conn.PeerStatusStore,
 	ip, cidr string,
 ) error {
 	err := s.cleanup()
@@ -91,8 +204,9 @@ func (s *RcnSock) Connect(
 	s.ip = ip
 	s.cidr = cidr
 	s.signalClient = signalClient
+	s.peerStatus = peerStatus
 
-	listener, err := net.Listen("unix", sockaddr)
+	listener, err := net.Listen("unix", s.addr)
 	if err != nil {
 		return err
 	}
@@ -117,7 +231,7 @@ func (s *RcnSock) Connect(
 }
 
 func (s *RcnSock) DialDotshakeStatus() (*DialDotshakeStatus, error) {
-	conn, err := net.Dial("unix", sockaddr)
+	conn, err := net.Dial("unix", s.addr)
 	defer conn.Close()
 	if err != nil {
 		return nil, err
@@ -144,3 +258,100 @@ func (s *RcnSock) DialDotshakeStatus() (*DialDotshakeStatus, error) {
 
 	return d.DialDotshakeStatus, nil
 }
+
+// returns the lifecycle state of each remote machine
+//
+func (s *RcnSock) DialPeerStatus() ([]conn.PeerStatus, error) {
+	c, err := net.Dial("unix", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	decoder := gob.NewDecoder(c)
+	encoder := gob.NewEncoder(c)
+
+	d := &RcnDialSock{
+		MessageType: PeerStatusConn,
+	}
+
+	err = encoder.Encode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	err = decoder.Decode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.PeerStatuses, nil
+}
+
+// pings ip through the overlay of the daemon, returns the round trip time
+//
+func (s *RcnSock) DialPing(ip string) (time.Duration, error) {
+	c, err := net.Dial("unix", s.addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	decoder := gob.NewDecoder(c)
+	encoder := gob.NewEncoder(c)
+
+	d := &RcnDialSock{
+		MessageType: PingConn,
+
+		Ping: &Ping{IP: ip},
+	}
+
+	err = encoder.Encode(d)
+	if err != nil {
+		return 0, err
+	}
+
+	err = decoder.Decode(d)
+	if err != nil {
+		return 0, err
+	}
+
+	if d.Ping.Error != "" {
+		return 0, errors.New(d.Ping.Error)
+	}
+	return d.Ping.RTT, nil
+}
+
+// sends the prefs to the daemon and waits until they have been applied
+//
+func (s *RcnSock) DialPrefs(p Prefs) error {
+	c, err := net.Dial("unix", s.addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	decoder := gob.NewDecoder(c)
+	encoder := gob.NewEncoder(c)
+
+	d := &RcnDialSock{
+		MessageType: PrefsConn,
+
+		Prefs: &p,
+	}
+
+	err = encoder.Encode(d)
+	if err != nil {
+		return err
+	}
+
+	err = decoder.Decode(d)
+	if err != nil {
+		return err
+	}
+
+	if d.Prefs.Error != "" {
+		return errors.New(d.Prefs.Error)
+	}
+	return nil
+}
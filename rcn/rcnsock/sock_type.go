@@ -4,6 +4,13 @@
 
 package rcnsock
 
+import (
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/iface/filter"
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+)
+
 // TODO: (shinta) is this safe?
 // appropriate permission and feel it would be better to
 // have a process that creates a file
@@ -13,7 +20,10 @@ const sockaddr = "/tmp/rcn.sock"
 type socketMessageType int
 
 const (
-	CompletedConn socketMessageType = 0
+	CompletedConn  socketMessageType = 0
+	PeerStatusConn socketMessageType = 1
+	PingConn       socketMessageType = 2
+	PrefsConn      socketMessageType = 3
 )
 
 type DialDotshakeStatus struct {
@@ -26,4 +36,28 @@ type RcnDialSock struct {
 	MessageType socketMessageType
 
 	DialDotshakeStatus *DialDotshakeStatus
+
+	PeerStatuses []conn.PeerStatus
+
+	Ping *Ping
+
+	Prefs *Prefs
+}
+
+type Ping struct {
+	IP string
+
+	RTT   time.Duration
+	Error string
+}
+
+// settings of the daemon changed by the dotshake command while it is running
+type Prefs struct {
+	ExitNode          string
+	AdvertiseExitNode bool
+	AdvertiseRoutes   []string
+	DNSRoutes         map[string][]string
+	PacketFilter      *filter.Policy
+
+	Error string
 }
@@ -0,0 +1,376 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/backoff"
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	keepAliveInterval = 30 * time.Second
+	dialTimeout       = 10 * time.Second
+)
+
+var errNotConnected = errors.New("relay server is not connected")
+
+type Client struct {
+	// tcp://host:port, tls://host:port, ws://host:port/path or wss://host:port/path
+	url string
+	mk  string
+	// the machine private key, the relay server challenges the client to prove it
+	privateKey string
+	token      string
+
+	conn    net.Conn
+	writeMu *sync.Mutex
+
+	// packets from each remote machine
+	conns map[string]*Conn
+
+	// called in a goroutine when a remote machine starts relaying to us
+	onPeer func(remoteMachineKey string)
+
+	closeCh   chan struct{}
+	closeOnce *sync.Once
+
+	mu *sync.Mutex
+
+	dotlog *dotlog.DotLog
+}
+
+func NewClient(
+	url string,
+	mk string,
+	privateKey string,
+	token string,
+	dotlog *dotlog.DotLog,
+) *Client {
+	return &Client{
+		url:        url,
+		mk:         mk,
+		privateKey: privateKey,
+		token:      token,
+
+		writeMu: &sync.Mutex{},
+
+		conns: make(map[string]*Conn),
+
+		closeCh:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+
+		mu: &sync.Mutex{},
+
+		dotlog: dotlog,
+	}
+}
+
+func (c *Client) OnPeer(fn func(remoteMachineKey string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onPeer = fn
+}
+
+// keeps the stream to the relay server open until Close,
+// re-dials with backoff when it is lost
+//
+func (c *Client) Start() {
+	go func() {
+		b := backoff.NewBackoff(1*time.Second, 1*time.Minute)
+
+		for {
+			connectedAt := time.Now()
+			err := c.connect()
+			if time.Since(connectedAt) > keepAliveInterval {
+				b.Reset()
+			}
+
+			select {
+			case <-c.closeCh:
+				return
+			default:
+			}
+
+			d := b.Duration()
+			c.dotlog.Logger.Warnf("relay stream to %s has been closed, reconnect after %s. %v", c.url, d.String(), err)
+
+			select {
+			case <-c.closeCh:
+				return
+			case <-time.After(d):
+			}
+		}
+	}()
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return net.DialTimeout("tcp", u.Host, dialTimeout)
+	case "tls":
+		return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	case "ws", "wss":
+		origin := "http://" + u.Host
+		if u.Scheme == "wss" {
+			origin = "https://" + u.Host
+		}
+
+		conf, err := websocket.NewConfig(c.url, origin)
+		if err != nil {
+			return nil, err
+		}
+		conf.Dialer = &net.Dialer{Timeout: dialTimeout}
+
+		ws, err := websocket.DialConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		return ws, nil
+	default:
+		return nil, fmt.Errorf("unsupported relay url scheme [%s]", u.Scheme)
+	}
+}
+
+// blocks until the stream is closed
+//
+func (c *Client) connect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	hello, err := encodeHello(c.mk, c.token)
+	if err != nil {
+		return err
+	}
+
+	err = writeFrame(conn, frameHello, hello)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxFrameLen)
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	t, body, err := readFrame(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case frameChallenge:
+	case frameError:
+		return fmt.Errorf("relay server refused, %s", string(body))
+	default:
+		return errInvalidFrame
+	}
+
+	err = c.answer(conn, body)
+	if err != nil {
+		return err
+	}
+
+	t, body, err = readFrame(conn, buf)
+	if err != nil {
+		return err
+	}
+
+	switch t {
+	case frameWelcome:
+	case frameError:
+		return fmt.Errorf("relay server refused, %s", string(body))
+	default:
+		return errInvalidFrame
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	c.dotlog.Logger.Infof("connected to relay server %s", c.url)
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go c.keepAlive(stopCh)
+
+	// Close closes the stream to stop reading
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		t, body, err := readFrame(conn, buf)
+		if err != nil {
+			return err
+		}
+
+		switch t {
+		case frameRecv:
+			src, packet, err := decodeAddressed(body)
+			if err != nil {
+				return err
+			}
+			c.deliver(src, packet)
+		case frameError:
+			return fmt.Errorf("relay server error, %s", string(body))
+		}
+	}
+}
+
+// proves that we hold the private key of our machine key
+//
+func (c *Client) answer(conn net.Conn, challenge []byte) error {
+	ephemeral, nonce, err := decodeChallenge(challenge)
+	if err != nil {
+		return err
+	}
+
+	priv, err := machinePrivateKey(c.privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse machine private key, %w", err)
+	}
+
+	mac, err := authMAC(priv, ephemeral, nonce, c.mk)
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(conn, frameAuth, mac)
+}
+
+func (c *Client) keepAlive(stopCh chan struct{}) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			err := c.write(framePing, nil)
+			if err != nil {
+				c.dotlog.Logger.Debugf("failed to ping relay server, %s", err.Error())
+			}
+		}
+	}
+}
+
+func (c *Client) deliver(src string, packet []byte) {
+	c.mu.Lock()
+	pc, ok := c.conns[src]
+	if !ok {
+		pc = newConn(c, src)
+		c.conns[src] = pc
+	}
+	onPeer := c.onPeer
+	c.mu.Unlock()
+
+	pc.deliver(packet)
+
+	if !ok && onPeer != nil {
+		go onPeer(src)
+	}
+}
+
+func (c *Client) write(t frameType, body []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return errNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return writeFrame(conn, t, body)
+}
+
+func (c *Client) send(dst string, packet []byte) error {
+	body, err := encodeAddressed(dst, packet)
+	if err != nil {
+		return err
+	}
+
+	return c.write(frameSend, body)
+}
+
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn != nil
+}
+
+func (c *Client) URL() string {
+	return c.url
+}
+
+// returns the conn to remoteMachineKey through the relay server,
+// packets from it are queued in the conn until it is read
+//
+func (c *Client) Conn(remoteMachineKey string) *Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pc, ok := c.conns[remoteMachineKey]
+	if !ok {
+		pc = newConn(c, remoteMachineKey)
+		c.conns[remoteMachineKey] = pc
+	}
+	return pc
+}
+
+func (c *Client) removeConn(pc *Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conns[pc.remoteMachineKey] == pc {
+		delete(c.conns, pc.remoteMachineKey)
+	}
+}
+
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+	})
+
+	c.mu.Lock()
+	conn := c.conn
+	conns := c.conns
+	c.conns = make(map[string]*Conn)
+	c.mu.Unlock()
+
+	for _, pc := range conns {
+		pc.close()
+	}
+
+	if conn != nil {
+		return conn.Close()
+	}
+
+	return nil
+}
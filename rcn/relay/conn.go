@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// packets queued for a remote machine until they are read,
+// new packets are dropped while it is full
+const connQueueSize = 256
+
+type Addr struct {
+	MachineKey string
+}
+
+func (a *Addr) Network() string { return "relay" }
+func (a *Addr) String() string  { return a.MachineKey }
+
+// Conn is a packet oriented net.Conn to a remote machine through the relay server,
+// each Read returns one packet and each Write sends one packet
+//
+type Conn struct {
+	client           *Client
+	remoteMachineKey string
+
+	recvCh chan []byte
+
+	closeCh   chan struct{}
+	closeOnce *sync.Once
+}
+
+func newConn(client *Client, remoteMachineKey string) *Conn {
+	return &Conn{
+		client:           client,
+		remoteMachineKey: remoteMachineKey,
+
+		recvCh: make(chan []byte, connQueueSize),
+
+		closeCh:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (c *Conn) deliver(packet []byte) {
+	b := make([]byte, len(packet))
+	copy(b, packet)
+
+	select {
+	case <-c.closeCh:
+	case c.recvCh <- b:
+	default:
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, io.EOF
+	case p := <-c.recvCh:
+		return copy(b, p), nil
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	err := c.client.send(c.remoteMachineKey, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+	})
+}
+
+func (c *Conn) Close() error {
+	c.close()
+	c.client.removeConn(c)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return &Addr{MachineKey: c.client.mk}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return &Addr{MachineKey: c.remoteMachineKey}
+}
+
+// deadlines are not supported, Close unblocks Read
+//
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,219 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package relay
+
+// relay carries wireguard packets between machines which can not reach each other
+// with ice, over a tcp, tls or websocket stream to a relay server.
+// packets are addressed by machine key. they are already encrypted by wireguard,
+// so the relay server only sees which machines talk to each other.
+//
+// every frame is a type, the length of the body and the body
+//
+//	type(1) | length(2, big endian) | body
+//
+// hello     client -> server: version(1) | len(1) | machine key | len(1) | token
+// challenge server -> client: ephemeral public key(32) | nonce(32)
+// auth      client -> server: mac(32)
+// welcome   server -> client: empty
+// send      client -> server: len(1) | destination machine key | packet
+// recv      server -> client: len(1) | source machine key | packet
+// ping/pong both directions: empty
+// error     server -> client: message, the server closes the stream after it
+//
+// the machine key is the curve25519 public key of the machine, the client proves that it holds
+// the private key with the mac of the nonce and the machine key, keyed by the x25519 of
+// the private key and the ephemeral public key. so no one else can take over its stream
+//
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const protocolVersion = 2
+
+type frameType byte
+
+const (
+	frameHello frameType = iota + 1
+	frameWelcome
+	frameSend
+	frameRecv
+	framePing
+	framePong
+	frameError
+	frameChallenge
+	frameAuth
+)
+
+const (
+	frameHeaderLen = 3
+	maxFrameLen    = 1<<16 - 1
+	maxKeyLen      = 1<<8 - 1
+
+	nonceLen     = 32
+	challengeLen = 32 + nonceLen
+	macLen       = sha256.Size
+)
+
+var (
+	errFrameTooLarge = errors.New("relay frame too large")
+	errInvalidFrame  = errors.New("invalid relay frame")
+)
+
+func writeFrame(w io.Writer, t frameType, body []byte) error {
+	if len(body) > maxFrameLen {
+		return errFrameTooLarge
+	}
+
+	b := make([]byte, frameHeaderLen+len(body))
+	b[0] = byte(t)
+	binary.BigEndian.PutUint16(b[1:frameHeaderLen], uint16(len(body)))
+	copy(b[frameHeaderLen:], body)
+
+	// one write per frame, websocket sends it as one message
+	_, err := w.Write(b)
+	return err
+}
+
+// buf must be at least maxFrameLen long, the returned body refers to it
+//
+func readFrame(r io.Reader, buf []byte) (frameType, []byte, error) {
+	var h [frameHeaderLen]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(h[1:]))
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return frameType(h[0]), buf[:n], nil
+}
+
+// machine key prefixed with its length, followed by the packet
+//
+func encodeAddressed(mk string, packet []byte) ([]byte, error) {
+	if len(mk) == 0 || len(mk) > maxKeyLen {
+		return nil, fmt.Errorf("invalid machine key length %d", len(mk))
+	}
+
+	b := make([]byte, 1+len(mk)+len(packet))
+	b[0] = byte(len(mk))
+	copy(b[1:], mk)
+	copy(b[1+len(mk):], packet)
+	return b, nil
+}
+
+func decodeAddressed(body []byte) (string, []byte, error) {
+	if len(body) < 1 {
+		return "", nil, errInvalidFrame
+	}
+
+	n := int(body[0])
+	if n == 0 || len(body) < 1+n {
+		return "", nil, errInvalidFrame
+	}
+
+	return string(body[1 : 1+n]), body[1+n:], nil
+}
+
+func encodeHello(mk, token string) ([]byte, error) {
+	if len(mk) == 0 || len(mk) > maxKeyLen || len(token) > maxKeyLen {
+		return nil, errInvalidFrame
+	}
+
+	b := make([]byte, 0, 3+len(mk)+len(token))
+	b = append(b, protocolVersion, byte(len(mk)))
+	b = append(b, mk...)
+	b = append(b, byte(len(token)))
+	b = append(b, token...)
+	return b, nil
+}
+
+func decodeHello(body []byte) (mk, token string, err error) {
+	if len(body) < 2 || body[0] != protocolVersion {
+		return "", "", errInvalidFrame
+	}
+
+	n := int(body[1])
+	if n == 0 || len(body) < 2+n+1 {
+		return "", "", errInvalidFrame
+	}
+	mk = string(body[2 : 2+n])
+
+	rest := body[2+n:]
+	m := int(rest[0])
+	if len(rest) < 1+m {
+		return "", "", errInvalidFrame
+	}
+	token = string(rest[1 : 1+m])
+
+	return mk, token, nil
+}
+
+func encodeChallenge(ephemeral *ecdh.PublicKey, nonce []byte) []byte {
+	b := make([]byte, 0, challengeLen)
+	b = append(b, ephemeral.Bytes()...)
+	b = append(b, nonce...)
+	return b
+}
+
+func decodeChallenge(body []byte) (ephemeral *ecdh.PublicKey, nonce []byte, err error) {
+	if len(body) != challengeLen {
+		return nil, nil, errInvalidFrame
+	}
+
+	ephemeral, err = ecdh.X25519().NewPublicKey(body[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ephemeral, body[32:], nil
+}
+
+// the mac of the nonce and mk, keyed by the x25519 of priv and pub.
+// the client computes it with the machine private key and the ephemeral public key,
+// the server with the ephemeral private key and the machine key
+//
+func authMAC(priv *ecdh.PrivateKey, pub *ecdh.PublicKey, nonce []byte, mk string) ([]byte, error) {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, secret)
+	h.Write(nonce)
+	h.Write([]byte(mk))
+	return h.Sum(nil), nil
+}
+
+// the machine key is the base64 curve25519 public key
+//
+func machinePublicKey(mk string) (*ecdh.PublicKey, error) {
+	k, err := wgtypes.ParseKey(mk)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(k[:])
+}
+
+func machinePrivateKey(privateKey string) (*ecdh.PrivateKey, error) {
+	k, err := wgtypes.ParseKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(k[:])
+}
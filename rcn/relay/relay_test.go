@@ -0,0 +1,223 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const testToken = "relay-test-token"
+
+func testLog() *dotlog.DotLog {
+	return &dotlog.DotLog{Logger: zap.NewNop().Sugar()}
+}
+
+type testMachine struct {
+	mk         string
+	privateKey string
+}
+
+func newTestMachine(t *testing.T) testMachine {
+	t.Helper()
+
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testMachine{mk: k.PublicKey().String(), privateKey: k.String()}
+}
+
+// serves the relay on a loopback port, returns the relay url
+//
+func startServer(t *testing.T, s *Server, ws bool) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ws {
+		go s.ServeWebSocket(ln, "/relay")
+		t.Cleanup(func() { s.Close() })
+		return "ws://" + ln.Addr().String() + "/relay"
+	}
+
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return "tcp://" + ln.Addr().String()
+}
+
+func waitConnected(t *testing.T, clients ...*Client) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, c := range clients {
+		for !c.IsConnected() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s has not connected to the relay server", c.mk)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func readPacket(t *testing.T, c *Conn) []byte {
+	t.Helper()
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		b := make([]byte, 1500)
+		n, err := c.Read(b)
+		ch <- result{b[:n], err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.b
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no packet from %s", c.RemoteAddr().String())
+	}
+	return nil
+}
+
+func TestRelayLoopback(t *testing.T) {
+	for _, ws := range []bool{false, true} {
+		name := "tcp"
+		if ws {
+			name = "websocket"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			url := startServer(t, NewServer(testToken, testLog()), ws)
+
+			a, b := newTestMachine(t), newTestMachine(t)
+
+			ac := NewClient(url, a.mk, a.privateKey, testToken, testLog())
+			bc := NewClient(url, b.mk, b.privateKey, testToken, testLog())
+			ac.Start()
+			bc.Start()
+			defer ac.Close()
+			defer bc.Close()
+
+			peerCh := make(chan string, 1)
+			ac.OnPeer(func(remoteMachineKey string) {
+				peerCh <- remoteMachineKey
+			})
+			waitConnected(t, ac, bc)
+
+			// b starts relaying to a with the first packet, a follows it in OnPeer
+			_, err := bc.Conn(a.mk).Write([]byte("ping"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case mk := <-peerCh:
+				if mk != b.mk {
+					t.Fatalf("relaying peer is %s, want %s", mk, b.mk)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnPeer has not been called")
+			}
+
+			got := readPacket(t, ac.Conn(b.mk))
+			if !bytes.Equal(got, []byte("ping")) {
+				t.Fatalf("got %q, want %q", got, "ping")
+			}
+
+			_, err = ac.Conn(b.mk).Write([]byte("pong"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = readPacket(t, bc.Conn(a.mk))
+			if !bytes.Equal(got, []byte("pong")) {
+				t.Fatalf("got %q, want %q", got, "pong")
+			}
+		})
+	}
+}
+
+func TestRelayRefusesClient(t *testing.T) {
+	a, other := newTestMachine(t), newTestMachine(t)
+
+	tests := []struct {
+		name       string
+		mk         string
+		privateKey string
+		token      string
+		want       string
+	}{
+		{"invalid token", a.mk, a.privateKey, "wrong", "invalid token"},
+		{"no token", a.mk, a.privateKey, "", "invalid token"},
+		// claims the machine key of a without its private key
+		{"not the owner of the machine key", a.mk, other.privateKey, testToken, "invalid machine key proof"},
+		{"not a machine key", "not-a-machine-key", a.privateKey, testToken, "invalid machine key proof"},
+	}
+
+	s := NewServer(testToken, testLog())
+	url := startServer(t, s, false)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(url, tt.mk, tt.privateKey, tt.token, testLog())
+
+			// connect returns once the server has refused the stream
+			err := c.connect()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+			if len(s.Clients()) != 0 {
+				t.Fatalf("refused client has been registered, %v", s.Clients())
+			}
+		})
+	}
+}
+
+// the owner of the machine key keeps its stream when someone else claims it
+//
+func TestRelayKeepsOwnerStream(t *testing.T) {
+	s := NewServer("", testLog())
+	url := startServer(t, s, false)
+
+	a, b, other := newTestMachine(t), newTestMachine(t), newTestMachine(t)
+
+	ac := NewClient(url, a.mk, a.privateKey, "", testLog())
+	bc := NewClient(url, b.mk, b.privateKey, "", testLog())
+	ac.Start()
+	bc.Start()
+	defer ac.Close()
+	defer bc.Close()
+	waitConnected(t, ac, bc)
+
+	impostor := NewClient(url, a.mk, other.privateKey, "", testLog())
+	err := impostor.connect()
+	if err == nil {
+		t.Fatal("impostor has connected")
+	}
+
+	_, err = bc.Conn(a.mk).Write([]byte("still a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readPacket(t, ac.Conn(b.mk))
+	if !bytes.Equal(got, []byte("still a")) {
+		t.Fatalf("got %q, want %q", got, "still a")
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package relay
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// frames queued for a client, new frames are dropped while it is full
+	clientQueueSize = 256
+
+	helloTimeout = 10 * time.Second
+	// clients ping every keepAliveInterval
+	readTimeout = 3 * keepAliveInterval
+)
+
+type serverClient struct {
+	mk   string
+	conn net.Conn
+
+	sendCh chan []byte
+	doneCh chan struct{}
+	once   *sync.Once
+}
+
+func (c *serverClient) close() {
+	c.once.Do(func() {
+		close(c.doneCh)
+		c.conn.Close()
+	})
+}
+
+type Server struct {
+	// clients must present this token in the hello frame, any machine can use the relay when empty.
+	// either way, a client must prove that it holds the private key of its machine key
+	token string
+
+	clients map[string]*serverClient
+
+	listeners []net.Listener
+	closed    bool
+
+	mu *sync.Mutex
+
+	dotlog *dotlog.DotLog
+}
+
+func NewServer(token string, dotlog *dotlog.DotLog) *Server {
+	return &Server{
+		token: token,
+
+		clients: make(map[string]*serverClient),
+
+		mu: &sync.Mutex{},
+
+		dotlog: dotlog,
+	}
+}
+
+// serves relay streams over tcp, or tls when ln is a tls listener
+//
+func (s *Server) Serve(ln net.Listener) error {
+	err := s.addListener(ln)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// serves relay streams over websocket on path
+//
+func (s *Server) ServeWebSocket(ln net.Listener, path string) error {
+	err := s.addListener(ln)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		s.serveConn(ws)
+	}))
+
+	err = http.Serve(ln, mux)
+	if s.isClosed() {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) addListener(ln net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("relay server has been closed")
+	}
+
+	s.listeners = append(s.listeners, ln)
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, maxFrameLen)
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	t, body, err := readFrame(conn, buf)
+	if err != nil {
+		s.dotlog.Logger.Debugf("failed to read hello from %s, %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	if t != frameHello {
+		writeFrame(conn, frameError, []byte("hello is expected"))
+		return
+	}
+
+	mk, token, err := decodeHello(body)
+	if err != nil {
+		writeFrame(conn, frameError, []byte(err.Error()))
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		s.dotlog.Logger.Warnf("[%s] presented an invalid token from %s", mk, conn.RemoteAddr().String())
+		writeFrame(conn, frameError, []byte("invalid token"))
+		return
+	}
+
+	err = s.authenticate(conn, mk, buf)
+	if err != nil {
+		s.dotlog.Logger.Warnf("[%s] failed to prove the machine key from %s, %s", mk, conn.RemoteAddr().String(), err.Error())
+		writeFrame(conn, frameError, []byte("invalid machine key proof"))
+		return
+	}
+
+	c := &serverClient{
+		mk:   mk,
+		conn: conn,
+
+		sendCh: make(chan []byte, clientQueueSize),
+		doneCh: make(chan struct{}),
+		once:   &sync.Once{},
+	}
+
+	err = writeFrame(conn, frameWelcome, nil)
+	if err != nil {
+		return
+	}
+
+	s.register(c)
+	defer s.unregister(c)
+
+	go s.writeLoop(c)
+
+	s.readLoop(c, buf)
+}
+
+// challenges the client to prove that it holds the private key of mk
+//
+func (s *Server) authenticate(conn net.Conn, mk string, buf []byte) error {
+	pub, err := machinePublicKey(mk)
+	if err != nil {
+		return err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, nonceLen)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	err = writeFrame(conn, frameChallenge, encodeChallenge(ephemeral.PublicKey(), nonce))
+	if err != nil {
+		return err
+	}
+
+	t, body, err := readFrame(conn, buf)
+	if err != nil {
+		return err
+	}
+	if t != frameAuth || len(body) != macLen {
+		return errInvalidFrame
+	}
+
+	expected, err := authMAC(ephemeral, pub, nonce, mk)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(body, expected) {
+		return errors.New("mac mismatch")
+	}
+
+	return nil
+}
+
+// the newest stream of a machine key wins, e.g. after the client has reconnected
+//
+func (s *Server) register(c *serverClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.clients[c.mk]; ok {
+		old.close()
+	}
+	s.clients[c.mk] = c
+
+	s.dotlog.Logger.Debugf("[%s] joined from %s", c.mk, c.conn.RemoteAddr().String())
+}
+
+func (s *Server) unregister(c *serverClient) {
+	c.close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clients[c.mk] == c {
+		delete(s.clients, c.mk)
+		s.dotlog.Logger.Debugf("[%s] left", c.mk)
+	}
+}
+
+func (s *Server) readLoop(c *serverClient, buf []byte) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		t, body, err := readFrame(c.conn, buf)
+		if err != nil {
+			return
+		}
+
+		switch t {
+		case framePing:
+			s.enqueue(c, framePong, nil)
+		case frameSend:
+			dst, packet, err := decodeAddressed(body)
+			if err != nil {
+				return
+			}
+			s.forward(c.mk, dst, packet)
+		}
+	}
+}
+
+func (s *Server) forward(src, dst string, packet []byte) {
+	s.mu.Lock()
+	d, ok := s.clients[dst]
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	body, err := encodeAddressed(src, packet)
+	if err != nil {
+		return
+	}
+
+	s.enqueue(d, frameRecv, body)
+}
+
+func (s *Server) enqueue(c *serverClient, t frameType, body []byte) {
+	b := make([]byte, 0, 1+len(body))
+	b = append(b, byte(t))
+	b = append(b, body...)
+
+	select {
+	case c.sendCh <- b:
+	default:
+		// wireguard recovers lost packets, never block the sender on a slow client
+	}
+}
+
+func (s *Server) writeLoop(c *serverClient) {
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		case b := <-c.sendCh:
+			err := writeFrame(c.conn, frameType(b[0]), b[1:])
+			if err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// returns the machine keys of the connected clients
+//
+func (s *Server) Clients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mks := make([]string, 0, len(s.clients))
+	for mk := range s.clients {
+		mks = append(mks, mk)
+	}
+	return mks
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var lastErr error
+	for _, ln := range s.listeners {
+		err := ln.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	for _, c := range s.clients {
+		c.close()
+	}
+	s.clients = make(map[string]*serverClient)
+
+	return lastErr
+}
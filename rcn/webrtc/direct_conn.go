@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// packets queued for the wire proxy, new packets are dropped while it is full
+const directConnQueueSize = 256
+
+// DirectConn is a packet oriented net.Conn to a direct path found by the prober,
+// it shares the socket of the udp mux with the ice agents
+//
+type DirectConn struct {
+	prober           *PathProber
+	remoteMachineKey string
+	addr             *net.UDPAddr
+
+	recvCh chan []byte
+	// unix nano of the latest packet
+	lastReceived int64
+
+	closeCh   chan struct{}
+	closeOnce *sync.Once
+}
+
+func newDirectConn(prober *PathProber, remoteMachineKey string, addr *net.UDPAddr) *DirectConn {
+	return &DirectConn{
+		prober:           prober,
+		remoteMachineKey: remoteMachineKey,
+		addr:             addr,
+
+		recvCh:       make(chan []byte, directConnQueueSize),
+		lastReceived: time.Now().UnixNano(),
+
+		closeCh:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (c *DirectConn) deliver(packet []byte) {
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+
+	b := make([]byte, len(packet))
+	copy(b, packet)
+
+	select {
+	case <-c.closeCh:
+	case c.recvCh <- b:
+	default:
+	}
+}
+
+func (c *DirectConn) LastReceived() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastReceived))
+}
+
+func (c *DirectConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, io.EOF
+	case p := <-c.recvCh:
+		return copy(b, p), nil
+	}
+}
+
+func (c *DirectConn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	return c.prober.writeTo(b, c.addr)
+}
+
+// writes a packet of each message with as few system calls as the platform allows,
+// the addresses of msgs are overwritten
+//
+func (c *DirectConn) WriteBatch(msgs []ipv4.Message) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+
+	return c.prober.writeBatchTo(msgs, c.addr)
+}
+
+func (c *DirectConn) isClosed() bool {
+	select {
+	case <-c.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *DirectConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+	})
+}
+
+func (c *DirectConn) Close() error {
+	c.close()
+	c.prober.removeDirect(c)
+	return nil
+}
+
+func (c *DirectConn) LocalAddr() net.Addr {
+	return c.prober.conns[0].LocalAddr()
+}
+
+func (c *DirectConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// deadlines are not supported, Close unblocks Read
+//
+func (c *DirectConn) SetDeadline(t time.Time) error      { return nil }
+func (c *DirectConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *DirectConn) SetWriteDeadline(t time.Time) error { return nil }
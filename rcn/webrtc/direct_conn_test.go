@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// the packets of a batch are written to the address of the direct path from the socket of the udp mux
+//
+func TestDirectConnWriteBatch(t *testing.T) {
+	m, err := NewUDPMux(0, testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	p, err := NewPathProber(m, "mk", testLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	dc := newDirectConn(p, "remote-mk", peer.LocalAddr().(*net.UDPAddr))
+
+	msgs := make([]ipv4.Message, 8)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{{byte(i)}}
+	}
+	n, err := dc.WriteBatch(msgs)
+	if err != nil || n != len(msgs) {
+		t.Fatalf("wrote %d of %d, %v", n, len(msgs), err)
+	}
+
+	b := make([]byte, 16)
+	for i := range msgs {
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, from, err := peer.ReadFromUDP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || int(b[0]) != i {
+			t.Fatalf("got %v, want packet %d", b[:n], i)
+		}
+		if from.Port != m.Port() {
+			t.Fatalf("written from port %d, want the udp mux port %d", from.Port, m.Port())
+		}
+	}
+
+	dc.close()
+	if _, err := dc.WriteBatch(msgs); err == nil {
+		t.Fatal("closed direct conn has written")
+	}
+}
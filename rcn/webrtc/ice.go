@@ -9,17 +9,21 @@ package webrtc
 //
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/Notch-Technologies/dotshake/backoff"
 	"github.com/Notch-Technologies/dotshake/client/grpc"
 	"github.com/Notch-Technologies/dotshake/dotlog"
 	"github.com/Notch-Technologies/dotshake/iface"
 	"github.com/Notch-Technologies/dotshake/rcn/conn"
 	"github.com/Notch-Technologies/dotshake/rcn/proxy"
 	"github.com/Notch-Technologies/dotshake/rcn/rcnsock"
+	"github.com/Notch-Technologies/dotshake/rcn/relay"
 	"github.com/pion/ice/v2"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -33,17 +37,42 @@ type Ice struct {
 
 	conn *conn.Conn
 
+	// lifecycle state of this peer, shared with the control plane and rcn sock
+	peerStatus *conn.PeerStatusStore
+
+	// credentials of the remote agent currently in use, changes when the remote peer restarts ice
+	remoteCredentials *Credentials
+	connStarted       bool
+
+	restartBackoff *backoff.Backoff
+
+	// closed by Cleanup, stops pending restarts
+	cleanupCh   chan struct{}
+	cleanupOnce *sync.Once
+
 	wireproxy *proxy.WireProxy
 
-	// channel to use when making a peer connection
-	remoteOfferCh  chan Credentials
-	remoteAnswerCh chan Credentials
+	// offers, answers and candidates from the remote peer,
+	// queued until waitingForSignalProcess is started
+	inbox *SignalInbox
+
+	agent *ice.Agent
+	// shared by all agents, owned by the control plane
+	udpMux *UDPMux
 
-	agent           *ice.Agent
-	udpMux          *ice.UDPMuxDefault
-	udpMuxSrflx     *ice.UniversalUDPMuxDefault
-	udpMuxConn      *net.UDPConn
-	udpMuxConnSrflx *net.UDPConn
+	// fallback when ice gives up, nil when no relay server is configured
+	relay     *relay.Client
+	relayConn *relay.Conn
+
+	// direct path found by the prober, and the path to fall back to when it breaks
+	directConn      *DirectConn
+	fallbackConn    net.Conn
+	fallbackRelayed bool
+	// host and server reflexive candidates of the remote peer, probed while relayed
+	remoteDirectAddrs []*net.UDPAddr
+
+	// set while the path mtu is being probed
+	mtuProbing int32
 
 	stunTurn *StunTurnConfig
 
@@ -80,6 +109,12 @@ func NewIce(
 
 	sock *rcnsock.RcnSock,
 
+	peerStatus *conn.PeerStatusStore,
+
+	udpMux *UDPMux,
+
+	relay *relay.Client,
+
 	// remote
 	remoteWgPubKey string,
 	remoteip string,
@@ -102,13 +137,29 @@ func NewIce(
 	closeCh chan struct{},
 ) *Ice {
 	failedtimeout := time.Second * 5
+
+	peerStatus.SetState(remoteMachineKey, conn.PeerNew)
+	peerStatus.Update(remoteMachineKey, func(p *conn.PeerStatus) {
+		p.RemoteWgPubKey = remoteWgPubKey
+	})
+
 	return &Ice{
 		signalClient: signalClient,
 
 		sock: sock,
 
-		remoteOfferCh:  make(chan Credentials),
-		remoteAnswerCh: make(chan Credentials),
+		peerStatus: peerStatus,
+
+		udpMux: udpMux,
+
+		relay: relay,
+
+		restartBackoff: backoff.NewBackoff(restartMinBackoff, restartMaxBackoff),
+
+		cleanupCh:   make(chan struct{}),
+		cleanupOnce: &sync.Once{},
+
+		inbox: NewSignalInbox(signalInboxSize),
 
 		stunTurn: stunTurn,
 
@@ -147,22 +198,22 @@ func (i *Ice) Setup() (err error) {
 	se := NewSigExecuter(i.signalClient, i.remoteMachineKey, i.mk, i.dotlog)
 	i.sigexec = se
 
-	// configure ice agent
-	i.udpMuxConn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: 0})
-	i.udpMuxConnSrflx, err = net.ListenUDP("udp4", &net.UDPAddr{Port: 0})
-
-	i.udpMux = ice.NewUDPMuxDefault(ice.UDPMuxParams{UDPConn: i.udpMuxConn})
-	i.udpMuxSrflx = ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{UDPConn: i.udpMuxConnSrflx})
+	if i.udpMux == nil {
+		return errors.New("udp mux is not listening")
+	}
 
+	// configure ice agent
+	// host and srflx candidates of every agent share the dual stack socket of udpMux,
+	// so udp6 candidates are gathered as well on hosts with ipv6
 	i.agent, err = ice.NewAgent(&ice.AgentConfig{
 		MulticastDNSMode: ice.MulticastDNSModeDisabled,
-		NetworkTypes:     []ice.NetworkType{ice.NetworkTypeUDP4},
+		NetworkTypes:     []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6},
 		Urls:             i.stunTurn.GetStunTurnsURL(),
 		CandidateTypes:   []ice.CandidateType{ice.CandidateTypeHost, ice.CandidateTypeServerReflexive, ice.CandidateTypeRelay},
 		FailedTimeout:    i.failedTimeout,
 		InterfaceFilter:  i.getBlackListWithInterfaceFilter(),
-		UDPMux:           i.udpMux,
-		UDPMuxSrflx:      i.udpMuxSrflx,
+		UDPMux:           i.udpMux.mux,
+		UDPMuxSrflx:      i.udpMux.mux,
 	})
 	if err != nil {
 		return err
@@ -204,40 +255,57 @@ func (i *Ice) Setup() (err error) {
 	return nil
 }
 
-// TODO: (shinta)
-// more detailed handling is needed.
-// by handling failures, we need to establish a connection path using DoubleNat? or
-// Ether(call me エーテル) when a connection cannot be made.
+// failures restart ice, and fall back to the relay server once restarts are given up.
+//
+// (shinta) do not lock mu here, pion calls this function from the agent loop
+// and restart and signaling hold mu while waiting for the agent loop
 func (i *Ice) IceConnectionHasBeenChanged(state ice.ConnectionState) {
+	// pion delivers the closed state after Cleanup, when the peer may have been removed
+	// or replaced by a new Ice with the same machine key
+	if i.isClosed() {
+		i.dotlog.Logger.Debugf("ignore the agent state [%s] of the closed ice of [%s]", state.String(), i.remoteMachineKey)
+		return
+	}
+
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.IceState = state.String()
+	})
+
 	switch state {
 	case ice.ConnectionStateNew: // ConnectionStateNew ICE agent is gathering addresses
 		i.dotlog.Logger.Infof("new connections collected, [%s]", state.String())
 	case ice.ConnectionStateChecking: // ConnectionStateNew ICE agent is gathering addresses
 		i.dotlog.Logger.Infof("checking agent state, [%s]", state.String())
+		i.setState(conn.PeerConnecting)
 	case ice.ConnectionStateConnected: // ConnectionStateConnected ICE agent has a pairing, but is still checking other pairs
 		i.dotlog.Logger.Debugf("agent [%s]", state.String())
+		i.connected()
 	case ice.ConnectionStateCompleted: // ConnectionStateConnected ICE agent has a pairing, but is still checking other pairs
-		err := i.signalClient.Connected()
-		if err != nil {
-			i.dotlog.Logger.Errorf("the agent connection was successful but I received an error in the function that updates the status to connect, [%s]", state.String())
-		}
 		i.dotlog.Logger.Debugf("successfully connected to agent, [%s]", state.String())
+		i.connected()
 	case ice.ConnectionStateFailed: // ConnectionStateFailed ICE agent never could successfully connect
-		err := i.signalClient.DisConnected()
-		if err != nil {
-			i.dotlog.Logger.Errorf("agent connection failed, but failed to set the connection state to disconnect, [%s]", state.String())
-		}
+		i.dotlog.Logger.Warnf("agent connection failed, [%s]", state.String())
+		i.scheduleRestart()
 	case ice.ConnectionStateDisconnected: // ConnectionStateDisconnected ICE agent connected successfully, but has entered a failed state
-		err := i.signalClient.DisConnected()
-		if err != nil {
-			i.dotlog.Logger.Errorf("agent connected successfully, but has entered a failed state, [%s]", state.String())
-		}
+		i.dotlog.Logger.Warnf("agent connected successfully, but has entered a failed state, [%s]", state.String())
+		// the agent may recover by itself, restart only when it turns into failed
+		i.setState(conn.PeerDisconnected)
 	case ice.ConnectionStateClosed: // ConnectionStateClosed ICE agent has finished and is no longer handling requests
 		i.dotlog.Logger.Infof("agent has finished and is no longer handling requests, [%s]", state.String())
 	}
 }
 
 func (i *Ice) IceSelectedHasCandidatePairChanged(local ice.Candidate, remote ice.Candidate) {
+	if i.isClosed() {
+		return
+	}
+
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.LocalCandidateType = local.Type().String()
+		p.RemoteCandidateType = remote.Type().String()
+		p.LocalCandidateAddr = net.JoinHostPort(local.Address(), strconv.Itoa(local.Port()))
+		p.RemoteCandidateAddr = net.JoinHostPort(remote.Address(), strconv.Itoa(remote.Port()))
+	})
 	i.dotlog.Logger.Infof("[CANDIDATE COMPLETED] agent candidates were found, local:[%s] <-> remote:[%s]", local.Address(), remote.Address())
 }
 
@@ -253,10 +321,68 @@ func (i *Ice) ConfigureGatherProcess() error {
 	return nil
 }
 
+// round trip time and loss measured by the wire proxy on the path in use
+//
+func (i *Ice) PathStats() (proxy.PathStats, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wireproxy == nil {
+		return proxy.PathStats{}, false
+	}
+	return i.wireproxy.PathStats(), true
+}
+
+// counters of the traffic proxied for the remote peer, false without a wire proxy
+//
+func (i *Ice) TrafficStats() (proxy.TrafficStats, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wireproxy == nil {
+		return proxy.TrafficStats{}, false
+	}
+	return i.wireproxy.TrafficStats(), true
+}
+
 func (i *Ice) GetRemoteMachineKey() string {
 	return i.remoteMachineKey
 }
 
+func (i *Ice) setLastError(err error) {
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.LastError = err.Error()
+		p.LastErrorAt = time.Now()
+	})
+}
+
+func (i *Ice) GetRemoteWgPubKey() string {
+	return i.remoteWgPubKey
+}
+
+func (i *Ice) GetRemoteIp() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.remoteIp
+}
+
+// replaces the allowed ips of the remote peer, on wireguard as well once the wire proxy is set up.
+// the ice session is kept
+//
+func (i *Ice) UpdateAllowedIPs(remoteip string) error {
+	i.mu.Lock()
+	i.remoteIp = remoteip
+	wireproxy := i.wireproxy
+	i.mu.Unlock()
+
+	if wireproxy == nil {
+		return nil
+	}
+
+	return wireproxy.UpdateAllowedIPs(remoteip)
+}
+
 func (i *Ice) GetLocalMachineKey() string {
 	return i.mk
 }
@@ -285,33 +411,18 @@ func (i *Ice) closeIceAgent() error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	err := i.udpMux.Close()
-	if err != nil {
-		return err
-	}
-
-	err = i.udpMuxSrflx.Close()
-	if err != nil {
-		return err
-	}
-
-	err = i.udpMuxConn.Close()
-	if err != nil {
-		return err
-	}
-
-	err = i.udpMuxConnSrflx.Close()
-	if err != nil {
-		return err
+	// Setup has not been called yet
+	if i.agent == nil {
+		return nil
 	}
 
-	err = i.agent.Close()
-	if err != nil {
+	// closing the agent removes its conns from the shared udp mux,
+	// it has already been closed when the ice conn has been closed
+	err := i.agent.Close()
+	if err != nil && !errors.Is(err, ice.ErrClosed) {
 		return err
 	}
 
-	i.signalClient.DisConnected()
-
 	i.dotlog.Logger.Debugf("completed clean ice agent process")
 
 	return nil
@@ -341,7 +452,7 @@ func (i *Ice) StartGatheringProcess() error {
 }
 
 func (i *Ice) startConn(uname, pwd string) error {
-	i.conn = conn.NewConn(
+	c := conn.NewConn(
 		i.agent,
 		uname,
 		pwd,
@@ -351,7 +462,16 @@ func (i *Ice) startConn(uname, pwd string) error {
 		i.dotlog,
 	)
 
-	err := i.conn.Start()
+	i.mu.Lock()
+	i.conn = c
+	i.mu.Unlock()
+
+	// closed meanwhile, Cleanup has not seen this conn
+	if i.isClosed() {
+		return c.Close()
+	}
+
+	err := c.Start()
 	if err != nil {
 		return err
 	}
@@ -360,8 +480,12 @@ func (i *Ice) startConn(uname, pwd string) error {
 }
 
 func (i *Ice) CloseConn() error {
-	if i.conn != nil {
-		err := i.conn.Close()
+	i.mu.Lock()
+	c := i.conn
+	i.mu.Unlock()
+
+	if c != nil {
+		err := c.Close()
 		if err != nil {
 			return err
 		}
@@ -370,20 +494,32 @@ func (i *Ice) CloseConn() error {
 	return nil
 }
 
+// closes everything of this peer even if a part of it fails,
+// returns the first error
+//
 func (i *Ice) Cleanup() error {
-	if i.conn != nil {
-		err := i.conn.Close()
-		if err != nil {
-			return err
-		}
-	}
+	i.setState(conn.PeerClosed)
+	i.cleanupOnce.Do(func() {
+		close(i.cleanupCh)
+		i.inbox.close()
+	})
+
+	var firstErr error
 
-	err := i.CloseIce()
+	err := i.CloseConn()
 	if err != nil {
-		return err
+		firstErr = err
 	}
 
-	return nil
+	i.releaseDirect()
+	i.closeRelay()
+
+	err = i.CloseIce()
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
 }
 
 func (i *Ice) CloseIce() error {
@@ -395,40 +531,120 @@ func (i *Ice) CloseIce() error {
 	return nil
 }
 
+// replays the signals queued in the inbox in the order they arrived,
+// the agent is ready once this has been started by StartGatheringProcess
+//
 func (i *Ice) waitingForSignalProcess() {
-	var credentials Credentials
-
 	for {
 		select {
-		case credentials = <-i.remoteAnswerCh:
-			i.dotlog.Logger.Debugf("receive credentials from [%s]", i.remoteMachineKey)
-		case credentials = <-i.remoteOfferCh:
-			i.dotlog.Logger.Debugf("receive offer from [%s]", i.remoteMachineKey)
-			err := i.signalAnswer()
+		case <-i.cleanupCh:
+			return
+		case <-i.inbox.notifyCh:
+		}
+
+		for _, msg := range i.inbox.drain() {
+			if i.isClosed() {
+				return
+			}
+
+			switch msg.signalType {
+			case signalTypeCandidate:
+				i.addRemoteCandidate(msg.candidate)
+			case signalTypeOffer, signalTypeAnswer:
+				err := i.receiveCredentials(msg)
+				if err != nil {
+					i.dotlog.Logger.Errorf("failed to gather candidates, %s", err.Error())
+					i.setLastError(err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// only returns an error when the agent can no longer be used
+//
+func (i *Ice) receiveCredentials(msg signalMessage) error {
+	credentials := msg.credentials
+
+	switch msg.signalType {
+	case signalTypeAnswer:
+		i.dotlog.Logger.Debugf("receive credentials from [%s]", i.remoteMachineKey)
+	case signalTypeOffer:
+		i.dotlog.Logger.Debugf("receive offer from [%s]", i.remoteMachineKey)
+
+		// an offer with new credentials after the connection has started
+		// means that the remote peer has restarted ice, so restart ours as well
+		if i.isRemoteRestarted(credentials) {
+			err := i.restartByRemote()
 			if err != nil {
-				i.dotlog.Logger.Errorf("failed to signal offer, %s", err.Error())
+				i.dotlog.Logger.Errorf("failed to restart ice by [%s], %s", i.remoteMachineKey, err.Error())
 			}
 		}
 
-		err := i.agent.GatherCandidates()
+		err := i.signalAnswer()
 		if err != nil {
-			i.dotlog.Logger.Errorf("failed to gather candidates, %s", err.Error())
-			return
+			i.dotlog.Logger.Errorf("failed to signal offer, %s", err.Error())
+		}
+	}
+
+	if i.isConnStarted() {
+		err := i.updateRemoteCredentials(credentials)
+		if err != nil {
+			i.dotlog.Logger.Errorf("failed to update remote credentials of [%s], %s", i.remoteMachineKey, err.Error())
 		}
+		return nil
+	}
+
+	err := i.agent.GatherCandidates()
+	if err != nil {
+		return err
+	}
 
-		err = i.startConn(credentials.UserName, credentials.Pwd)
+	i.mu.Lock()
+	i.remoteCredentials = NewCredentials(credentials.UserName, credentials.Pwd)
+	i.connStarted = true
+	i.mu.Unlock()
+
+	// starting conn blocks until the agent is connected,
+	// keep receiving signals meanwhile so that restarts can be handled
+	go func() {
+		err := i.startConn(credentials.UserName, credentials.Pwd)
 		if err != nil {
 			i.dotlog.Logger.Errorf("failed to start conn, %s", err.Error())
+			i.setLastError(err)
 			return
 		}
 
+		// the wire proxy has switched to the ice conn
+		i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+			p.Relayed = false
+		})
+
 		i.ConnectSock()
+	}()
+
+	return nil
+}
+
+func (i *Ice) addRemoteCandidate(candidate ice.Candidate) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	err := i.agent.AddRemoteCandidate(candidate)
+	if err != nil {
+		i.dotlog.Logger.Errorf("cannot add remote candidate of [%s], %s", i.remoteMachineKey, err.Error())
+		return
 	}
+
+	i.addRemoteDirectAddr(candidate)
+
+	i.dotlog.Logger.Debugf("added candidate of [%s]", i.remoteMachineKey)
 }
 
 func (i *Ice) ConnectSock() {
 	go func() {
-		err := i.sock.Connect(i.signalClient, i.ip, i.cidr)
+		err := i.sock.Connect(i.signalClient, i.peerStatus, i.ip, i.cidr)
 		if err != nil {
 			i.dotlog.Logger.Errorf("failed connect rcn sock, %s", err.Error())
 		}
@@ -473,39 +689,39 @@ func (i *Ice) signalOffer() error {
 }
 
 func (i *Ice) SendRemoteOfferCh(remotemk, uname, pwd string) {
-	select {
-	case i.remoteOfferCh <- *NewCredentials(uname, pwd):
-		i.dotlog.Logger.Debugf("send offer to [%s]", remotemk)
-	default:
-		i.dotlog.Logger.Debugf("%s agent waitForSignalingProcess does not seem to have been started", remotemk)
-	}
+	i.pushSignal(remotemk, signalMessage{
+		signalType:  signalTypeOffer,
+		credentials: *NewCredentials(uname, pwd),
+	})
 }
 
 func (i *Ice) SendRemoteAnswerCh(remotemk, uname, pwd string) {
-	select {
-	case i.remoteAnswerCh <- *NewCredentials(uname, pwd):
-		i.dotlog.Logger.Debugf("send answer to [%s]", remotemk)
-	default:
-		i.dotlog.Logger.Debugf("answer skipping message to %s", remotemk)
-	}
+	i.pushSignal(remotemk, signalMessage{
+		signalType:  signalTypeAnswer,
+		credentials: *NewCredentials(uname, pwd),
+	})
 }
 
 func (i *Ice) SendRemoteCandidate(candidate ice.Candidate) {
-	go func() {
-		i.mu.Lock()
-		defer i.mu.Unlock()
-
-		if i.agent == nil {
-			i.dotlog.Logger.Errorf("agent is nil")
-			return
-		}
+	i.pushSignal(i.remoteMachineKey, signalMessage{
+		signalType: signalTypeCandidate,
+		candidate:  candidate,
+	})
+}
 
-		err := i.agent.AddRemoteCandidate(candidate)
-		if err != nil {
-			i.dotlog.Logger.Errorf("cannot add remote candidate")
-			return
-		}
+func (i *Ice) pushSignal(remotemk string, msg signalMessage) {
+	dropped := i.inbox.push(msg)
+	if dropped == 0 {
+		i.dotlog.Logger.Debugf("queued %s of [%s]", msg.signalType.String(), remotemk)
+		return
+	}
 
-		i.dotlog.Logger.Debugf("send candidate to [%s]", i.remoteMachineKey)
-	}()
+	if msg.signalType == signalTypeCandidate {
+		i.dotlog.Logger.Warnf("signal inbox of [%s] is full, dropped the oldest candidate", remotemk)
+	} else {
+		i.dotlog.Logger.Debugf("%s of [%s] has replaced the queued one, dropped %d signals", msg.signalType.String(), remotemk, dropped)
+	}
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.SignalsDropped = i.inbox.Dropped()
+	})
 }
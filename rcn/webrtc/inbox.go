@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// signals from the remote peer can arrive before the agent is set up
+// or before waitingForSignalProcess has been started.
+// the inbox queues them and replays them in the order they arrived. a newer offer or answer
+// replaces the queued one of the same type along with the candidates queued before it,
+// which belong to the negotiation it replaces
+//
+
+import (
+	"sync"
+
+	"github.com/pion/ice/v2"
+)
+
+// enough for a few rounds of candidates, the oldest candidate is dropped when it is full.
+// the offer and the answer do not count, the negotiation cannot complete without them
+const signalInboxSize = 128
+
+type signalType int
+
+const (
+	signalTypeOffer signalType = iota
+	signalTypeAnswer
+	signalTypeCandidate
+)
+
+func (t signalType) String() string {
+	switch t {
+	case signalTypeOffer:
+		return "offer"
+	case signalTypeAnswer:
+		return "answer"
+	case signalTypeCandidate:
+		return "candidate"
+	default:
+		return "unknown"
+	}
+}
+
+type signalMessage struct {
+	signalType  signalType
+	credentials Credentials
+	candidate   ice.Candidate
+}
+
+type SignalInbox struct {
+	// in the order they arrived
+	queue []signalMessage
+	// candidates in the queue, at most size
+	candidates int
+	size       int
+
+	dropped uint64
+	closed  bool
+
+	// notified when a message is pushed, never blocks the sender
+	notifyCh chan struct{}
+
+	mu *sync.Mutex
+}
+
+func NewSignalInbox(size int) *SignalInbox {
+	return &SignalInbox{
+		queue: make([]signalMessage, 0, size),
+		size:  size,
+
+		notifyCh: make(chan struct{}, 1),
+
+		mu: &sync.Mutex{},
+	}
+}
+
+// returns the number of messages dropped for msg. an offer or an answer replaces the queued one
+// of the same type and the candidates queued before it, a candidate drops the oldest candidate when it is full
+//
+func (s *SignalInbox) push(msg signalMessage) (dropped int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0
+	}
+
+	switch msg.signalType {
+	case signalTypeOffer, signalTypeAnswer:
+		dropped = s.replace(msg.signalType)
+	default:
+		if s.candidates >= s.size {
+			s.removeOldestCandidate()
+			dropped = 1
+		}
+		s.candidates++
+	}
+	s.dropped += uint64(dropped)
+	s.queue = append(s.queue, msg)
+
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+
+	return dropped
+}
+
+// removes the queued offer or answer of t and the candidates queued before the new one,
+// nothing is removed when there is no queued one to replace.
+// be sure to lock mu before calling this function
+//
+func (s *SignalInbox) replace(t signalType) int {
+	found := false
+	for _, m := range s.queue {
+		if m.signalType == t {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0
+	}
+
+	kept := make([]signalMessage, 0, cap(s.queue))
+	for _, m := range s.queue {
+		if m.signalType == t || m.signalType == signalTypeCandidate {
+			continue
+		}
+		kept = append(kept, m)
+	}
+
+	removed := len(s.queue) - len(kept)
+	s.queue = kept
+	s.candidates = 0
+
+	return removed
+}
+
+// be sure to lock mu before calling this function
+//
+func (s *SignalInbox) removeOldestCandidate() {
+	for n, m := range s.queue {
+		if m.signalType == signalTypeCandidate {
+			s.queue = append(s.queue[:n], s.queue[n+1:]...)
+			s.candidates--
+			return
+		}
+	}
+}
+
+// returns the messages in the order they arrived
+//
+func (s *SignalInbox) drain() []signalMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.queue
+	s.queue = make([]signalMessage, 0, s.size)
+	s.candidates = 0
+
+	return msgs
+}
+
+func (s *SignalInbox) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queue)
+}
+
+func (s *SignalInbox) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// messages pushed after close are discarded
+//
+func (s *SignalInbox) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.queue = nil
+	s.candidates = 0
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/ice/v2"
+)
+
+func offer(uname string) signalMessage {
+	return signalMessage{signalType: signalTypeOffer, credentials: Credentials{UserName: uname}}
+}
+
+func answer(uname string) signalMessage {
+	return signalMessage{signalType: signalTypeAnswer, credentials: Credentials{UserName: uname}}
+}
+
+func candidate(t *testing.T, port int) signalMessage {
+	t.Helper()
+
+	c, err := ice.NewCandidateHost(&ice.CandidateHostConfig{
+		Network:   "udp",
+		Address:   "192.0.2.1",
+		Port:      port,
+		Component: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signalMessage{signalType: signalTypeCandidate, candidate: c}
+}
+
+// offer:a, answer:a or candidate:port
+//
+func describe(msgs []signalMessage) string {
+	s := []string{}
+	for _, m := range msgs {
+		if m.signalType == signalTypeCandidate {
+			s = append(s, fmt.Sprintf("candidate:%d", m.candidate.Port()))
+			continue
+		}
+		s = append(s, m.signalType.String()+":"+m.credentials.UserName)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestSignalInbox(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		push    func(t *testing.T) []signalMessage
+		want    string
+		dropped uint64
+	}{
+		{
+			"arrival order",
+			4,
+			func(t *testing.T) []signalMessage {
+				return []signalMessage{candidate(t, 1), offer("a"), candidate(t, 2)}
+			},
+			"candidate:1 offer:a candidate:2",
+			0,
+		},
+		{
+			"newer offer drops the candidates before it",
+			4,
+			func(t *testing.T) []signalMessage {
+				return []signalMessage{offer("a"), candidate(t, 1), candidate(t, 2), offer("b"), candidate(t, 3)}
+			},
+			"offer:b candidate:3",
+			3,
+		},
+		{
+			"newer answer keeps the offer",
+			4,
+			func(t *testing.T) []signalMessage {
+				return []signalMessage{offer("a"), answer("a"), candidate(t, 1), answer("b")}
+			},
+			"offer:a answer:b",
+			2,
+		},
+		{
+			"overflow drops the oldest candidate",
+			2,
+			func(t *testing.T) []signalMessage {
+				return []signalMessage{candidate(t, 1), offer("a"), candidate(t, 2), candidate(t, 3)}
+			},
+			"offer:a candidate:2 candidate:3",
+			1,
+		},
+		{
+			"offers do not count",
+			1,
+			func(t *testing.T) []signalMessage {
+				return []signalMessage{offer("a"), answer("a"), candidate(t, 1)}
+			},
+			"offer:a answer:a candidate:1",
+			0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSignalInbox(tt.size)
+			for _, m := range tt.push(t) {
+				s.push(m)
+			}
+
+			if s.Dropped() != tt.dropped {
+				t.Fatalf("dropped %d, want %d", s.Dropped(), tt.dropped)
+			}
+
+			got := describe(s.drain())
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if s.Len() != 0 {
+				t.Fatalf("%d messages left after drain", s.Len())
+			}
+		})
+	}
+}
+
+func TestSignalInboxClosed(t *testing.T) {
+	s := NewSignalInbox(signalInboxSize)
+	s.push(offer("a"))
+	s.close()
+
+	if n := s.push(candidate(t, 1)); n != 0 {
+		t.Fatalf("dropped %d after close", n)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("%d messages kept after close", s.Len())
+	}
+}
+
+// the candidates count again after drain and replace
+//
+func TestSignalInboxCandidatesAfterDrain(t *testing.T) {
+	s := NewSignalInbox(2)
+	s.push(candidate(t, 1))
+	s.push(candidate(t, 2))
+	s.drain()
+
+	s.push(candidate(t, 3))
+	s.push(candidate(t, 4))
+	if s.Dropped() != 0 {
+		t.Fatalf("dropped %d, want 0", s.Dropped())
+	}
+
+	s.push(offer("a"))
+	s.push(offer("b"))
+	s.push(candidate(t, 5))
+	s.push(candidate(t, 6))
+	if got := describe(s.drain()); got != "offer:b candidate:5 candidate:6" {
+		t.Fatalf("got %q", got)
+	}
+}
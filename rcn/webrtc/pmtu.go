@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+	"github.com/Notch-Technologies/dotshake/wireguard"
+	"github.com/pion/ice/v2"
+)
+
+const (
+	// the largest link mtu probed, jumbo frames are not used
+	maxLinkMTU = 1500
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+)
+
+var errMTUProbing = errors.New("path mtu is already being probed")
+
+// largest udp payload on a link of maxLinkMTU to ip
+//
+func maxDatagram(ip net.IP) int {
+	if ip != nil && ip.To4() == nil {
+		return maxLinkMTU - ipv6HeaderLen - udpHeaderLen
+	}
+	return maxLinkMTU - ipv4HeaderLen - udpHeaderLen
+}
+
+// probes the tunnel mtu of the path in use and records it in the peer status
+// with the path it has been probed on, blocks until the probe has finished
+//
+func (i *Ice) ProbePathMTU(pathID string) (int, error) {
+	if !atomic.CompareAndSwapInt32(&i.mtuProbing, 0, 1) {
+		return 0, errMTUProbing
+	}
+	defer atomic.StoreInt32(&i.mtuProbing, 0)
+
+	mtu, err := i.probePathMTU()
+	if err != nil {
+		return 0, err
+	}
+
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.PathMTU = mtu
+		p.MTUPathID = pathID
+	})
+
+	i.dotlog.Logger.Infof("path mtu of [%s] is %d", i.remoteMachineKey, mtu)
+
+	return mtu, nil
+}
+
+func (i *Ice) IsProbingMTU() bool {
+	return atomic.LoadInt32(&i.mtuProbing) == 1
+}
+
+func (i *Ice) probePathMTU() (int, error) {
+	i.mu.Lock()
+	wireproxy, agent, dc := i.wireproxy, i.agent, i.directConn
+	i.mu.Unlock()
+
+	if wireproxy == nil || wireproxy.RemoteConn() == nil {
+		return 0, errors.New("ice has not been connected yet")
+	}
+
+	switch {
+	case dc != nil && wireproxy.RemoteConn() == net.Conn(dc):
+		return wireproxy.ProbeMTU(maxDatagram(dc.addr.IP))
+	case wireproxy.IsRelayed():
+		// the relay stream never fragments, as large as a wireguard message on a clean link
+		return wireproxy.ProbeMTU(maxDatagram(nil))
+	}
+
+	pair, err := agent.GetSelectedCandidatePair()
+	if err != nil {
+		return 0, err
+	}
+	if pair == nil {
+		return 0, errors.New("no candidate pair has been selected")
+	}
+
+	// turn packets are sent from sockets of the agent without the don't fragment bit,
+	// oversized probes would be fragmented and acked, stay at the safe default
+	if pair.Local.Type() == ice.CandidateTypeRelay || pair.Remote.Type() == ice.CandidateTypeRelay {
+		return wireguard.DefaultMTU, nil
+	}
+
+	return wireproxy.ProbeMTU(maxDatagram(net.ParseIP(pair.Remote.Address())))
+}
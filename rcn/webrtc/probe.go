@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// latency of stun and turn servers.
+// udp servers are probed with a stun binding request, which turn servers answer as well.
+// over tcp and tls the time to establish the connection is used
+//
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/stun"
+)
+
+func probeServer(u *ice.URL, timeout time.Duration) (time.Duration, error) {
+	addr := net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+
+	switch {
+	case u.Scheme == ice.SchemeTypeTURNS || u.Scheme == ice.SchemeTypeSTUNS:
+		return probeTLS(addr, u.Host, timeout)
+	case u.Proto == ice.ProtoTypeTCP:
+		return probeTCP(addr, timeout)
+	default:
+		return probeUDP(addr, timeout)
+	}
+}
+
+func probeUDP(addr string, timeout time.Duration) (time.Duration, error) {
+	c, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return 0, err
+	}
+
+	err = c.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	_, err = c.Write(req.Raw)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+
+		res := &stun.Message{Raw: buf[:n]}
+		if res.Decode() != nil || res.TransactionID != req.TransactionID {
+			continue
+		}
+
+		if res.Type.Class == stun.ClassErrorResponse {
+			return 0, errors.New("binding request has been rejected")
+		}
+
+		return time.Since(start), nil
+	}
+}
+
+func probeTCP(addr string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	return time.Since(start), nil
+}
+
+func probeTLS(addr, serverName string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	c, err := tls.DialWithDialer(
+		&net.Dialer{Timeout: timeout},
+		"tcp", addr,
+		&tls.Config{ServerName: serverName},
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	return time.Since(start), nil
+}
@@ -0,0 +1,479 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// the prober keeps looking for a direct path to the remote peers
+// whose packets go through a turn server or the relay server.
+//
+// it sends stun binding requests from the shared udp mux to the host and
+// server reflexive candidates of the remote peer, with the ufrag probeUfrag so that
+// the udp mux of the remote peer dispatches them to its prober. the messages are
+// authenticated with the ice passwords of the peers. once a response arrives,
+// the wire proxy is switched to the direct path without touching the ice agent,
+// and the previous path is kept to fall back to when the direct path goes silent.
+//
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/pion/stun"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// the udp mux dispatches stun messages with this ufrag to the prober
+	probeUfrag = "dotshakeprobe"
+
+	probeInterval = 20 * time.Second
+	probeTimeout  = 5 * time.Second
+
+	// wireguard keeps the tunnel alive every 25 seconds,
+	// a direct path without any packet for this long is considered broken
+	directPathTimeout = 1 * time.Minute
+)
+
+type pendingProbe struct {
+	remoteMachineKey string
+	addr             *net.UDPAddr
+	sentAt           time.Time
+}
+
+type PathProber struct {
+	// conns of the shared udp mux for ipv4 and ipv6,
+	// both of them write to the same socket
+	conns []net.PacketConn
+	// the socket of the udp mux, nil where it can not write in batches
+	batch *ipv4.PacketConn
+
+	mk string
+
+	peers map[string]*Ice
+
+	// addresses of remote peers which are probed by us or have been verified by their requests
+	paths map[string]string
+	// direct conns by address
+	directs map[string]*DirectConn
+	pending map[[stun.TransactionIDSize]byte]*pendingProbe
+
+	closeCh   chan struct{}
+	closeOnce *sync.Once
+
+	mu *sync.Mutex
+
+	dotlog *dotlog.DotLog
+}
+
+func NewPathProber(udpMux *UDPMux, mk string, dotlog *dotlog.DotLog) (*PathProber, error) {
+	conn4, err := udpMux.mux.GetConn(probeUfrag, false)
+	if err != nil {
+		return nil, err
+	}
+
+	conn6, err := udpMux.mux.GetConn(probeUfrag, true)
+	if err != nil {
+		conn4.Close()
+		return nil, err
+	}
+
+	return &PathProber{
+		conns: []net.PacketConn{conn4, conn6},
+		batch: udpMux.batch,
+
+		mk: mk,
+
+		peers:   make(map[string]*Ice),
+		paths:   make(map[string]string),
+		directs: make(map[string]*DirectConn),
+		pending: make(map[[stun.TransactionIDSize]byte]*pendingProbe),
+
+		closeCh:   make(chan struct{}),
+		closeOnce: &sync.Once{},
+
+		mu: &sync.Mutex{},
+
+		dotlog: dotlog,
+	}, nil
+}
+
+func (p *PathProber) Start() {
+	for _, c := range p.conns {
+		go p.read(c)
+	}
+	go p.loop()
+}
+
+func (p *PathProber) Register(i *Ice) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.peers[i.GetRemoteMachineKey()] = i
+}
+
+func (p *PathProber) Unregister(i *Ice) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mk := i.GetRemoteMachineKey()
+	if p.peers[mk] != i {
+		return
+	}
+	delete(p.peers, mk)
+
+	for addr, pmk := range p.paths {
+		if pmk == mk {
+			delete(p.paths, addr)
+		}
+	}
+
+	for addr, dc := range p.directs {
+		if dc.remoteMachineKey == mk {
+			dc.close()
+			delete(p.directs, addr)
+		}
+	}
+}
+
+func (p *PathProber) getPeer(remoteMachineKey string) (*Ice, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i, ok := p.peers[remoteMachineKey]
+	return i, ok
+}
+
+func (p *PathProber) loop() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case <-ticker.C:
+			p.expirePending()
+
+			p.mu.Lock()
+			peers := make([]*Ice, 0, len(p.peers))
+			for _, i := range p.peers {
+				peers = append(peers, i)
+			}
+			p.mu.Unlock()
+
+			for _, i := range peers {
+				p.probePeer(i)
+			}
+		}
+	}
+}
+
+func (p *PathProber) probePeer(i *Ice) {
+	if i.isClosed() {
+		return
+	}
+
+	if dc := i.getDirectConn(); dc != nil {
+		if !i.isOnDirectPath() {
+			// ice or the relay has taken over the path meanwhile
+			i.releaseDirect()
+			return
+		}
+
+		if time.Since(dc.LastReceived()) > directPathTimeout {
+			i.downgradeFromDirect("no packet on the direct path")
+		}
+		return
+	}
+
+	if !i.isRelayedPath() {
+		return
+	}
+
+	remotePwd := i.remotePwd()
+	if remotePwd == "" {
+		return
+	}
+
+	for _, addr := range i.directCandidates() {
+		err := p.sendProbe(i.GetRemoteMachineKey(), addr, remotePwd)
+		if err != nil {
+			p.dotlog.Logger.Debugf("failed to probe [%s] at %s, %s", i.GetRemoteMachineKey(), addr.String(), err.Error())
+		}
+	}
+}
+
+func (p *PathProber) sendProbe(remoteMachineKey string, addr *net.UDPAddr, remotePwd string) error {
+	req, err := stun.Build(
+		stun.TransactionID,
+		stun.BindingRequest,
+		stun.NewUsername(probeUfrag+":"+p.mk),
+		stun.NewShortTermIntegrity(remotePwd),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.paths[addr.String()] = remoteMachineKey
+	p.pending[req.TransactionID] = &pendingProbe{
+		remoteMachineKey: remoteMachineKey,
+		addr:             addr,
+		sentAt:           time.Now(),
+	}
+	p.mu.Unlock()
+
+	_, err = p.conns[0].WriteTo(req.Raw, addr)
+	return err
+}
+
+func (p *PathProber) expirePending() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, pp := range p.pending {
+		if time.Since(pp.sentAt) > probeTimeout {
+			delete(p.pending, id)
+		}
+	}
+}
+
+func (p *PathProber) read(c net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-p.closeCh:
+				return
+			default:
+			}
+
+			if isClosedConnError(err) {
+				return
+			}
+			continue
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		if stun.IsMessage(buf[:n]) {
+			p.handleStun(c, buf[:n], udpAddr)
+			continue
+		}
+
+		p.handleData(buf[:n], udpAddr)
+	}
+}
+
+func (p *PathProber) handleStun(c net.PacketConn, b []byte, addr *net.UDPAddr) {
+	m := &stun.Message{Raw: append([]byte{}, b...)}
+	if err := m.Decode(); err != nil {
+		return
+	}
+
+	switch m.Type {
+	case stun.BindingRequest:
+		p.handleRequest(c, m, addr)
+	case stun.BindingSuccess:
+		p.handleResponse(m, addr)
+	}
+}
+
+// the remote peer probes us, answer it and remember the address
+//
+func (p *PathProber) handleRequest(c net.PacketConn, m *stun.Message, addr *net.UDPAddr) {
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		return
+	}
+
+	parts := strings.SplitN(username.String(), ":", 2)
+	if len(parts) != 2 || parts[0] != probeUfrag {
+		return
+	}
+	remoteMachineKey := parts[1]
+
+	i, ok := p.getPeer(remoteMachineKey)
+	if !ok {
+		return
+	}
+
+	localPwd, remotePwd := i.localPwd(), i.remotePwd()
+	if localPwd == "" || remotePwd == "" {
+		return
+	}
+
+	if err := stun.NewShortTermIntegrity(localPwd).Check(m); err != nil {
+		p.dotlog.Logger.Debugf("invalid probe of [%s] from %s", remoteMachineKey, addr.String())
+		return
+	}
+
+	res, err := stun.Build(
+		stun.NewTransactionIDSetter(m.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: addr.IP, Port: addr.Port},
+		stun.NewShortTermIntegrity(remotePwd),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.paths[addr.String()] = remoteMachineKey
+	p.mu.Unlock()
+
+	_, err = c.WriteTo(res.Raw, addr)
+	if err != nil {
+		p.dotlog.Logger.Debugf("failed to answer the probe of [%s], %s", remoteMachineKey, err.Error())
+	}
+}
+
+// our probe has reached the remote peer, the direct path works
+//
+func (p *PathProber) handleResponse(m *stun.Message, addr *net.UDPAddr) {
+	p.mu.Lock()
+	pp, ok := p.pending[m.TransactionID]
+	if ok {
+		delete(p.pending, m.TransactionID)
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	i, ok := p.getPeer(pp.remoteMachineKey)
+	if !ok {
+		return
+	}
+
+	if err := stun.NewShortTermIntegrity(i.localPwd()).Check(m); err != nil {
+		p.dotlog.Logger.Debugf("invalid probe response of [%s] from %s", pp.remoteMachineKey, addr.String())
+		return
+	}
+
+	if !i.isRelayedPath() {
+		return
+	}
+
+	i.upgradeToDirect(p.directConn(pp.remoteMachineKey, addr), time.Since(pp.sentAt))
+}
+
+// wireguard packets on a direct path, the remote peer may have
+// switched to it before our probe has been answered
+//
+func (p *PathProber) handleData(b []byte, addr *net.UDPAddr) {
+	p.mu.Lock()
+	remoteMachineKey, ok := p.paths[addr.String()]
+	i := p.peers[remoteMachineKey]
+	p.mu.Unlock()
+
+	if !ok || i == nil {
+		return
+	}
+
+	dc := p.directConn(remoteMachineKey, addr)
+	dc.deliver(b)
+
+	if i.isRelayedPath() {
+		i.upgradeToDirect(dc, 0)
+	}
+}
+
+func (p *PathProber) directConn(remoteMachineKey string, addr *net.UDPAddr) *DirectConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := addr.String()
+	dc, ok := p.directs[key]
+	if ok && !dc.isClosed() && dc.remoteMachineKey == remoteMachineKey {
+		return dc
+	}
+
+	dc = newDirectConn(p, remoteMachineKey, addr)
+	p.directs[key] = dc
+	return dc
+}
+
+func (p *PathProber) removeDirect(dc *DirectConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := dc.addr.String()
+	if p.directs[key] == dc {
+		delete(p.directs, key)
+	}
+}
+
+func (p *PathProber) writeTo(b []byte, addr *net.UDPAddr) (int, error) {
+	return p.conns[0].WriteTo(b, addr)
+}
+
+// writes all of msgs to addr, one by one where the socket can not write them in batches.
+// returns how many of them have been written
+//
+func (p *PathProber) writeBatchTo(msgs []ipv4.Message, addr *net.UDPAddr) (int, error) {
+	if p.batch == nil {
+		for i, m := range msgs {
+			_, err := p.writeTo(m.Buffers[0], addr)
+			if err != nil {
+				return i, err
+			}
+		}
+		return len(msgs), nil
+	}
+
+	for i := range msgs {
+		msgs[i].Addr = addr
+	}
+
+	// sendmmsg may write a part of them
+	written := 0
+	for written < len(msgs) {
+		n, err := p.batch.WriteBatch(msgs[written:], 0)
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (p *PathProber) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+	})
+
+	p.mu.Lock()
+	for _, dc := range p.directs {
+		dc.close()
+	}
+	p.directs = make(map[string]*DirectConn)
+	p.mu.Unlock()
+
+	var lastErr error
+	for _, c := range p.conns {
+		err := c.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// fallback to the relay server when ice can not connect to the remote peer at all.
+// it is started when restarts have been given up, or when the remote peer
+// has started relaying to us
+//
+
+import (
+	"errors"
+
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+)
+
+func (i *Ice) StartRelay() error {
+	if i.relay == nil {
+		return errors.New("no relay server is configured")
+	}
+
+	if i.isClosed() {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wireproxy == nil {
+		return errors.New("ice has not been set up yet")
+	}
+
+	if i.relayConn != nil && i.wireproxy.IsRelayed() {
+		return nil
+	}
+
+	rc := i.relay.Conn(i.remoteMachineKey)
+	err := i.wireproxy.StartRelayProxy(rc)
+	if err != nil {
+		return err
+	}
+	i.relayConn = rc
+
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.Relayed = true
+	})
+
+	i.dotlog.Logger.Infof("relaying [%s] through %s", i.remoteMachineKey, i.relay.URL())
+
+	return nil
+}
+
+func (i *Ice) closeRelay() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.relayConn == nil {
+		return
+	}
+
+	i.relayConn.Close()
+	i.relayConn = nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// recovery of the path to the remote peer.
+// when the agent fails, ice is restarted with new credentials, fresh gathering
+// and a re-offer through SigExecuter, with bounded retries and backoff
+//
+
+import (
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+)
+
+const (
+	maxRestartAttempts = 5
+	restartMinBackoff  = 1 * time.Second
+	restartMaxBackoff  = 30 * time.Second
+)
+
+func (i *Ice) isClosed() bool {
+	select {
+	case <-i.cleanupCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i *Ice) setState(next conn.PeerState) {
+	if next != conn.PeerClosed && i.isClosed() {
+		return
+	}
+
+	if !i.peerStatus.SetState(i.remoteMachineKey, next) {
+		i.dotlog.Logger.Debugf("ignore the state transition of [%s] to %s", i.remoteMachineKey, next.String())
+		return
+	}
+
+	i.dotlog.Logger.Debugf("[%s] is %s", i.remoteMachineKey, next.String())
+}
+
+func (i *Ice) connected() {
+	i.restartBackoff.Reset()
+	i.setState(conn.PeerConnected)
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.Restarts = 0
+	})
+}
+
+// gives up after maxRestartAttempts and leaves the peer failed
+// until the remote peer restarts or the peer is reconfigured
+//
+func (i *Ice) scheduleRestart() {
+	if i.isClosed() {
+		return
+	}
+
+	attempt := i.restartBackoff.Attempt()
+	if attempt >= maxRestartAttempts {
+		i.setState(conn.PeerFailed)
+		i.dotlog.Logger.Warnf("gave up restarting ice for [%s] after %d attempts", i.remoteMachineKey, attempt)
+
+		err := i.StartRelay()
+		if err != nil {
+			i.dotlog.Logger.Errorf("failed to fall back to relay for [%s], %s", i.remoteMachineKey, err.Error())
+			i.setLastError(err)
+		}
+		return
+	}
+
+	d := i.restartBackoff.Duration()
+	i.setState(conn.PeerRestarting)
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.Restarts = attempt + 1
+	})
+
+	i.dotlog.Logger.Infof("restart ice for [%s] after %s, attempt %d", i.remoteMachineKey, d.String(), attempt+1)
+
+	time.AfterFunc(d, func() {
+		err := i.restart()
+		if err != nil {
+			i.dotlog.Logger.Errorf("failed to restart ice for [%s], %s", i.remoteMachineKey, err.Error())
+			i.setLastError(err)
+			i.scheduleRestart()
+		}
+	})
+}
+
+// restart our agent and offer the new credentials to the remote peer
+//
+func (i *Ice) restart() error {
+	if i.isClosed() {
+		return nil
+	}
+
+	err := i.restartAgent()
+	if err != nil {
+		return err
+	}
+
+	return i.signalOffer()
+}
+
+// the remote peer has restarted ice, restart ours to follow it.
+// the answer is sent by the caller
+//
+func (i *Ice) restartByRemote() error {
+	i.setState(conn.PeerRestarting)
+	return i.restartAgent()
+}
+
+func (i *Ice) restartAgent() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	err := i.agent.Restart("", "")
+	if err != nil {
+		return err
+	}
+
+	// the remote credentials and candidates have been cleared by the restart,
+	// the new ones arrive with the answer or offer of the remote peer
+	i.remoteCredentials = nil
+	i.remoteDirectAddrs = nil
+
+	return i.agent.GatherCandidates()
+}
+
+func (i *Ice) isConnStarted() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.connStarted
+}
+
+func (i *Ice) isRemoteRestarted(credentials Credentials) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.connStarted || i.remoteCredentials == nil {
+		return false
+	}
+
+	return i.remoteCredentials.UserName != credentials.UserName || i.remoteCredentials.Pwd != credentials.Pwd
+}
+
+func (i *Ice) updateRemoteCredentials(credentials Credentials) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.remoteCredentials != nil &&
+		i.remoteCredentials.UserName == credentials.UserName &&
+		i.remoteCredentials.Pwd == credentials.Pwd {
+		return nil
+	}
+
+	err := i.agent.SetRemoteCredentials(credentials.UserName, credentials.Pwd)
+	if err != nil {
+		return err
+	}
+
+	i.remoteCredentials = NewCredentials(credentials.UserName, credentials.Pwd)
+
+	return nil
+}
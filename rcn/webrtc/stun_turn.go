@@ -4,26 +4,228 @@
 
 package webrtc
 
-import "github.com/pion/ice/v2"
+// stun and turn servers used by the ice agents.
+// servers come from the signal server and the client config, each with its
+// own credentials and transport. they are ranked by the latency measured by Probe,
+// and agents created afterwards use the fastest reachable ones
+//
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+)
+
+// number of servers of each scheme handed to an agent
+const maxServersPerScheme = 2
+
+type IceServer struct {
+	URL *ice.URL
+
+	// when the credentials expire, zero if they do not
+	Expires time.Time
+
+	// results of the latest probe
+	RTT       time.Duration
+	Reachable bool
+	ProbedAt  time.Time
+}
+
+func NewIceServer(url *ice.URL) *IceServer {
+	return &IceServer{
+		URL:     url,
+		Expires: parseCredentialExpiry(url.Username),
+	}
+}
+
+// the time-limited credentials of the turn rest api have a username
+// like "<unix timestamp of expiry>:<user>"
+//
+func parseCredentialExpiry(username string) time.Time {
+	ts := strings.SplitN(username, ":", 2)[0]
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (s *IceServer) isExpiredWithin(d time.Duration) bool {
+	return !s.Expires.IsZero() && time.Until(s.Expires) < d
+}
 
 type StunTurnConfig struct {
-	Stun *ice.URL
-	Turn *ice.URL
+	servers []*IceServer
+
+	mu *sync.Mutex
+}
+
+func NewStunTurnConfig(urls ...*ice.URL) *StunTurnConfig {
+	s := &StunTurnConfig{
+		mu: &sync.Mutex{},
+	}
+	s.SetURLs(urls)
+	return s
+}
+
+// replaces the servers, e.g. when the credentials have been refreshed.
+// latency of the servers which are still in use is kept until the next probe
+//
+func (s *StunTurnConfig) SetURLs(urls []*ice.URL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := make(map[string]*IceServer)
+	for _, srv := range s.servers {
+		prev[srv.URL.String()] = srv
+	}
+
+	servers := make([]*IceServer, 0, len(urls))
+	for _, u := range urls {
+		if u == nil {
+			continue
+		}
+
+		srv := NewIceServer(u)
+		if p, ok := prev[u.String()]; ok {
+			srv.RTT = p.RTT
+			srv.Reachable = p.Reachable
+			srv.ProbedAt = p.ProbedAt
+		}
+		servers = append(servers, srv)
+	}
+
+	s.servers = servers
 }
 
-func NewStunTurnConfig(
-	stun *ice.URL,
-	turn *ice.URL,
-) *StunTurnConfig {
-	return &StunTurnConfig{
-		Stun: stun,
-		Turn: turn,
+// returns copies of the servers
+//
+func (s *StunTurnConfig) GetServers() []IceServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	servers := make([]IceServer, 0, len(s.servers))
+	for _, srv := range s.servers {
+		servers = append(servers, *srv)
 	}
+	return servers
 }
 
+// returns true when some credentials expire within d
+//
+func (s *StunTurnConfig) IsExpiredWithin(d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, srv := range s.servers {
+		if srv.isExpiredWithin(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// measures the latency of every server concurrently
+//
+func (s *StunTurnConfig) Probe(timeout time.Duration) {
+	s.mu.Lock()
+	urls := make([]*ice.URL, 0, len(s.servers))
+	for _, srv := range s.servers {
+		urls = append(urls, srv.URL)
+	}
+	s.mu.Unlock()
+
+	type result struct {
+		url string
+		rtt time.Duration
+		err error
+	}
+
+	results := make(chan result, len(urls))
+	for _, u := range urls {
+		go func(u *ice.URL) {
+			rtt, err := probeServer(u, timeout)
+			results <- result{url: u.String(), rtt: rtt, err: err}
+		}(u)
+	}
+
+	probed := make(map[string]result)
+	for range urls {
+		r := <-results
+		probed[r.url] = r
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, srv := range s.servers {
+		r, ok := probed[srv.URL.String()]
+		if !ok {
+			continue
+		}
+		srv.RTT = r.rtt
+		srv.Reachable = r.err == nil
+		srv.ProbedAt = now
+	}
+}
+
+// returns the fastest reachable servers of each scheme, stun first, then turn and turns.
+// servers which have not been probed yet are used as they are,
+// and all of them are used when none is reachable
+//
 func (s *StunTurnConfig) GetStunTurnsURL() []*ice.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bySchemes := make(map[ice.SchemeType][]*IceServer)
+	for _, srv := range s.servers {
+		if srv.isExpiredWithin(0) {
+			continue
+		}
+		scheme := srv.URL.Scheme
+		// turns is turn over tls, rank it together with turn
+		if scheme == ice.SchemeTypeTURNS {
+			scheme = ice.SchemeTypeTURN
+		}
+		bySchemes[scheme] = append(bySchemes[scheme], srv)
+	}
+
+	// in a fixed order, each scheme ranked by latency
 	var urls []*ice.URL
-	urls = append(urls, s.Stun)
-	urls = append(urls, s.Turn)
+	for _, scheme := range []ice.SchemeType{ice.SchemeTypeSTUN, ice.SchemeTypeTURN} {
+		for _, srv := range selectServers(bySchemes[scheme]) {
+			urls = append(urls, srv.URL)
+		}
+	}
 	return urls
 }
+
+func selectServers(servers []*IceServer) []*IceServer {
+	candidates := []*IceServer{}
+	for _, srv := range servers {
+		if srv.ProbedAt.IsZero() || srv.Reachable {
+			candidates = append(candidates, srv)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = servers
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Reachable != b.Reachable {
+			return a.Reachable
+		}
+		return a.RTT < b.RTT
+	})
+
+	if len(candidates) > maxServersPerScheme {
+		candidates = candidates[:maxServersPerScheme]
+	}
+	return candidates
+}
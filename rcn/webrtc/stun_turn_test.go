@@ -0,0 +1,188 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v2"
+)
+
+func parseURL(t *testing.T, raw, username string) *ice.URL {
+	t.Helper()
+
+	u, err := ice.ParseURL(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Username = username
+	return u
+}
+
+func TestParseCredentialExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     time.Time
+	}{
+		{"turn rest api", "1656633600:dotshake", time.Unix(1656633600, 0)},
+		{"timestamp only", "1656633600", time.Unix(1656633600, 0)},
+		{"static user", "dotshake", time.Time{}},
+		{"empty", "", time.Time{}},
+		{"zero", "0:dotshake", time.Time{}},
+		{"negative", "-1:dotshake", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseCredentialExpiry(tt.username)
+			if !got.Equal(tt.want) {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStunTurnConfigIsExpiredWithin(t *testing.T) {
+	soon := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + ":dotshake"
+	later := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + ":dotshake"
+
+	tests := []struct {
+		name     string
+		username string
+		within   time.Duration
+		want     bool
+	}{
+		{"expires within", soon, 5 * time.Minute, true},
+		{"expires later", later, 5 * time.Minute, false},
+		{"does not expire", "dotshake", 5 * time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStunTurnConfig(parseURL(t, "turn:turn.example.com:3478", tt.username))
+			if got := s.IsExpiredWithin(tt.within); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectServers(t *testing.T) {
+	probed := time.Now()
+
+	server := func(host string, reachable bool, rtt time.Duration, probedAt time.Time) *IceServer {
+		return &IceServer{
+			URL:       &ice.URL{Scheme: ice.SchemeTypeSTUN, Host: host},
+			Reachable: reachable,
+			RTT:       rtt,
+			ProbedAt:  probedAt,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		servers []*IceServer
+		want    string
+	}{
+		{
+			"fastest reachable first",
+			[]*IceServer{
+				server("a", true, 30*time.Millisecond, probed),
+				server("b", true, 10*time.Millisecond, probed),
+				server("c", true, 20*time.Millisecond, probed),
+			},
+			"b c",
+		},
+		{
+			"unreachable skipped",
+			[]*IceServer{
+				server("a", false, 0, probed),
+				server("b", true, 40*time.Millisecond, probed),
+			},
+			"b",
+		},
+		{
+			"not probed yet used after the reachable ones",
+			[]*IceServer{
+				server("a", false, 0, time.Time{}),
+				server("b", true, 40*time.Millisecond, probed),
+			},
+			"b a",
+		},
+		{
+			"all unreachable",
+			[]*IceServer{
+				server("a", false, 0, probed),
+				server("b", false, 0, probed),
+				server("c", false, 0, probed),
+			},
+			"a b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := []string{}
+			for _, srv := range selectServers(tt.servers) {
+				hosts = append(hosts, srv.URL.Host)
+			}
+			if got := strings.Join(hosts, " "); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStunTurnConfigGetStunTurnsURL(t *testing.T) {
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ":dotshake"
+
+	s := NewStunTurnConfig(
+		parseURL(t, "turns:turn1.example.com:5349", ""),
+		parseURL(t, "turn:turn2.example.com:3478", expired),
+		parseURL(t, "stun:stun1.example.com:3478", ""),
+		parseURL(t, "turn:turn3.example.com:3478", ""),
+	)
+
+	hosts := []string{}
+	for _, u := range s.GetStunTurnsURL() {
+		hosts = append(hosts, u.Host)
+	}
+
+	// stun first, the expired turn server is not handed out
+	want := "stun1.example.com turn1.example.com turn3.example.com"
+	if got := strings.Join(hosts, " "); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// the latency of the servers still in use survives a refresh of the credentials
+//
+func TestStunTurnConfigSetURLsKeepsLatency(t *testing.T) {
+	stun := parseURL(t, "stun:stun1.example.com:3478", "")
+	s := NewStunTurnConfig(stun, parseURL(t, "stun:stun2.example.com:3478", ""))
+
+	s.mu.Lock()
+	s.servers[0].RTT = 15 * time.Millisecond
+	s.servers[0].Reachable = true
+	s.servers[0].ProbedAt = time.Now()
+	s.mu.Unlock()
+
+	s.SetURLs([]*ice.URL{stun, parseURL(t, "stun:stun3.example.com:3478", ""), nil})
+
+	servers := s.GetServers()
+	if len(servers) != 2 {
+		t.Fatalf("got %d servers, want 2", len(servers))
+	}
+	if !servers[0].Reachable || servers[0].RTT != 15*time.Millisecond {
+		t.Fatalf("latency of %s has not been kept, %+v", servers[0].URL.Host, servers[0])
+	}
+	if !servers[1].ProbedAt.IsZero() {
+		t.Fatalf("new server %s has a probe result, %+v", servers[1].URL.Host, servers[1])
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// one udp socket shared by the ice agents of every remote peer.
+// packets are dispatched to the agents by ufrag, and the server reflexive
+// address is cached per stun server, so all agents share one nat mapping
+//
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"github.com/pion/ice/v2"
+	"golang.org/x/net/ipv4"
+)
+
+type UDPMux struct {
+	// used both as the UDPMux for host candidates and
+	// the UDPMuxSrflx for server reflexive candidates
+	mux  *ice.UniversalUDPMuxDefault
+	conn *net.UDPConn
+	// writes packets in batches to the direct paths, nil where the platform can not
+	batch *ipv4.PacketConn
+
+	dotlog *dotlog.DotLog
+}
+
+// listens on port, a random port is used when it is 0.
+// a port set explicitly is not replaced, e.g. the firewall may allow only that one
+//
+func NewUDPMux(port int, dotlog *dotlog.DotLog) (*UDPMux, error) {
+	// dual stack, falls back to ipv4 only on hosts without ipv6
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen ice port %d, %w", port, err)
+	}
+
+	err = setDontFragment(conn)
+	if err != nil {
+		dotlog.Logger.Warnf("failed to set don't fragment on ice port, path mtu may be overestimated. %s", err.Error())
+	}
+
+	err = setMark(conn)
+	if err != nil {
+		dotlog.Logger.Debugf("failed to mark ice port, it can not use an exit node. %s", err.Error())
+	}
+
+	mux := ice.NewUniversalUDPMuxDefault(ice.UniversalUDPMuxParams{UDPConn: conn})
+
+	return &UDPMux{
+		mux:   mux,
+		conn:  conn,
+		batch: newBatchConn(conn),
+
+		dotlog: dotlog,
+	}, nil
+}
+
+func (m *UDPMux) Port() int {
+	return m.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// be sure to close all agents before calling this function
+//
+func (m *UDPMux) Close() error {
+	err := m.mux.Close()
+	if err != nil {
+		return err
+	}
+
+	// the mux does not close the socket, which also stops its read loop
+	return m.conn.Close()
+}
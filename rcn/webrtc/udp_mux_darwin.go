@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+)
+
+// not defined in syscall for darwin
+const (
+	ipDontFrag   = 0x1c
+	ipv6DontFrag = 0x3e
+)
+
+// sets the don't fragment bit on the packets of the udp mux,
+// so that oversized mtu probes are dropped instead of being fragmented
+//
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err4, err6 error
+	err = rc.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipDontFrag, 1)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	// either of them fails on a single stack socket
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+
+	return nil
+}
+
+// no exit node routing on darwin
+//
+func setMark(conn *net.UDPConn) error {
+	return nil
+}
+
+// the dual stack socket refuses the ipv4 addresses written by ipv4.PacketConn,
+// and there is no sendmmsg anyway. packets are written one by one
+//
+func newBatchConn(conn *net.UDPConn) *ipv4.PacketConn {
+	return nil
+}
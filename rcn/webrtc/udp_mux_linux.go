@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/Notch-Technologies/dotshake/wireguard"
+	"golang.org/x/net/ipv4"
+)
+
+// sets the don't fragment bit on the packets of the udp mux,
+// so that oversized mtu probes are dropped instead of being fragmented
+//
+func setDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err4, err6 error
+	err = rc.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+	})
+	if err != nil {
+		return err
+	}
+
+	// either of them fails on a single stack socket
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+
+	return nil
+}
+
+// marks the packets of the udp mux, so that they keep off the tunnel
+// when all the traffic is routed to an exit node. needs CAP_NET_ADMIN
+//
+func setMark(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, wireguard.FwMark)
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// sendmmsg on the dual stack socket, linux takes the ipv4 addresses as they are
+//
+func newBatchConn(conn *net.UDPConn) *ipv4.PacketConn {
+	return ipv4.NewPacketConn(conn)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Notch-Technologies/dotshake/dotlog"
+	"go.uber.org/zap"
+)
+
+func testLog() *dotlog.DotLog {
+	return &dotlog.DotLog{Logger: zap.NewNop().Sugar()}
+}
+
+func TestNewUDPMux(t *testing.T) {
+	used, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	usedPort := used.LocalAddr().(*net.UDPAddr).Port
+
+	tests := []struct {
+		name    string
+		port    int
+		wantErr bool
+	}{
+		{"random port", 0, false},
+		// another port would not be allowed by the firewall set up for this one
+		{"explicit port in use", usedPort, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewUDPMux(tt.port, testLog())
+			if tt.wantErr {
+				if err == nil {
+					m.Close()
+					t.Fatalf("listened port %d instead of failing", m.Port())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			if m.Port() == 0 {
+				t.Fatal("no port has been listened")
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2022 Notch Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD 3-Clause License
+// license that can be found in the LICENSE file.
+
+package webrtc
+
+// switching between the relayed path and a direct path found by the prober.
+// the ice agent and the relay conn are kept as they are while on the direct path,
+// so that the wire proxy can fall back to them without waiting for ice
+//
+
+import (
+	"net"
+	"time"
+
+	"github.com/Notch-Technologies/dotshake/rcn/conn"
+	"github.com/pion/ice/v2"
+)
+
+func (i *Ice) addRemoteDirectAddr(candidate ice.Candidate) {
+	if candidate.NetworkType().IsTCP() {
+		return
+	}
+
+	switch candidate.Type() {
+	case ice.CandidateTypeHost, ice.CandidateTypeServerReflexive:
+	default:
+		return
+	}
+
+	ip := net.ParseIP(candidate.Address())
+	if ip == nil || ip.IsLinkLocalUnicast() {
+		return
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: candidate.Port()}
+	for _, a := range i.remoteDirectAddrs {
+		if a.String() == addr.String() {
+			return
+		}
+	}
+	i.remoteDirectAddrs = append(i.remoteDirectAddrs, addr)
+}
+
+func (i *Ice) directCandidates() []*net.UDPAddr {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	addrs := make([]*net.UDPAddr, len(i.remoteDirectAddrs))
+	copy(addrs, i.remoteDirectAddrs)
+	return addrs
+}
+
+func (i *Ice) localPwd() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.agent == nil {
+		return ""
+	}
+
+	_, pwd, err := i.getLocalUserIceAgentCredentials()
+	if err != nil {
+		return ""
+	}
+	return pwd
+}
+
+func (i *Ice) remotePwd() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.remoteCredentials == nil {
+		return ""
+	}
+	return i.remoteCredentials.Pwd
+}
+
+func (i *Ice) getDirectConn() *DirectConn {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.directConn
+}
+
+func (i *Ice) isOnDirectPath() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wireproxy == nil || i.directConn == nil {
+		return false
+	}
+	return i.wireproxy.RemoteConn() == net.Conn(i.directConn)
+}
+
+// true when wireguard packets go through the relay server or a turn server
+//
+// (shinta) do not hold mu while asking the agent for the selected pair,
+// the agent loop may be waiting for mu in a callback
+func (i *Ice) isRelayedPath() bool {
+	i.mu.Lock()
+	wireproxy, agent, dc := i.wireproxy, i.agent, i.directConn
+	i.mu.Unlock()
+
+	if wireproxy == nil || wireproxy.RemoteConn() == nil || wireproxy.IsNoProxy() {
+		return false
+	}
+
+	if dc != nil && wireproxy.RemoteConn() == net.Conn(dc) {
+		return false
+	}
+
+	if wireproxy.IsRelayed() {
+		return true
+	}
+
+	if agent == nil {
+		return false
+	}
+
+	pair, err := agent.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return false
+	}
+
+	return pair.Local.Type() == ice.CandidateTypeRelay || pair.Remote.Type() == ice.CandidateTypeRelay
+}
+
+func pathName(c net.Conn, relayed bool) string {
+	switch {
+	case c == nil:
+		return "-"
+	case relayed:
+		return "relay"
+	default:
+		return c.RemoteAddr().String()
+	}
+}
+
+func (i *Ice) upgradeToDirect(dc *DirectConn, rtt time.Duration) {
+	if i.isClosed() {
+		return
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wireproxy == nil || i.directConn == dc {
+		return
+	}
+
+	prev, prevRelayed := i.wireproxy.SwitchRemoteConn(dc, false)
+	if old := i.directConn; old != nil {
+		// switched from one direct path to another, keep the original fallback
+		old.Close()
+	} else {
+		i.fallbackConn, i.fallbackRelayed = prev, prevRelayed
+	}
+	i.directConn = dc
+
+	from := pathName(prev, prevRelayed)
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.DirectPath = dc.RemoteAddr().String()
+		p.AddPathChange(conn.PathChange{
+			At:   time.Now(),
+			From: from,
+			To:   p.DirectPath,
+			RTT:  rtt,
+		})
+	})
+
+	i.dotlog.Logger.Infof("upgraded [%s] to the direct path %s from %s", i.remoteMachineKey, dc.RemoteAddr().String(), from)
+}
+
+// switches back to the path used before the upgrade
+//
+func (i *Ice) downgradeFromDirect(reason string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.directConn == nil || i.fallbackConn == nil || i.wireproxy == nil {
+		return
+	}
+
+	dc := i.directConn
+	i.wireproxy.SwitchRemoteConn(i.fallbackConn, i.fallbackRelayed)
+	to := pathName(i.fallbackConn, i.fallbackRelayed)
+
+	i.directConn = nil
+	i.fallbackConn = nil
+	i.fallbackRelayed = false
+	dc.Close()
+
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.DirectPath = ""
+		p.AddPathChange(conn.PathChange{
+			At:     time.Now(),
+			From:   dc.RemoteAddr().String(),
+			To:     to,
+			Reason: reason,
+		})
+	})
+
+	i.dotlog.Logger.Warnf("[%s] fell back to %s from the direct path %s, %s", i.remoteMachineKey, to, dc.RemoteAddr().String(), reason)
+}
+
+// forgets the direct path without touching the wire proxy,
+// e.g. ice or the relay has replaced it
+//
+func (i *Ice) releaseDirect() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.directConn == nil {
+		return
+	}
+
+	i.directConn.Close()
+	i.directConn = nil
+	i.fallbackConn = nil
+	i.fallbackRelayed = false
+
+	i.peerStatus.Update(i.remoteMachineKey, func(p *conn.PeerStatus) {
+		p.DirectPath = ""
+	})
+}
@@ -9,4 +9,35 @@ const (
 	OS         = "os"
 	HostName   = "hostname"
 	WgPubKey   = "wg-pub-key"
+	AuthKey    = "auth-key"
+
+	// request headers of the machine service, see the contract below
+	AdvertiseExitNode = "advertise-exit-node"
+	AdvertiseRoutes   = "advertise-routes"
+
+	// response headers of the machine service, see the contract below
+	DNSRoutes = "dns-routes"
+	PeerTags  = "peer-tags"
 )
+
+// what the client expects of the server about the machine service headers. the protos come from
+// client-go and have no fields for them, so they are carried in the grpc metadata. the server
+// has to implement this side of it, until it does they are ignored.
+//
+// request headers, sent with GetMachine, SyncRemoteMachinesConfig, JoinHangOutMachines
+// and ConnectToHangoutMachines:
+//
+//	advertise-exit-node  "true" or "false", whether this machine forwards the traffic of the others to the internet.
+//	                     the server shares such a machine with 0.0.0.0/0 and ::/0 in its allowed ips,
+//	                     the others use a machine as an exit node only then
+//	advertise-routes     comma separated subnets this machine forwards to, e.g. 192.168.1.0/24,10.0.0.0/16.
+//	                     absent when it advertises none
+//
+// response headers, set by the server on the same calls:
+//
+//	dns-routes  one value per domain, domain=nameserver,nameserver, e.g. corp.example=10.0.0.53,10.0.0.54
+//	peer-tags   one value per remote peer, peer=tag,tag, where peer is a machine key or an overlay ip
+//
+// a response without a response header keeps what the previous responses have set,
+// the server clears it with the header set to an empty value
+//
@@ -10,4 +10,8 @@ const (
 	WgPort             = 51820
 	DefaultMTU         = 1280
 	DefaultWgKeepAlive = 25 * time.Second
+
+	// fwmark of the sockets of wireguard and ice on linux.
+	// the routing to an exit node keeps the marked packets off the tunnel
+	FwMark = 0xd07
 )